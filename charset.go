@@ -0,0 +1,316 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// CharsetReader returns a reader that converts text read from 'input' from
+// the character set named by 'label' to UTF-8. It may be assigned to
+// ReadSettings.CharsetReader, which causes documents declaring one of the
+// supported character sets in their XML declaration to be read correctly.
+//
+// The supported character sets are UTF-8, US-ASCII, ISO-8859-1 (Latin-1),
+// Windows-1252, and UTF-16 in either byte order. Labels are matched without
+// regard to case, and common aliases such as "latin1" and "cp1252" are
+// recognized. ISO-8859-1 is decoded strictly, so bytes 0x80 to 0x9F become
+// C1 control characters; use Windows-1252 for text that uses them for
+// punctuation. Bytes that are invalid in the character set are replaced by
+// the Unicode replacement character U+FFFD.
+//
+// UTF-16 input can't be read through ReadSettings.CharsetReader, since the
+// XML declaration itself must be readable as ASCII. Use ReadSettings.Encoding
+// to read UTF-16 documents instead.
+func CharsetReader(label string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "utf-8", "utf8":
+		return input, nil
+	case "us-ascii", "ascii":
+		return newDecodingReader(input, asciiTable.decode), nil
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "l1":
+		return newDecodingReader(input, latin1Table.decode), nil
+	case "windows-1252", "cp1252", "x-cp1252":
+		return newDecodingReader(input, windows1252Table.decode), nil
+	case "utf-16", "utf16":
+		d := &utf16Decoder{bigEndian: true, detectBOM: true}
+		return newDecodingReader(input, d.decode), nil
+	case "utf-16be":
+		d := &utf16Decoder{bigEndian: true}
+		return newDecodingReader(input, d.decode), nil
+	case "utf-16le":
+		d := &utf16Decoder{bigEndian: false}
+		return newDecodingReader(input, d.decode), nil
+	default:
+		return nil, fmt.Errorf("etree: unsupported charset %q", label)
+	}
+}
+
+// A decodeFunc appends the UTF-8 encoding of the text in 'src' to 'dst' and
+// returns the extended buffer and the number of bytes of 'src' consumed.
+// Bytes that can't be decoded until more input is available are left
+// unconsumed unless 'atEOF' is true.
+type decodeFunc func(dst, src []byte, atEOF bool) ([]byte, int)
+
+// A decodingReader converts the text read from another reader to UTF-8.
+type decodingReader struct {
+	r      io.Reader
+	decode decodeFunc
+	in     []byte // input not yet decoded
+	out    []byte // decoded output not yet read
+	err    error
+}
+
+func newDecodingReader(r io.Reader, decode decodeFunc) *decodingReader {
+	return &decodingReader{r: r, decode: decode}
+}
+
+func (d *decodingReader) Read(p []byte) (n int, err error) {
+	var chunk [4096]byte
+	for len(d.out) == 0 && d.err == nil {
+		n, err := d.r.Read(chunk[:])
+		d.in = append(d.in, chunk[:n]...)
+		var used int
+		d.out, used = d.decode(d.out[:0], d.in, err != nil)
+		d.in = d.in[:copy(d.in, d.in[used:])]
+		d.err = err
+	}
+	n = copy(p, d.out)
+	d.out = d.out[n:]
+	if n == 0 {
+		return 0, d.err
+	}
+	return n, nil
+}
+
+// A charsetTable maps each byte of a single-byte character set to a rune.
+type charsetTable [256]rune
+
+func (t *charsetTable) decode(dst, src []byte, atEOF bool) ([]byte, int) {
+	var buf [utf8.UTFMax]byte
+	for _, b := range src {
+		if r := t[b]; r < utf8.RuneSelf {
+			dst = append(dst, byte(r))
+		} else {
+			n := utf8.EncodeRune(buf[:], r)
+			dst = append(dst, buf[:n]...)
+		}
+	}
+	return dst, len(src)
+}
+
+var (
+	asciiTable       = newCharsetTable(0x80, nil)
+	latin1Table      = newCharsetTable(0x100, nil)
+	windows1252Table = newCharsetTable(0x100, map[byte]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„',
+		0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ',
+		0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ',
+		0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“',
+		0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›',
+		0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+	})
+)
+
+// newCharsetTable creates a table mapping the first 'n' bytes to the runes
+// with the same values, the bytes in 'exceptions' to the given runes, and
+// all remaining bytes to the Unicode replacement character.
+func newCharsetTable(n int, exceptions map[byte]rune) *charsetTable {
+	var t charsetTable
+	for i := range t {
+		if i < n {
+			t[i] = rune(i)
+		} else {
+			t[i] = utf8.RuneError
+		}
+	}
+	for b, r := range exceptions {
+		t[b] = r
+	}
+	return &t
+}
+
+// A utf16Decoder decodes UTF-16 text. If 'detectBOM' is set, a byte order
+// mark at the start of the text overrides the byte order given by
+// 'bigEndian'. A byte order mark matching the byte order is discarded.
+type utf16Decoder struct {
+	bigEndian bool
+	detectBOM bool
+	started   bool
+}
+
+func (u *utf16Decoder) decode(dst, src []byte, atEOF bool) ([]byte, int) {
+	i := 0
+	if !u.started {
+		if len(src) < 2 && !atEOF {
+			return dst, 0
+		}
+		u.started = true
+		if len(src) >= 2 {
+			switch {
+			case src[0] == 0xFE && src[1] == 0xFF && (u.detectBOM || u.bigEndian):
+				u.bigEndian, i = true, 2
+			case src[0] == 0xFF && src[1] == 0xFE && (u.detectBOM || !u.bigEndian):
+				u.bigEndian, i = false, 2
+			}
+		}
+	}
+
+	var buf [utf8.UTFMax]byte
+	for i+1 < len(src) {
+		r, size := u.unit(src[i:]), 2
+		if utf16.IsSurrogate(r) {
+			if i+3 >= len(src) && !atEOF {
+				break
+			}
+			r = utf8.RuneError
+			if i+3 < len(src) {
+				if rr := utf16.DecodeRune(u.unit(src[i:]), u.unit(src[i+2:])); rr != utf8.RuneError {
+					r, size = rr, 4
+				}
+			}
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		dst = append(dst, buf[:n]...)
+		i += size
+	}
+	if atEOF && i < len(src) {
+		dst = append(dst, "�"...)
+		i = len(src)
+	}
+	return dst, i
+}
+
+// unit returns the UTF-16 code unit at the start of 'b'.
+func (u *utf16Decoder) unit(b []byte) rune {
+	if u.bigEndian {
+		return rune(b[0])<<8 | rune(b[1])
+	}
+	return rune(b[1])<<8 | rune(b[0])
+}
+
+// An EncodingError is returned when reading with ReadSettings.ValidateEncoding
+// finds that the input doesn't match its declared character set.
+type EncodingError struct {
+	Encoding string // the character set the input was expected to use
+	Offset   int64  // the byte offset of the mismatch in the input
+	Reason   string // a description of the mismatch
+}
+
+func (err *EncodingError) Error() string {
+	return fmt.Sprintf("etree: input does not match encoding %q at offset %d: %s", err.Encoding, err.Offset, err.Reason)
+}
+
+// validateEncoding returns a reader of the input read from 'r' that checks
+// it against the character set named by 'encoding' or, if 'encoding' is
+// empty, against the character set declared by the input's XML declaration,
+// as described by ReadSettings.ValidateEncoding.
+func validateEncoding(r io.Reader, encoding string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(512)
+
+	if encoding == "" {
+		encoding = "UTF-8"
+		decl := bytes.TrimPrefix(start, utf8BOM)
+		if end := bytes.Index(decl, []byte("?>")); bytes.HasPrefix(decl, []byte("<?xml")) && end > 0 {
+			for _, a := range parsePseudoAttrs(string(decl[len("<?xml"):end])) {
+				if a.key == "encoding" {
+					encoding = a.value
+					break
+				}
+			}
+		}
+	}
+	label := strings.ToLower(strings.TrimSpace(encoding))
+	isUTF16 := strings.HasPrefix(label, "utf-16") || label == "utf16"
+
+	mismatch := func(reason string) error {
+		return &EncodingError{Encoding: encoding, Offset: 0, Reason: reason}
+	}
+	switch {
+	case isUTF16:
+		return br, nil
+	case bytes.HasPrefix(start, []byte{0xFE, 0xFF}), bytes.HasPrefix(start, []byte{0xFF, 0xFE}):
+		return nil, mismatch("UTF-16 byte order mark")
+	case bytes.HasPrefix(start, []byte{0, '<'}), bytes.HasPrefix(start, []byte{'<', 0}):
+		return nil, mismatch("UTF-16 text")
+	case bytes.HasPrefix(start, utf8BOM) && label != "utf-8" && label != "utf8":
+		return nil, mismatch("UTF-8 byte order mark")
+	}
+
+	switch label {
+	case "utf-8", "utf8":
+		return &encodingValidator{r: br, encoding: encoding}, nil
+	case "us-ascii", "ascii":
+		return &encodingValidator{r: br, encoding: encoding, ascii: true}, nil
+	default:
+		return br, nil
+	}
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// An encodingValidator implements a proxy reader that checks that the text
+// read from its encapsulated reader is valid UTF-8, or ASCII if 'ascii' is
+// set. The bytes preceding an invalid byte are returned by one read, and the
+// next read fails with an EncodingError.
+type encodingValidator struct {
+	r        io.Reader
+	encoding string
+	ascii    bool
+	offset   int64  // input offset of the next byte to be returned
+	held     []byte // the start of an incomplete UTF-8 sequence
+	err      error
+}
+
+func (v *encodingValidator) Read(p []byte) (n int, err error) {
+	for v.err == nil {
+		held := copy(p, v.held)
+		if held < len(v.held) {
+			// The buffer is too small to complete the sequence.
+			return 0, io.ErrShortBuffer
+		}
+		n, err = v.r.Read(p[held:])
+		buf := p[:held+n]
+		v.held = v.held[:0]
+
+		i, reason := 0, ""
+		for i < len(buf) && reason == "" {
+			switch r, size := utf8.DecodeRune(buf[i:]); {
+			case r < utf8.RuneSelf:
+				i++
+			case v.ascii:
+				reason = "non-ASCII byte"
+			case !utf8.FullRune(buf[i:]):
+				if err != nil {
+					reason = "incomplete UTF-8 sequence"
+				} else {
+					v.held = append(v.held, buf[i:]...)
+					buf = buf[:i]
+				}
+			case r == utf8.RuneError && size == 1:
+				reason = "invalid UTF-8 sequence"
+			default:
+				i += size
+			}
+		}
+		if reason != "" {
+			v.err = &EncodingError{Encoding: v.encoding, Offset: v.offset + int64(i), Reason: reason}
+			err = nil
+		}
+		v.offset += int64(i)
+		if i > 0 || err != nil {
+			return i, err
+		}
+	}
+	return 0, v.err
+}
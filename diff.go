@@ -0,0 +1,300 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiffOptions determine the behavior of the TextDiff function.
+type DiffOptions struct {
+	// Context is the number of unchanged lines shown before and after each
+	// changed line. Unified diffs conventionally use 3. Default: 0.
+	Context int
+
+	// IgnoreComments causes comments to be left out of the comparison.
+	// Default: false.
+	IgnoreComments bool
+
+	// NameA and NameB are the names given to the documents in the diff's
+	// header lines. Default: "a" and "b".
+	NameA, NameB string
+}
+
+// TextDiff returns a line-oriented diff of the documents 'a' and 'b' in the
+// unified diff format, or the empty string if the documents don't differ.
+// Before they are compared, both documents are written in a canonical form,
+// with the attributes of every element sorted by key, character data
+// containing only whitespace removed, and each element on its own indented
+// line, so that the diff shows meaningful changes rather than differences in
+// attribute order or formatting. The documents themselves are not modified.
+func TextDiff(a, b *Document, opts DiffOptions) string {
+	nameA, nameB := opts.NameA, opts.NameB
+	if nameA == "" {
+		nameA = "a"
+	}
+	if nameB == "" {
+		nameB = "b"
+	}
+
+	ops := diffLines(diffCanonicalLines(a, &opts), diffCanonicalLines(b, &opts))
+	hunks := diffHunks(ops, opts.Context)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+	for _, h := range hunks {
+		h.writeTo(&buf, ops)
+	}
+	return buf.String()
+}
+
+// diffCanonicalLines returns the lines of the canonical form of the document
+// 'd' compared by TextDiff.
+func diffCanonicalLines(d *Document, opts *DiffOptions) []string {
+	c := d.Copy()
+	c.WriteSettings = newWriteSettings()
+	if opts.IgnoreComments {
+		c.WriteSettings.ChildFilter = func(t Token) bool {
+			_, ok := t.(*Comment)
+			return !ok
+		}
+	}
+	c.StripWhitespace()
+	sortAttrsRecursive(&c.Element)
+	c.Indent(2)
+
+	s := strings.TrimSuffix(c.String(), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// sortAttrsRecursive sorts the attributes of the element and of all of its
+// descendants.
+func sortAttrsRecursive(e *Element) {
+	e.SortAttrs()
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			sortAttrsRecursive(c)
+		}
+	}
+}
+
+// A diffOp is a line of a diff, which is either unchanged (' '), deleted
+// from the first text ('-') or inserted into the second text ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest list of operations that transforms the
+// lines 'a' into the lines 'b', computed with the linear space variant of
+// Myers' difference algorithm, so that memory use grows only with the
+// number of lines, however much the texts differ. Within each run of
+// changed lines, the deletions are listed before the insertions.
+func diffLines(a, b []string) []diffOp {
+	offset := (len(a)+len(b)+1)/2 + 2
+	d := differ{
+		a:      a,
+		b:      b,
+		offset: offset,
+		vf:     make([]int, 2*offset+1),
+		vb:     make([]int, 2*offset+1),
+	}
+	d.compare(0, len(a), 0, len(b))
+
+	ops := d.ops
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(ops) && ops[j].kind != ' ' {
+			j++
+		}
+		sort.SliceStable(ops[i:j], func(p, q int) bool {
+			return ops[i+p].kind == '-' && ops[i+q].kind == '+'
+		})
+		i = j
+	}
+	return ops
+}
+
+// A differ holds the state of a diffLines call. The arrays 'vf' and 'vb'
+// record the furthest reaching forward and reverse paths on each diagonal,
+// indexed by the diagonal plus 'offset', and are shared by all the
+// subproblems.
+type differ struct {
+	a, b   []string
+	offset int
+	vf, vb []int
+	ops    []diffOp
+}
+
+// compare appends the operations that transform the lines a[a0:a1] into
+// the lines b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	// Lines common to the start and end of both ranges are unchanged.
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.ops = append(d.ops, diffOp{' ', d.a[a0]})
+		a0, b0 = a0+1, b0+1
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && d.a[a1-suffix-1] == d.b[b1-suffix-1] {
+		suffix++
+	}
+	a1, b1 = a1-suffix, b1-suffix
+
+	switch {
+	case a0 == a1:
+		for _, line := range d.b[b0:b1] {
+			d.ops = append(d.ops, diffOp{'+', line})
+		}
+	case b0 == b1:
+		for _, line := range d.a[a0:a1] {
+			d.ops = append(d.ops, diffOp{'-', line})
+		}
+	default:
+		// Neither range is empty and their first and last lines differ, so
+		// the middle snake splits them into two smaller subproblems.
+		x, y, u, v := d.middleSnake(a0, a1, b0, b1)
+		d.compare(a0, a0+x, b0, b0+y)
+		for _, line := range d.a[a0+x : a0+u] {
+			d.ops = append(d.ops, diffOp{' ', line})
+		}
+		d.compare(a0+u, a1, b0+v, b1)
+	}
+
+	for _, line := range d.a[a1 : a1+suffix] {
+		d.ops = append(d.ops, diffOp{' ', line})
+	}
+}
+
+// middleSnake finds the middle snake of a shortest path transforming the
+// lines a[a0:a1] into the lines b[b0:b1], by searching forward from the
+// start and backward from the end until the two searches overlap. It returns
+// the start (x, y) and end (u, v) of the snake relative to a0 and b0.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x, y, u, v int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	vf, vb, o := d.vf, d.vb, d.offset
+	vf[o+1], vb[o+1] = 0, 0
+
+	for D := 0; D <= (n+m+1)/2; D++ {
+		// Extend the forward paths.
+		for k := -D; k <= D; k += 2 {
+			if k == -D || (k != D && vf[o+k-1] < vf[o+k+1]) {
+				x = vf[o+k+1]
+			} else {
+				x = vf[o+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && d.a[a0+u] == d.b[b0+v] {
+				u, v = u+1, v+1
+			}
+			vf[o+k] = u
+			if kr := delta - k; odd && kr >= -(D-1) && kr <= D-1 && u+vb[o+kr] >= n {
+				return x, y, u, v
+			}
+		}
+
+		// Extend the reverse paths, measured from the ends of the ranges.
+		for k := -D; k <= D; k += 2 {
+			var xr int
+			if k == -D || (k != D && vb[o+k-1] < vb[o+k+1]) {
+				xr = vb[o+k+1]
+			} else {
+				xr = vb[o+k-1] + 1
+			}
+			yr := xr - k
+			ur, vr := xr, yr
+			for ur < n && vr < m && d.a[a1-ur-1] == d.b[b1-vr-1] {
+				ur, vr = ur+1, vr+1
+			}
+			vb[o+k] = ur
+			if kf := delta - k; !odd && kf >= -D && kf <= D && ur+vf[o+kf] >= n {
+				return n - ur, m - vr, n - xr, m - yr
+			}
+		}
+	}
+	panic("etree: diff search failed")
+}
+
+// A diffHunk is a range of diff operations written with a single hunk
+// header.
+type diffHunk struct {
+	start, end int // range of operations
+	aLine      int // first line of the first text in the range
+	bLine      int // first line of the second text in the range
+}
+
+// diffHunks groups the changed operations in 'ops', together with up to
+// 'context' unchanged operations on either side of them, into hunks. Changes
+// separated by no more than twice 'context' unchanged operations share a
+// hunk.
+func diffHunks(ops []diffOp, context int) []diffHunk {
+	var hunks []diffHunk
+	aLine, bLine := 1, 1
+	last := -1 // index of the last change in the current hunk
+	for i, op := range ops {
+		if op.kind != ' ' {
+			if len(hunks) == 0 || i-last > 2*context+1 {
+				start := i - context
+				if start < 0 {
+					start = 0
+				}
+				unchanged := i - start
+				hunks = append(hunks, diffHunk{start: start, aLine: aLine - unchanged, bLine: bLine - unchanged})
+			}
+			last = i
+			h := &hunks[len(hunks)-1]
+			if h.end = last + context + 1; h.end > len(ops) {
+				h.end = len(ops)
+			}
+		}
+		if op.kind != '+' {
+			aLine++
+		}
+		if op.kind != '-' {
+			bLine++
+		}
+	}
+	return hunks
+}
+
+// writeTo writes the hunk's header and operations to the builder 'buf'.
+func (h *diffHunk) writeTo(buf *strings.Builder, ops []diffOp) {
+	aLen, bLen := 0, 0
+	for _, op := range ops[h.start:h.end] {
+		if op.kind != '+' {
+			aLen++
+		}
+		if op.kind != '-' {
+			bLen++
+		}
+	}
+	aLine, bLine := h.aLine, h.bLine
+	if aLen == 0 {
+		aLine--
+	}
+	if bLen == 0 {
+		bLine--
+	}
+	fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", aLine, aLen, bLine, bLen)
+	for _, op := range ops[h.start:h.end] {
+		buf.WriteByte(op.kind)
+		buf.WriteString(op.line)
+		buf.WriteByte('\n')
+	}
+}
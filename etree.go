@@ -4,17 +4,36 @@
 
 // Package etree provides XML services through an Element Tree
 // abstraction.
+//
+// A document or element tree may be read by multiple goroutines at once,
+// provided that none of them modifies it. The methods that only read a tree
+// include the Find*, Select*, Get* and Text methods, Copy, and the WriteTo*
+// methods of elements and documents; a compiled Path may also be shared by
+// goroutines evaluating it. Methods that change the tree, including the
+// Indent methods, BuildChildIndex and reading into an existing document,
+// must not run concurrently with any other use of the same tree. Callers
+// that need to update a shared tree should guard it with a sync.RWMutex,
+// holding the read lock while querying and the write lock while modifying.
 package etree
 
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -23,9 +42,38 @@ const (
 	NoIndent = -1
 )
 
+// xmlNamespaceURI is the namespace URI to which the xml prefix is bound.
+const xmlNamespaceURI = "http://www.w3.org/XML/1998/namespace"
+
+// xmlnsNamespaceURI is the namespace URI to which namespace declaration
+// attributes belong.
+const xmlnsNamespaceURI = "http://www.w3.org/2000/xmlns/"
+
 // ErrXML is returned when XML parsing fails due to incorrect formatting.
 var ErrXML = errors.New("etree: invalid XML format")
 
+// ErrAttrNotFound is returned by the ParseAttr* methods when the element has
+// no attribute with the requested key.
+var ErrAttrNotFound = errors.New("etree: attribute not found")
+
+// ErrNotFound is returned by FindElementErr and FindExactlyOne when no
+// element matches the path.
+var ErrNotFound = errors.New("etree: no element matches the path")
+
+// ErrMultiple is returned by FindExactlyOne when more than one element
+// matches the path.
+var ErrMultiple = errors.New("etree: more than one element matches the path")
+
+// ErrCycle is returned by MoveTo, and is the value with which AddChild and
+// the other methods that add child tokens panic, when an element would
+// become a child of itself or of one of its descendants.
+var ErrCycle = errors.New("etree: element cannot be added to its own subtree")
+
+// ErrOutputLimit is returned by the Document's WriteTo* methods and the
+// other serialization methods when the output would exceed the limit set by
+// WriteSettings.MaxOutputBytes.
+var ErrOutputLimit = errors.New("etree: output exceeds the maximum size")
+
 // ReadSettings determine the default behavior of the Document's ReadFrom*
 // methods.
 type ReadSettings struct {
@@ -36,8 +84,80 @@ type ReadSettings struct {
 	// or attribute values. Default: false.
 	Permissive bool
 
+	// RepairTags causes elements left open by a mismatched end tag or by the
+	// end of the input to be closed automatically, and end tags that match
+	// no open element to be dropped, instead of failing with ErrXML. Use
+	// Document.ReadFromDiag to find out which corrections were made.
+	// Default: false.
+	RepairTags bool
+
 	// Entity to be passed to standard xml.Decoder. Default: nil.
 	Entity map[string]string
+
+	// Verbatim causes the source text of each element tag, character data
+	// token and processing instruction to be recorded as it is read, so that
+	// unmodified tokens can be reproduced exactly when the document is written
+	// with WriteSettings.Verbatim. Verbatim reading requires UTF-8 input.
+	// Default: false.
+	Verbatim bool
+
+	// Decompress causes input that starts with the gzip magic bytes to be
+	// decompressed while it is read. Input that is not gzip-compressed is
+	// read unchanged. When Decompress is set, the byte counts returned by
+	// the ReadFrom methods are the number of decompressed bytes read.
+	// Default: false.
+	Decompress bool
+
+	// TrackOffsets causes the byte offsets at which each element's start tag
+	// begins and its end tag ends to be recorded as it is read. The offsets
+	// can be retrieved with Element.SourceRange. Default: false.
+	TrackOffsets bool
+
+	// TrackPositions causes the line and column at which each element's
+	// start tag begins to be recorded as it is read. The position can be
+	// retrieved with Element.SourcePos. Default: false.
+	TrackPositions bool
+
+	// Encoding, if not empty, names the character set of the input, which
+	// is converted to UTF-8 before it is parsed. Any encoding declared by
+	// the input's XML declaration is then ignored, and CharsetReader is not
+	// used. Unlike CharsetReader, Encoding can be used to read UTF-16
+	// documents. See the CharsetReader function for the supported character
+	// sets. Default: "".
+	Encoding string
+
+	// ExpandNamespaces causes the namespace prefix of each element and of
+	// each prefixed attribute to be replaced by the namespace URI it is
+	// bound to as the document is read, so that Space holds a URI and an
+	// element has the same Space in every document regardless of the prefix
+	// used. Unprefixed elements in a default namespace also get its URI.
+	// Namespace declarations are kept unchanged, and prefixes bound to no
+	// namespace or to a URI that is itself a valid prefix are left alone.
+	// When an expanded element or attribute is written, the nearest
+	// in-scope prefix declared for its URI is used. If no declaration binds
+	// the URI, as after the element is copied or detached, a prefix of the
+	// form "nsN" is declared for it on the outermost written element using
+	// it. Default: false.
+	ExpandNamespaces bool
+
+	// CoalesceText causes adjacent character data tokens, such as text
+	// followed by a CDATA section, to be merged into a single CharData token
+	// as they are read, so that an element has at most one CharData token
+	// between any two other tokens. The merged token is a CDATA section only
+	// if all of the merged tokens were CDATA sections, and is otherwise
+	// simple text. Default: false.
+	CoalesceText bool
+
+	// ValidateEncoding causes the input to be checked against the character
+	// set named by Encoding or, if Encoding is empty, the character set
+	// declared by the input's XML declaration, which defaults to UTF-8. If
+	// the input starts with a byte order mark or the pattern of UTF-16 text
+	// that doesn't match the character set, or if the character set is UTF-8
+	// or US-ASCII and the input contains a byte that is invalid in it,
+	// reading fails with an *EncodingError reporting the offset of the
+	// mismatch. The content of input in other character sets is not checked.
+	// Default: false.
+	ValidateEncoding bool
 }
 
 // newReadSettings creates a default ReadSettings record.
@@ -60,9 +180,18 @@ func (s *ReadSettings) dup() ReadSettings {
 		}
 	}
 	return ReadSettings{
-		CharsetReader: s.CharsetReader,
-		Permissive:    s.Permissive,
-		Entity:        entityCopy,
+		CharsetReader:    s.CharsetReader,
+		Permissive:       s.Permissive,
+		RepairTags:       s.RepairTags,
+		Entity:           entityCopy,
+		Verbatim:         s.Verbatim,
+		Decompress:       s.Decompress,
+		TrackOffsets:     s.TrackOffsets,
+		TrackPositions:   s.TrackPositions,
+		Encoding:         s.Encoding,
+		ExpandNamespaces: s.ExpandNamespaces,
+		CoalesceText:     s.CoalesceText,
+		ValidateEncoding: s.ValidateEncoding,
 	}
 }
 
@@ -73,6 +202,14 @@ type WriteSettings struct {
 	// elements that have no child elements. Default: false.
 	CanonicalEndTags bool
 
+	// EmptyWhitespace causes elements whose child tokens are all character
+	// data containing only whitespace, such as elements left with nothing
+	// but indentation, to be written as if they had no children. Such
+	// elements are written as self-closing tags, or with an empty start and
+	// end tag pair if CanonicalEndTags is also set. CDATA sections are not
+	// considered whitespace. Default: false.
+	EmptyWhitespace bool
+
 	// CanonicalText forces the production of XML character references for
 	// text data characters &, <, and >. If false, XML character references
 	// are also produced for " and '. Default: false.
@@ -85,8 +222,104 @@ type WriteSettings struct {
 
 	// UseCRLF causes the document's indentation methods to use a carriage
 	// return followed by a linefeed ("\r\n") when outputting a newline. If
-	// false, only a linefeed is used ("\n"). Default: false.
+	// false, only a linefeed is used ("\n"). Unless PreserveLineEndings is
+	// set, it also causes each linefeed in character data, including CDATA
+	// sections, and in attribute values that isn't already preceded by a
+	// carriage return to be written as a carriage return and linefeed, so
+	// that the output uses consistent line endings. Default: false.
 	UseCRLF bool
+
+	// PreserveLineEndings prevents UseCRLF from changing the linefeeds in
+	// character data and attribute values. XML parsers translate the line
+	// endings in character data back to linefeeds, but set this option when
+	// the exact line endings of the serialized data matter, for example when
+	// a document's text is hashed or signed. Default: false.
+	PreserveLineEndings bool
+
+	// InlineLeadingComments causes the document's indentation methods to
+	// leave a comment that is an element's first child token on the same
+	// line as the element's start tag, instead of placing it on its own
+	// indented line. If the comment is the element's only child, the
+	// element's end tag also remains on the same line. Default: false.
+	InlineLeadingComments bool
+
+	// MaxLineWidth, if greater than zero, is the number of characters beyond
+	// which the start tag of an element with more than one attribute is
+	// wrapped, placing each attribute after the first on its own line,
+	// aligned with the first attribute. Only start tags placed on their own
+	// lines by indentation are wrapped: those immediately following the
+	// newline and indentation inserted by Indent, IndentTabs and the other
+	// indentation methods or written by WriteIndentedTo. The start tag of
+	// the element passed to WriteIndentedTo, start tags following a newline
+	// in other text, and all start tags of a document that hasn't been
+	// indented are never wrapped. A document's root element is wrapped only
+	// if indentation placed it on a new line, such as one following an XML
+	// declaration. Each character, including a tab, counts as one column.
+	// The newlines use a carriage return and linefeed if UseCRLF is set.
+	// Default: 0.
+	MaxLineWidth int
+
+	// TrailingNewline causes Document.WriteTo and the other Document WriteTo*
+	// methods to finish the output with a newline, unless the document's
+	// last token is character data already ending with one, as it is after
+	// indentation. The newline is a carriage return and linefeed if UseCRLF
+	// is set. Nothing is added to the output of an empty document. Default:
+	// false.
+	TrailingNewline bool
+
+	// CanonicalXMLDecl causes the XML declaration, a processing instruction
+	// with the target "xml", to be written in the conventional form used by
+	// most serializers, with its version, encoding and standalone
+	// pseudo-attributes in that order, separated by single spaces and quoted
+	// with double quotes, such as <?xml version="1.0" encoding="UTF-8"?>. A
+	// declaration containing anything else is written unchanged. Default:
+	// false.
+	CanonicalXMLDecl bool
+
+	// MaxOutputBytes, if greater than zero, is the maximum number of bytes
+	// written by Document.WriteTo and the other Document WriteTo* methods,
+	// Document.Minify and Element.WriteIndentedTo. Once the output would
+	// exceed the limit, writing stops and the method returns ErrOutputLimit.
+	// Exactly MaxOutputBytes bytes of output, the longest possible prefix of
+	// the complete output, have then been written to the writer, and that is
+	// the byte count returned by methods that report one. Methods that return
+	// the output as a byte slice or string return no output. Default: 0.
+	MaxOutputBytes int64
+
+	// Escaper, if not nil, replaces the built-in escaping of text data and
+	// attribute values. It is called to write the string 's' to the writer
+	// 'w', and 'inAttr' is true if 's' is an attribute value. When Escaper is
+	// set, the CanonicalText and CanonicalAttrVal settings are ignored. CDATA
+	// sections are never escaped. Default: nil.
+	Escaper func(w XMLWriter, s string, inAttr bool)
+
+	// RawAttrValue, if not nil, is called for each attribute being written.
+	// The values of the attributes for which it returns true are written
+	// exactly as they are, without escaping or line ending conversion, which
+	// allows values that are already escaped to be written without being
+	// escaped twice. The value is the caller's responsibility: a raw value
+	// containing a double quote, a '<' or an '&' that doesn't begin a
+	// character or entity reference produces malformed XML. Default: nil.
+	RawAttrValue func(a *Attr) bool
+
+	// Verbatim causes tokens whose source text was recorded by reading with
+	// ReadSettings.Verbatim to be written using their original source text,
+	// preserving details such as attribute quoting and spacing, self-closing
+	// tags, character references and line endings. Tokens that have been
+	// modified since they were read are written normally, as are any other
+	// tokens. The other write settings have no effect on tokens written
+	// verbatim. Default: false.
+	Verbatim bool
+
+	// ChildFilter, if not nil, is called for each child token of the
+	// document and of each element being serialized. Tokens for which it
+	// returns false are omitted from the output, along with their
+	// descendants, without modifying the element tree. Whitespace-only
+	// character data immediately preceding an omitted token, such as
+	// indentation, is also omitted, and an element whose remaining children
+	// are all whitespace is written as an empty element. The token being
+	// serialized by a call to WriteTo is always written. Default: nil.
+	ChildFilter func(t Token) bool
 }
 
 // XMLWriter is a Writer that also has convenience methods for writing
@@ -112,6 +345,141 @@ func (s *WriteSettings) dup() WriteSettings {
 	return *s
 }
 
+// filterChildren returns the tokens in 'child' that should be serialized
+// according to the ChildFilter setting. It returns 'child' itself if no
+// tokens are omitted.
+func (s *WriteSettings) filterChildren(child []Token) []Token {
+	if s.ChildFilter == nil || len(child) == 0 {
+		return child
+	}
+
+	keep := make([]bool, len(child))
+	omitted := false
+	for i, c := range child {
+		keep[i] = s.ChildFilter(c)
+		omitted = omitted || !keep[i]
+	}
+	if !omitted {
+		return child
+	}
+
+	kept := make([]Token, 0, len(child))
+	content := false
+	for i, c := range child {
+		switch {
+		case !keep[i]:
+		case isWhitespaceText(c) && i+1 < len(child) && !keep[i+1]:
+			// Omit indentation preceding an omitted token.
+		default:
+			content = content || !isWhitespaceText(c)
+			kept = append(kept, c)
+		}
+	}
+	if !content {
+		return nil
+	}
+	return kept
+}
+
+// allWhitespaceText reports whether all of the tokens are character data,
+// other than CDATA sections, containing only whitespace.
+func allWhitespaceText(tokens []Token) bool {
+	for _, t := range tokens {
+		if !isWhitespaceText(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWhitespaceText reports whether the token is character data, other than
+// a CDATA section, containing only whitespace.
+func isWhitespaceText(t Token) bool {
+	cd, ok := t.(*CharData)
+	return ok && cd.isIndentation() && !cd.IsCData()
+}
+
+// escape writes the string 'str' to the writer, escaped as text data or, if
+// 'inAttr' is true, as an attribute value.
+func (s *WriteSettings) escape(w XMLWriter, str string, inAttr bool) {
+	if s.normalizeCRLF(str) {
+		var buf bytes.Buffer
+		s.escapeTo(&buf, str, inAttr)
+		writeCRLF(w, buf.String())
+		return
+	}
+	s.escapeTo(w, str, inAttr)
+}
+
+// normalizeCRLF reports whether linefeeds in the string 'str' should be
+// written as carriage return and linefeed pairs.
+func (s *WriteSettings) normalizeCRLF(str string) bool {
+	return s.UseCRLF && !s.PreserveLineEndings && strings.IndexByte(str, '\n') >= 0
+}
+
+// escapeTo writes the string 'str' to the writer, escaped as text data or,
+// if 'inAttr' is true, as an attribute value, without normalizing its line
+// endings.
+func (s *WriteSettings) escapeTo(w XMLWriter, str string, inAttr bool) {
+	switch {
+	case s.Escaper != nil:
+		s.Escaper(w, str, inAttr)
+	case inAttr && s.CanonicalAttrVal:
+		escapeString(w, str, escapeCanonicalAttr)
+	case !inAttr && s.CanonicalText:
+		escapeString(w, str, escapeCanonicalText)
+	default:
+		escapeString(w, str, escapeNormal)
+	}
+}
+
+// EscapeText returns the string 's' escaped in the same way that etree
+// escapes text data or, if 'inAttr' is true, attribute values when it
+// serializes a document using the provided write settings. If 'settings' is
+// nil, the default write settings are used. The result does not include the
+// quotes that surround an attribute value.
+func EscapeText(s string, inAttr bool, settings *WriteSettings) string {
+	if settings == nil {
+		ws := newWriteSettings()
+		settings = &ws
+	}
+	var buf bytes.Buffer
+	settings.escape(&buf, s, inAttr)
+	return buf.String()
+}
+
+// UnescapeText returns the string 's' with its character references, such
+// as "&#65;" and "&#x41;", and the predefined XML entity references &amp;,
+// &lt;, &gt;, &apos; and &quot; replaced by the characters they represent.
+// Other entity references and malformed references are left unchanged.
+func UnescapeText(s string) string {
+	i := strings.IndexByte(s, '&')
+	if i < 0 {
+		return s
+	}
+
+	var buf bytes.Buffer
+	for i >= 0 {
+		buf.WriteString(s[:i])
+		s = s[i:]
+		end := strings.IndexByte(s, ';')
+		r, ok := rune(0), false
+		if end > 1 {
+			r, ok = unescapeRef(s[1:end])
+		}
+		if ok {
+			buf.WriteRune(r)
+			s = s[end+1:]
+		} else {
+			buf.WriteByte('&')
+			s = s[1:]
+		}
+		i = strings.IndexByte(s, '&')
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
+
 // A Token is an interface type used to represent XML elements, character
 // data, CDATA sections, XML comments, XML directives, and XML processing
 // instructions.
@@ -142,14 +510,26 @@ type Document struct {
 
 // An Element represents an XML element, its attributes, and its child tokens.
 type Element struct {
-	Space, Tag string   // namespace prefix and tag
-	Attr       []Attr   // key-value attribute pairs
-	Child      []Token  // child tokens (elements, comments, etc.)
-	parent     *Element // parent element
-	index      int      // token index in parent's children
+	Space, Tag string                // namespace prefix and tag
+	Attr       []Attr                // key-value attribute pairs
+	Child      []Token               // child tokens (elements, comments, etc.)
+	parent     *Element              // parent element
+	index      int                   // token index in parent's children
+	childIndex map[string][]*Element // optional child elements by tag
+	verbatim   *verbatimElement      // source text recorded by verbatim reads
+	source     *sourceRange          // source offsets recorded by reads
 }
 
 // An Attr represents a key-value attribute within an XML element.
+//
+// An element stores its attributes by value in its Attr slice, so an *Attr
+// returned by methods such as SelectAttr and CreateAttr points into that
+// slice. The pointer becomes stale as soon as the slice is changed: adding an
+// attribute may move the slice to a new array, and removing, sorting or
+// replacing attributes moves other attributes into the pointed-to slot.
+// Modifying an attribute through a stale pointer doesn't affect the element.
+// Don't hold on to an *Attr across changes to its element's attributes;
+// select the attribute again or keep a copy of its value instead.
 type Attr struct {
 	Space, Key string   // The attribute's namespace prefix and key
 	Value      string   // The attribute value string
@@ -165,16 +545,20 @@ const (
 
 	// The CharData contains a CDATA section.
 	cdataFlag
+
+	// The CharData is significant even if it contains only whitespace.
+	significantFlag
 )
 
 // CharData may be used to represent simple text data or a CDATA section
 // within an XML document. The Data property should never be modified
 // directly; use the SetData method instead.
 type CharData struct {
-	Data   string // the simple text or CDATA section content
-	parent *Element
-	index  int
-	flags  charDataFlags
+	Data     string // the simple text or CDATA section content
+	parent   *Element
+	index    int
+	flags    charDataFlags
+	verbatim *verbatimCharData
 }
 
 // A Comment represents an XML comment.
@@ -193,10 +577,44 @@ type Directive struct {
 
 // A ProcInst represents an XML processing instruction.
 type ProcInst struct {
-	Target string // the processing instruction target
-	Inst   string // the processing instruction value
-	parent *Element
-	index  int
+	Target   string // the processing instruction target
+	Inst     string // the processing instruction value
+	parent   *Element
+	index    int
+	verbatim *verbatimProcInst
+}
+
+// verbatimElement holds the source text of an element's start and end tags,
+// along with a copy of the element's name and attributes as they were read.
+// The end tag is empty if the element was self-closing.
+type verbatimElement struct {
+	start, end string
+	space, tag string
+	attr       []Attr
+}
+
+// verbatimCharData holds the source text of a character data token, along
+// with a copy of its content as it was read.
+type verbatimCharData struct {
+	source string
+	data   string
+	cdata  bool
+}
+
+// verbatimProcInst holds the source text of a processing instruction, along
+// with a copy of its target and instruction as they were read.
+type verbatimProcInst struct {
+	source string
+	target string
+	inst   string
+}
+
+// sourceRange holds the byte offsets of an element in the input it was read
+// from, and the line and column at which it began. Offsets that were not
+// tracked are -1, and a line and column that were not tracked are 0.
+type sourceRange struct {
+	start, end int64
+	line, col  int
 }
 
 // NewDocument creates an XML document without a root element.
@@ -217,6 +635,24 @@ func NewDocumentWithRoot(e *Element) *Document {
 	return d
 }
 
+// FromTokens creates an XML document from the tokens read from the
+// caller-supplied decoder 'dec' until it reports the end of its input, so
+// that a decoder configured with its own character set reader, entities or
+// strictness, or one created with xml.NewTokenDecoder to filter another
+// token stream, can be used to build an element tree. Tokens are read with
+// the decoder's RawToken method, so namespace prefixes are stored as they
+// appear in the input. Without access to the source text, CDATA sections
+// can't be told apart from other character data and are stored as text. It
+// returns ErrXML if the tokens are not properly nested.
+func FromTokens(dec *xml.Decoder) (*Document, error) {
+	doc := NewDocument()
+	d := &decoder{dec: dec}
+	if err := d.read(&doc.Element); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
 // Copy returns a recursive, deep copy of the document.
 func (d *Document) Copy() *Document {
 	return &Document{
@@ -237,11 +673,33 @@ func (d *Document) Root() *Element {
 	return nil
 }
 
+// RootTag returns the namespace prefix and tag of the document's root
+// element. It returns two empty strings if there is no root element.
+func (d *Document) RootTag() (space, tag string) {
+	if r := d.Root(); r != nil {
+		return r.Space, r.Tag
+	}
+	return "", ""
+}
+
+// RootAttrValue finds an attribute of the document's root element matching
+// the requested 'key' and returns its value if found. If there is no root
+// element or no matching attribute is found, the function returns the 'dflt'
+// value instead. The key may include a namespace prefix followed by a colon.
+func (d *Document) RootAttrValue(key, dflt string) string {
+	if r := d.Root(); r != nil {
+		return r.SelectAttrValue(key, dflt)
+	}
+	return dflt
+}
+
 // SetRoot replaces the document's root element with the element 'e'. If the
 // document already has a root element when this function is called, then the
 // existing root element is unbound from the document. If the element 'e' is
-// part of another document, then it is unbound from the other document.
+// part of another document, then it is unbound from the other document. It
+// panics with ErrCycle if 'e' is the document's own element.
 func (d *Document) SetRoot(e *Element) {
+	d.Element.checkCycle(e)
 	if e.parent != nil {
 		e.parent.RemoveChild(e)
 	}
@@ -269,6 +727,26 @@ func (d *Document) ReadFrom(r io.Reader) (n int64, err error) {
 	return d.Element.readFrom(r, d.ReadSettings)
 }
 
+// ReadFromDiag reads XML from the reader 'r' into this document, like
+// ReadFrom, and also returns a list of diagnostics describing the problems
+// in the input that were tolerated while reading it. These include
+// duplicate attributes, whose earlier values are dropped, and, when
+// ReadSettings.RepairTags is set, elements that were closed automatically
+// and end tags that were dropped.
+func (d *Document) ReadFromDiag(r io.Reader) (n int64, diags []Diagnostic, err error) {
+	return d.Element.readFromDiag(r, d.ReadSettings)
+}
+
+// ReadFromContext reads XML from the reader 'r' into this document, like
+// ReadFrom, but stops and returns the context's error if the context 'ctx' is
+// canceled or its deadline passes before the input has been read. The
+// context is checked before each read from 'r', so a read that blocks is not
+// interrupted; use a reader whose reads time out, such as a network
+// connection with a deadline, if that matters.
+func (d *Document) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	return d.Element.readFrom(&contextReader{ctx, r}, d.ReadSettings)
+}
+
 // ReadFromFile reads XML from a local file at path 'filepath' into this
 // document.
 func (d *Document) ReadFromFile(filepath string) error {
@@ -296,10 +774,30 @@ func (d *Document) ReadFromString(s string) error {
 // WriteTo serializes the document out to the writer 'w'. The function returns
 // the number of bytes written and any error encountered.
 func (d *Document) WriteTo(w io.Writer) (n int64, err error) {
-	cw := newCountWriter(w)
+	return d.writeTo(w, &d.WriteSettings)
+}
+
+// writeTo serializes the document out to the writer 'w' using the write
+// settings 's'.
+func (d *Document) writeTo(w io.Writer, s *WriteSettings) (n int64, err error) {
+	cw := newCountWriter(limitOutput(w, s.MaxOutputBytes))
 	b := bufio.NewWriter(cw)
-	for _, c := range d.Child {
-		c.WriteTo(b, &d.WriteSettings)
+	var xw XMLWriter = b
+	if s.MaxLineWidth > 0 {
+		xw = trackColumns(b)
+	}
+	children := s.filterChildren(d.Child)
+	for _, c := range children {
+		c.WriteTo(xw, s)
+	}
+	if s.TrailingNewline && len(children) > 0 {
+		last, ok := children[len(children)-1].(*CharData)
+		if !ok || !strings.HasSuffix(last.Data, "\n") {
+			if s.UseCRLF {
+				b.WriteByte('\r')
+			}
+			b.WriteByte('\n')
+		}
 	}
 	err, n = b.Flush(), cw.bytes
 	return
@@ -325,6 +823,57 @@ func (d *Document) WriteToBytes() (b []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+// Minify serializes the document into a byte slice without the whitespace
+// used to format it, using the document's write settings. Character data
+// containing only whitespace and at least one line break, such as
+// indentation, is omitted, unless it belongs to an element that also
+// contains other text, since the line breaks in such mixed content are part
+// of the text. Whitespace without line breaks, such as the space separating
+// the words in <p><b>a</b> <i>b</i></p>, all other text and all CDATA
+// sections are written exactly. The MaxLineWidth and TrailingNewline
+// settings are ignored. The element tree is not modified.
+func (d *Document) Minify() ([]byte, error) {
+	s := d.WriteSettings
+	s.MaxLineWidth, s.TrailingNewline = 0, false
+	filter := s.ChildFilter
+	mixed := make(map[*Element]bool)
+	s.ChildFilter = func(t Token) bool {
+		if cd, ok := t.(*CharData); ok && !cd.IsCData() && cd.isIndentation() && strings.ContainsAny(cd.Data, "\r\n") {
+			p := cd.Parent()
+			isMixed, ok := mixed[p]
+			if !ok {
+				isMixed = p != nil && hasText(p)
+				mixed[p] = isMixed
+			}
+			if !isMixed {
+				return false
+			}
+		}
+		return filter == nil || filter(t)
+	}
+
+	var buf bytes.Buffer
+	b := bufio.NewWriter(limitOutput(&buf, s.MaxOutputBytes))
+	for _, c := range s.filterChildren(d.Child) {
+		c.WriteTo(b, &s)
+	}
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hasText returns true if the element has a child character data token
+// that is a CDATA section or contains non-whitespace characters.
+func hasText(e *Element) bool {
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && (cd.IsCData() || !isWhitespace(cd.Data)) {
+			return true
+		}
+	}
+	return false
+}
+
 // WriteToString serializes this document into a string.
 func (d *Document) WriteToString() (s string, err error) {
 	var b []byte
@@ -334,23 +883,84 @@ func (d *Document) WriteToString() (s string, err error) {
 	return string(b), nil
 }
 
+// String serializes the document into a string using the document's write
+// settings. It implements the fmt.Stringer interface, so the document's XML
+// is printed when the document is formatted using the %v or %s verbs. The
+// entire document is serialized regardless of its size, ignoring the
+// MaxOutputBytes setting.
+func (d *Document) String() string {
+	s := d.WriteSettings
+	s.MaxOutputBytes = 0
+	var buf strings.Builder
+	d.writeTo(&buf, &s)
+	return buf.String()
+}
+
+// GoString returns a compact description of the document's structure. It
+// implements the fmt.GoStringer interface used by the %#v formatting verb.
+func (d *Document) GoString() string {
+	var root string
+	if r := d.Root(); r != nil {
+		root = r.FullTag()
+	}
+	return fmt.Sprintf("&etree.Document{Root:%q, Child:%d}", root, len(d.Child))
+}
+
+// WithPermissive sets the document's ReadSettings.Permissive option and
+// returns the document, so that calls can be chained.
+func (d *Document) WithPermissive(permissive bool) *Document {
+	d.ReadSettings.Permissive = permissive
+	return d
+}
+
+// WithCRLF sets the document's WriteSettings.UseCRLF option and returns the
+// document, so that calls can be chained.
+func (d *Document) WithCRLF(useCRLF bool) *Document {
+	d.WriteSettings.UseCRLF = useCRLF
+	return d
+}
+
+// WithCanonicalEndTags sets the document's WriteSettings.CanonicalEndTags
+// option and returns the document, so that calls can be chained.
+func (d *Document) WithCanonicalEndTags(canonical bool) *Document {
+	d.WriteSettings.CanonicalEndTags = canonical
+	return d
+}
+
+// WithIndent indents the document's current contents by calling Indent with
+// the given number of 'spaces', and returns the document, so that calls can
+// be chained. Indentation is not a setting, so WithIndent must be called
+// after the document has been read or built, and after any setting, such as
+// UseCRLF, that affects indentation has been chosen.
+func (d *Document) WithIndent(spaces int) *Document {
+	d.Indent(spaces)
+	return d
+}
+
 type indentFunc func(depth int) string
 
 // Indent modifies the document's element tree by inserting character data
 // tokens containing newlines and indentation. The amount of indentation per
 // depth level is given by the 'spaces' parameter. Pass etree.NoIndent for
-// 'spaces' if you want no indentation at all.
+// 'spaces' if you want no indentation at all. Elements containing nothing
+// but previous indentation or whitespace read from a document are emptied
+// rather than indented, so they are written as <a/>, or as <a></a> with
+// CanonicalEndTags, and never as <a>\n  </a>.
 func (d *Document) Indent(spaces int) {
-	var indent indentFunc
+	d.Element.indent(0, spaceIndent(spaces, d.WriteSettings.UseCRLF), &d.WriteSettings)
+}
+
+// spaceIndent returns an indentFunc that indents each depth level by
+// 'spaces' spaces, or that produces no indentation if 'spaces' is negative.
+func spaceIndent(spaces int, useCRLF bool) indentFunc {
 	switch {
 	case spaces < 0:
-		indent = func(depth int) string { return "" }
-	case d.WriteSettings.UseCRLF:
-		indent = func(depth int) string { return indentCRLF(depth*spaces, indentSpaces) }
+		return func(depth int) string { return "" }
+	case useCRLF:
+		return func(depth int) string { return indentCRLF(depth*spaces, indentSpaces) }
 	default:
-		indent = func(depth int) string { return indentLF(depth*spaces, indentSpaces) }
+		return func(depth int) string { return indentLF(depth*spaces, indentSpaces) }
 	}
-	d.Element.indent(0, indent)
 }
 
 // IndentTabs modifies the document's element tree by inserting CharData
@@ -364,7 +974,157 @@ func (d *Document) IndentTabs() {
 	default:
 		indent = func(depth int) string { return indentLF(depth, indentTabs) }
 	}
-	d.Element.indent(0, indent)
+	d.Element.indent(0, indent, &d.WriteSettings)
+}
+
+// StripIndentation modifies the document's element tree by removing all
+// character data tokens that contain only whitespace, undoing the effect of
+// the Indent and IndentTabs methods. See Element.StripWhitespace.
+func (d *Document) StripIndentation() {
+	d.Element.StripWhitespace()
+}
+
+// ForEachAttr calls the function fn for each attribute of each element in
+// the document, in document order, passing the attribute and the element
+// that owns it. Iteration stops as soon as fn returns false. See
+// Element.WalkAttrs.
+func (d *Document) ForEachAttr(fn func(e *Element, a *Attr) bool) {
+	d.Element.WalkAttrs(fn)
+}
+
+// NormalizeNamespaces rewrites the namespace prefixes used in the document
+// so that, throughout the whole document, each namespace URI is bound to a
+// single prefix and each prefix is bound to a single namespace URI. This is
+// useful after assembling a document from fragments that declare the same
+// prefix for different URIs, or different prefixes for the same URI.
+//
+// Each URI keeps the prefix of its first declaration in document order,
+// unless that prefix is already bound to another URI, in which case a numeric
+// suffix is appended to make it unique. Element and attribute prefixes and
+// xmlns declarations are rewritten accordingly, and declarations made
+// redundant by an identical declaration on an ancestor are removed. Default
+// namespace declarations, unbound prefixes and prefixes appearing inside
+// attribute values or text are left unchanged.
+func (d *Document) NormalizeNamespaces() {
+	n := nsNormalizer{
+		prefix:   make(map[string]string),
+		taken:    make(map[string]bool),
+		declared: make(map[string]bool),
+	}
+	n.collect(&d.Element)
+	n.assign(&d.Element)
+	n.rewrite(&d.Element, map[string]string{}, map[string]bool{})
+}
+
+// nsNormalizer holds the state used by Document.NormalizeNamespaces.
+type nsNormalizer struct {
+	prefix   map[string]string // namespace URI -> normalized prefix
+	taken    map[string]bool   // normalized prefixes already assigned
+	declared map[string]bool   // all prefixes declared in the source
+}
+
+// collect records every prefix declared by the element e and its
+// descendants.
+func (n *nsNormalizer) collect(e *Element) {
+	for _, a := range e.Attr {
+		if a.Space == "xmlns" {
+			n.declared[a.Key] = true
+		}
+	}
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			n.collect(c)
+		}
+	}
+}
+
+// assign chooses a normalized prefix for each namespace URI declared by the
+// element e and its descendants, visiting declarations in document order.
+func (n *nsNormalizer) assign(e *Element) {
+	for _, a := range e.Attr {
+		if a.Space != "xmlns" || a.Value == "" {
+			continue
+		}
+		if _, ok := n.prefix[a.Value]; ok {
+			continue
+		}
+		p := a.Key
+		for i := 1; n.taken[p] || (p != a.Key && n.declared[p]); i++ {
+			p = fmt.Sprintf("%s%d", a.Key, i)
+		}
+		n.prefix[a.Value] = p
+		n.taken[p] = true
+	}
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			n.assign(c)
+		}
+	}
+}
+
+// rewrite replaces the prefixes used by the element e and its descendants
+// with their normalized equivalents. The 'scope' map holds the source prefix
+// bindings in effect for e, and 'bound' the normalized prefixes already
+// declared by e's ancestors.
+func (n *nsNormalizer) rewrite(e *Element, scope map[string]string, bound map[string]bool) {
+	hasDecl := false
+	for _, a := range e.Attr {
+		if a.Space == "xmlns" {
+			hasDecl = true
+			break
+		}
+	}
+	if hasDecl {
+		s := make(map[string]string, len(scope))
+		for k, v := range scope {
+			s[k] = v
+		}
+		b := make(map[string]bool, len(bound))
+		for k, v := range bound {
+			b[k] = v
+		}
+		scope, bound = s, b
+		for _, a := range e.Attr {
+			if a.Space == "xmlns" {
+				scope[a.Key] = a.Value
+			}
+		}
+	}
+
+	j := 0
+	for _, a := range e.Attr {
+		switch {
+		case a.Space == "xmlns" && a.Value != "":
+			p := n.prefix[a.Value]
+			if bound[p] {
+				continue
+			}
+			a.Key = p
+			bound[p] = true
+		case a.Space != "" && a.Space != "xmlns" && a.Space != "xml":
+			if uri, ok := scope[a.Space]; ok && uri != "" {
+				a.Space = n.prefix[uri]
+			}
+		}
+		e.Attr[j] = a
+		j++
+	}
+	for k := j; k < len(e.Attr); k++ {
+		e.Attr[k] = Attr{}
+	}
+	e.Attr = e.Attr[:j]
+
+	if e.Space != "" && e.Space != "xml" {
+		if uri, ok := scope[e.Space]; ok && uri != "" {
+			e.Space = n.prefix[uri]
+		}
+	}
+
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			n.rewrite(c, scope, bound)
+		}
+	}
 }
 
 // NewElement creates an unparented element with the specified tag (i.e.,
@@ -399,54 +1159,624 @@ func (e *Element) Copy() *Element {
 	return e.dup(nil).(*Element)
 }
 
-// FullTag returns the element e's complete tag, including namespace prefix if
-// present.
-func (e *Element) FullTag() string {
-	if e.Space == "" {
-		return e.Tag
-	}
-	return e.Space + ":" + e.Tag
+// CopyFiltered creates a recursive, deep copy of the element like Copy, but
+// copies only the descendant tokens for which the function 'pred' returns
+// true. When 'pred' returns false for an element, its descendants are
+// omitted along with it. The function is not called for this element, which
+// is always copied along with its attributes.
+func (e *Element) CopyFiltered(pred func(t Token) bool) *Element {
+	return e.dupFiltered(nil, pred)
 }
 
-// NamespaceURI returns the XML namespace URI associated with the element. If
-// the element is part of the XML default namespace, NamespaceURI returns the
-// empty string.
-func (e *Element) NamespaceURI() string {
-	if e.Space == "" {
-		return e.findDefaultNamespaceURI()
-	}
-	return e.findLocalNamespaceURI(e.Space)
+// CopyWithoutComments creates a recursive, deep copy of the element like
+// Copy, but omits all comments.
+func (e *Element) CopyWithoutComments() *Element {
+	return e.CopyFiltered(func(t Token) bool {
+		_, ok := t.(*Comment)
+		return !ok
+	})
 }
 
-// findLocalNamespaceURI finds the namespace URI corresponding to the
-// requested prefix.
-func (e *Element) findLocalNamespaceURI(prefix string) string {
-	for _, a := range e.Attr {
-		if a.Space == "xmlns" && a.Key == prefix {
-			return a.Value
+// CopyContentOnly creates a recursive, deep copy of the element like Copy,
+// but copies only its descendant elements and their character data. All
+// comments, directives and processing instructions are omitted, as is any
+// character data containing only whitespace, such as indentation, unless it
+// is a CDATA section or has been marked significant with
+// CharData.SetSignificant.
+func (e *Element) CopyContentOnly() *Element {
+	return e.CopyFiltered(func(t Token) bool {
+		switch t := t.(type) {
+		case *Element:
+			return true
+		case *CharData:
+			return t.IsCData() || t.IsSignificant() || !isWhitespace(t.Data)
+		default:
+			return false
+		}
+	})
+}
+
+// dupFiltered duplicates the element and the descendant tokens for which
+// 'pred' returns true.
+func (e *Element) dupFiltered(parent *Element, pred func(t Token) bool) *Element {
+	ne := &Element{
+		Space:    e.Space,
+		Tag:      e.Tag,
+		Attr:     make([]Attr, len(e.Attr)),
+		Child:    make([]Token, 0, len(e.Child)),
+		parent:   parent,
+		index:    e.index,
+		verbatim: e.verbatim,
+		source:   e.source,
+	}
+	for _, t := range e.Child {
+		if !pred(t) {
+			continue
 		}
+		var c Token
+		if ce, ok := t.(*Element); ok {
+			c = ce.dupFiltered(ne, pred)
+		} else {
+			c = t.dup(ne)
+		}
+		c.setIndex(len(ne.Child))
+		ne.Child = append(ne.Child, c)
 	}
+	copy(ne.Attr, e.Attr)
+	return ne
+}
 
-	if e.parent == nil {
-		return ""
+// CopyStandalone creates a recursive, deep copy of the element, like Copy,
+// and adds to the copy the namespace declarations it inherits from the
+// element's ancestors and needs to resolve the namespace prefixes used by
+// the copied element and its descendants, including a default namespace
+// declaration if the copy uses the default namespace. Namespace URIs held
+// in the Space fields of elements and attributes read with
+// ReadSettings.ExpandNamespaces are declared in the same way, using the
+// inherited prefix or default namespace declaration binding the URI, or a
+// generated prefix of the form "nsN" if no inherited declaration binds it. The copy remains valid wherever it
+// is placed afterward. Inherited declarations that the copy doesn't use are
+// not added.
+func (e *Element) CopyStandalone() *Element {
+	c := e.Copy()
+
+	used := make(map[string]bool)
+	c.collectInheritedPrefixes(nil, used)
+	names := make([]string, 0, len(used))
+	for p := range used {
+		names = append(names, p)
 	}
+	sort.Strings(names)
 
-	return e.parent.findLocalNamespaceURI(prefix)
+	// Prefixes declared by the copy itself or used without a declaration
+	// can't be declared again.
+	taken := make(map[string]bool, len(used))
+	for p := range used {
+		taken[p] = true
+	}
+	for _, a := range c.Attr {
+		switch {
+		case a.Space == "xmlns":
+			taken[a.Key] = true
+		case a.Space == "" && a.Key == "xmlns":
+			taken[""] = true
+		}
+	}
+
+	var decls []Attr
+	bound := make(map[string]string) // the URIs of the prefixes declared
+	declare := func(p, uri string) {
+		if p == "" {
+			decls = append(decls, Attr{Key: "xmlns", Value: uri, element: c})
+		} else {
+			decls = append(decls, Attr{Space: "xmlns", Key: p, Value: uri, element: c})
+		}
+		taken[p], bound[p] = true, uri
+	}
+	var uris []string
+	for _, p := range names {
+		switch {
+		case !isNCName(p) && p != "":
+			uris = append(uris, p)
+		case e.parent == nil:
+		case p == "":
+			if uri := e.parent.findDefaultNamespaceURI(); uri != "" {
+				declare("", uri)
+			}
+		default:
+			if uri := e.parent.findLocalNamespaceURI(p); uri != "" {
+				declare(p, uri)
+			}
+		}
+	}
+	n := 0
+	for _, uri := range uris {
+		if e.parent != nil {
+			if p, ok := e.parent.declaredPrefix(uri, false); ok && (!taken[p] || bound[p] == uri) {
+				if !taken[p] {
+					declare(p, uri)
+				}
+				continue
+			}
+			if e.parent.findDefaultNamespaceURI() == uri && (!taken[""] || bound[""] == uri) {
+				if !taken[""] {
+					declare("", uri)
+				}
+				continue
+			}
+		}
+		for {
+			n++
+			if p := "ns" + strconv.Itoa(n); !taken[p] {
+				declare(p, uri)
+				break
+			}
+		}
+	}
+	if decls != nil {
+		c.Attr = append(decls, c.Attr...)
+	}
+	return c
 }
 
-// findDefaultNamespaceURI finds the default namespace URI of the element.
-func (e *Element) findDefaultNamespaceURI() string {
+// collectInheritedPrefixes adds to 'used' each namespace prefix used by the
+// element e or its descendants that is not declared by e, its descendants,
+// or the prefixes in 'declared'. The empty prefix represents the default
+// namespace, which is used by elements without a prefix. A namespace URI
+// held in Space, as after reading with ReadSettings.ExpandNamespaces, is
+// added unless one of the declarations binds a prefix to it; such URIs are
+// never valid prefixes, so the two can't be confused.
+func (e *Element) collectInheritedPrefixes(declared map[string]bool, used map[string]bool) {
 	for _, a := range e.Attr {
+		p, ok := a.Key, a.Space == "xmlns"
 		if a.Space == "" && a.Key == "xmlns" {
-			return a.Value
+			p, ok = "", true
+		}
+		if ok && (!declared[p] || (a.Value != "" && !isNCName(a.Value) && !declared[a.Value])) {
+			d := make(map[string]bool, len(declared)+2)
+			for k, v := range declared {
+				d[k] = v
+			}
+			d[p] = true
+			if a.Value != "" && !isNCName(a.Value) {
+				d[a.Value] = true
+			}
+			declared = d
 		}
 	}
 
-	if e.parent == nil {
-		return ""
+	use := func(p string) {
+		if p != "xml" && p != "xmlns" && !declared[p] {
+			used[p] = true
+		}
+	}
+	use(e.Space)
+	for _, a := range e.Attr {
+		if a.Space != "" {
+			use(a.Space)
+		}
 	}
 
-	return e.parent.findDefaultNamespaceURI()
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			c.collectInheritedPrefixes(declared, used)
+		}
+	}
+}
+
+// expandNamespaces replaces the namespace prefixes of the element and its
+// prefixed attributes by the namespace URIs they are bound to, as described
+// by ReadSettings.ExpandNamespaces. Namespace declarations are unaffected, so
+// the element's children can be expanded before or after it.
+func (e *Element) expandNamespaces() {
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		if a.Space != "" && a.Space != "xmlns" {
+			if uri := e.findLocalNamespaceURI(a.Space); uri != "" && !isNCName(uri) {
+				a.Space = uri
+			}
+		}
+	}
+	if uri := e.NamespaceURI(); uri != "" && !isNCName(uri) {
+		e.Space = uri
+	}
+	if e.verbatim != nil {
+		e.verbatim.space = e.Space
+		copy(e.verbatim.attr, e.Attr)
+	}
+}
+
+// writtenTag returns the element's complete tag as it is written. If the
+// element's Space holds a namespace URI, as it does after reading with
+// ReadSettings.ExpandNamespaces, the URI is replaced by the nearest in-scope
+// prefix declared for it, or by a prefix declared by 'pw' if no declaration
+// in the element tree binds the URI.
+func (e *Element) writtenTag(pw *prefixWriter) string {
+	return e.writtenName(e.Space, e.Tag, true, pw)
+}
+
+// writtenName returns the name with namespace 'space' and local name 'local'
+// of the element or of one of its attributes, as it is written by the
+// element. A namespace URI is replaced as described for writtenTag; the
+// default namespace is used only if 'allowDefault' is set. If 'pw' is nil,
+// a namespace URI no declaration binds is kept unchanged.
+func (e *Element) writtenName(space, local string, allowDefault bool, pw *prefixWriter) string {
+	if space == "" || isNCName(space) {
+		return spaceJoin(space, local)
+	}
+	if prefix, ok := e.declaredPrefix(space, allowDefault); ok {
+		return spaceJoin(prefix, local)
+	}
+	if pw == nil {
+		return spaceJoin(space, local)
+	}
+	return spaceJoin(pw.prefix(e, space), local)
+}
+
+// declaredPrefix returns the nearest in-scope namespace prefix declared for
+// the namespace 'uri', or the empty string if 'allowDefault' is set and the
+// URI is the default namespace in scope. It returns false if no in-scope
+// declaration binds the URI.
+func (e *Element) declaredPrefix(uri string, allowDefault bool) (string, bool) {
+	for p := e; p != nil; p = p.parent {
+		for _, a := range p.Attr {
+			switch {
+			case a.Value != uri:
+			case a.Space == "xmlns" && e.findLocalNamespaceURI(a.Key) == uri:
+				return a.Key, true
+			case allowDefault && a.Space == "" && a.Key == "xmlns" &&
+				e.findDefaultNamespaceURI() == uri:
+				return "", true
+			}
+		}
+	}
+	return "", false
+}
+
+// FullTag returns the element e's complete tag, including namespace prefix if
+// present.
+func (e *Element) FullTag() string {
+	if e.Space == "" {
+		return e.Tag
+	}
+	return e.Space + ":" + e.Tag
+}
+
+// Rename changes the element's tag (i.e., name). The tag may include a
+// namespace prefix followed by a colon, which replaces the element's current
+// prefix; without one, the element's prefix is removed. The tag is not
+// validated; use IsValidTag to check it first if necessary.
+func (e *Element) Rename(tag string) {
+	e.Space, e.Tag = spaceDecompose(tag)
+	if e.parent != nil {
+		e.parent.dropChildIndex()
+	}
+}
+
+// RenameAll renames this element and each of its descendant elements whose
+// full tag, including any namespace prefix, equals 'old' to 'new', as if by
+// calling Rename. It returns the number of elements renamed.
+func (e *Element) RenameAll(old, new string) int {
+	n := 0
+	if e.FullTag() == old {
+		e.Rename(new)
+		n++
+	}
+	for _, c := range e.Child {
+		if ce, ok := c.(*Element); ok {
+			n += ce.RenameAll(old, new)
+		}
+	}
+	return n
+}
+
+// IsValidTag reports whether 'tag' is a valid XML element or attribute name
+// that may be passed to functions such as CreateElement, CreateAttr and
+// Rename: a name without colons, optionally preceded by a namespace prefix
+// and a colon, as defined by the XML Namespaces specification.
+func IsValidTag(tag string) bool {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return isNCName(tag[:i]) && isNCName(tag[i+1:])
+	}
+	return isNCName(tag)
+}
+
+// NamespaceURI returns the XML namespace URI associated with the element. If
+// the element is part of the XML default namespace, NamespaceURI returns the
+// empty string.
+func (e *Element) NamespaceURI() string {
+	switch {
+	case e.Space == "":
+		return e.findDefaultNamespaceURI()
+	case !isNCName(e.Space):
+		return e.Space // expanded by ReadSettings.ExpandNamespaces
+	}
+	return e.findLocalNamespaceURI(e.Space)
+}
+
+// QName returns the element's namespace-qualified name: the namespace URI
+// reported by NamespaceURI and the local name stored in Tag. Unlike FullTag,
+// the result does not depend on the namespace prefix used in the document.
+func (e *Element) QName() (uri, local string) {
+	return e.NamespaceURI(), e.Tag
+}
+
+// EqualNS returns true if this element and the 'other' element are equal
+// when namespace prefixes are disregarded: the elements have the same
+// namespace URI and local name, the same attributes, and equal child tokens.
+// Attributes are compared by namespace URI, local name and value, without
+// regard to their order, and namespace declarations are ignored. Child
+// tokens are compared in order, child elements recursively, and character
+// data is compared without regard to whether it is a CDATA section.
+func (e *Element) EqualNS(other *Element) bool {
+	if e.Tag != other.Tag || e.NamespaceURI() != other.NamespaceURI() {
+		return false
+	}
+	if !equalAttrsNS(e.Attr, other.Attr) || len(e.Child) != len(other.Child) {
+		return false
+	}
+	for i, t := range e.Child {
+		switch t := t.(type) {
+		case *Element:
+			o, ok := other.Child[i].(*Element)
+			if !ok || !t.EqualNS(o) {
+				return false
+			}
+		case *CharData:
+			o, ok := other.Child[i].(*CharData)
+			if !ok || t.Data != o.Data {
+				return false
+			}
+		case *Comment:
+			o, ok := other.Child[i].(*Comment)
+			if !ok || t.Data != o.Data {
+				return false
+			}
+		case *Directive:
+			o, ok := other.Child[i].(*Directive)
+			if !ok || t.Data != o.Data {
+				return false
+			}
+		case *ProcInst:
+			o, ok := other.Child[i].(*ProcInst)
+			if !ok || t.Target != o.Target || t.Inst != o.Inst {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// equalAttrsNS returns true if the attribute lists contain the same
+// attributes other than namespace declarations, compared by namespace URI,
+// local name and value.
+func equalAttrsNS(a, b []Attr) bool {
+	n := 0
+	for i := range a {
+		if a[i].IsNamespaceDecl() {
+			continue
+		}
+		n++
+		uri := a[i].NamespaceURI()
+		found := false
+		for j := range b {
+			if !b[j].IsNamespaceDecl() && a[i].Key == b[j].Key && a[i].Value == b[j].Value &&
+				uri == b[j].NamespaceURI() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for i := range b {
+		if !b[i].IsNamespaceDecl() {
+			n--
+		}
+	}
+	return n == 0
+}
+
+// FingerprintOption values modify the content from which Fingerprint
+// computes an element's fingerprint.
+type FingerprintOption int
+
+const (
+	// FingerprintComments includes comments in the fingerprint.
+	FingerprintComments FingerprintOption = 1 << iota
+
+	// FingerprintProcInsts includes processing instructions in the
+	// fingerprint.
+	FingerprintProcInsts
+
+	// FingerprintWhitespace includes character data containing only
+	// whitespace, such as indentation, in the fingerprint.
+	FingerprintWhitespace
+
+	// FingerprintNormalizeSpace causes text to be fingerprinted with leading
+	// and trailing whitespace removed and each remaining run of whitespace
+	// replaced by a single space.
+	FingerprintNormalizeSpace
+)
+
+// Fingerprint returns a SHA-256 digest of the canonical content of this
+// element and its descendants, which can be used to detect whether the
+// meaningful content of a subtree has changed without comparing it byte by
+// byte. Elements and attributes are identified by namespace URI and local
+// name, as by EqualNS, so namespace prefixes and declarations don't affect
+// the fingerprint, and attributes are fingerprinted in sorted order.
+// Adjacent character data tokens are fingerprinted as a single text, with no
+// distinction between CDATA sections and other text. Directives are always
+// ignored. By default, comments, processing instructions and whitespace-only
+// text are also ignored; pass FingerprintOption values in 'opts' to include
+// them.
+func (e *Element) Fingerprint(opts ...FingerprintOption) []byte {
+	var o FingerprintOption
+	for _, opt := range opts {
+		o |= opt
+	}
+	h := sha256.New()
+	e.fingerprint(h, o)
+	return h.Sum(nil)
+}
+
+// fingerprint writes the canonical content of the element to the hash 'h'.
+// Each item is written as a kind byte followed by length-prefixed fields, so
+// that different content can't produce the same byte sequence.
+func (e *Element) fingerprint(h hash.Hash, o FingerprintOption) {
+	writeFingerprintItem(h, 'E', e.NamespaceURI(), e.Tag)
+
+	type qattr struct{ uri, key, value string }
+	attrs := make([]qattr, 0, len(e.Attr))
+	for i := range e.Attr {
+		if a := &e.Attr[i]; !a.IsNamespaceDecl() {
+			attrs = append(attrs, qattr{a.NamespaceURI(), a.Key, a.Value})
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].uri != attrs[j].uri {
+			return attrs[i].uri < attrs[j].uri
+		}
+		return attrs[i].key < attrs[j].key
+	})
+	for _, a := range attrs {
+		writeFingerprintItem(h, 'A', a.uri, a.key, a.value)
+	}
+
+	var text strings.Builder
+	flush := func() {
+		t := text.String()
+		text.Reset()
+		if o&FingerprintNormalizeSpace != 0 {
+			t = strings.Join(strings.Fields(t), " ")
+		}
+		if t != "" && (o&FingerprintWhitespace != 0 || !isWhitespace(t)) {
+			writeFingerprintItem(h, 'T', t)
+		}
+	}
+	for _, c := range e.Child {
+		switch c := c.(type) {
+		case *CharData:
+			text.WriteString(c.Data)
+		case *Element:
+			flush()
+			c.fingerprint(h, o)
+		case *Comment:
+			if o&FingerprintComments != 0 {
+				flush()
+				writeFingerprintItem(h, 'C', c.Data)
+			}
+		case *ProcInst:
+			if o&FingerprintProcInsts != 0 {
+				flush()
+				writeFingerprintItem(h, 'P', c.Target, c.Inst)
+			}
+		}
+	}
+	flush()
+	writeFingerprintItem(h, '/')
+}
+
+// writeFingerprintItem writes the 'kind' byte followed by each of the
+// 'fields', prefixed by its length, to the hash 'h'.
+func writeFingerprintItem(h hash.Hash, kind byte, fields ...string) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write([]byte{kind})
+	for _, f := range fields {
+		n := binary.PutUvarint(buf[:], uint64(len(f)))
+		h.Write(buf[:n])
+		io.WriteString(h, f)
+	}
+}
+
+// BaseURI returns the element's base URI as defined by the XML Base
+// specification. The xml:base attributes of the element and its ancestors
+// are resolved against each other according to RFC 3986, starting from the
+// outermost one, so that a relative xml:base is interpreted relative to the
+// base URI of the element's parent. Attributes whose values are not valid
+// URI references are ignored. If neither the element nor any of its
+// ancestors has an xml:base attribute, BaseURI returns the empty string.
+func (e *Element) BaseURI() string {
+	var bases []string
+	for p := e; p != nil; p = p.parent {
+		if a := p.SelectAttr("xml:base"); a != nil {
+			bases = append(bases, strings.TrimSpace(a.Value))
+		}
+	}
+
+	var base *url.URL
+	for i := len(bases) - 1; i >= 0; i-- {
+		ref, err := url.Parse(bases[i])
+		switch {
+		case err != nil:
+			continue
+		case base == nil:
+			base = ref
+		default:
+			base = base.ResolveReference(ref)
+		}
+	}
+	if base == nil {
+		return ""
+	}
+	return base.String()
+}
+
+// SourceRange returns the byte offsets in the input at which the element's
+// start tag began and its end tag ended, so that the element's source text
+// is the half-open range [start, end). The offsets are only available for
+// elements read with ReadSettings.TrackOffsets, and 'ok' is false otherwise.
+// They count bytes after any decompression and character set conversion,
+// and they are not updated when the element tree is modified.
+func (e *Element) SourceRange() (start, end int64, ok bool) {
+	if e.source == nil || e.source.start < 0 || e.source.end < 0 {
+		return 0, 0, false
+	}
+	return e.source.start, e.source.end, true
+}
+
+// SourcePos returns the line and column in the input at which the element's
+// start tag began. Lines and columns are numbered from 1, and columns count
+// characters rather than bytes. The position is only available for elements
+// read with ReadSettings.TrackPositions, and 'ok' is false otherwise. It
+// refers to the text after any decompression and character set conversion.
+func (e *Element) SourcePos() (line, col int, ok bool) {
+	if e.source == nil || e.source.line == 0 {
+		return 0, 0, false
+	}
+	return e.source.line, e.source.col, true
+}
+
+// findLocalNamespaceURI finds the namespace URI corresponding to the
+// requested prefix.
+func (e *Element) findLocalNamespaceURI(prefix string) string {
+	for _, a := range e.Attr {
+		if a.Space == "xmlns" && a.Key == prefix {
+			return a.Value
+		}
+	}
+
+	if e.parent == nil {
+		return ""
+	}
+
+	return e.parent.findLocalNamespaceURI(prefix)
+}
+
+// findDefaultNamespaceURI finds the default namespace URI of the element.
+func (e *Element) findDefaultNamespaceURI() string {
+	for _, a := range e.Attr {
+		if a.Space == "" && a.Key == "xmlns" {
+			return a.Value
+		}
+	}
+
+	if e.parent == nil {
+		return ""
+	}
+
+	return e.parent.findDefaultNamespaceURI()
 }
 
 // namespacePrefix returns the namespace prefix associated with the element.
@@ -481,6 +1811,37 @@ func (e *Element) Text() string {
 	return text
 }
 
+// TrimText removes the leading and trailing whitespace from the character
+// data immediately following the element's opening tag, as returned by
+// Text. If 'collapse' is true, each run of whitespace within the text is also
+// replaced by a single space. The character data is left untouched if it
+// doesn't change, and removed if it contains only whitespace. Unlike
+// StripWhitespace, TrimText modifies significant text content.
+func (e *Element) TrimText(collapse bool) {
+	text := e.Text()
+	trimmed := trimSpace(text, collapse)
+	if trimmed == text {
+		return
+	}
+	var flags charDataFlags
+	if e.Child[0].(*CharData).IsCData() {
+		flags = cdataFlag
+	}
+	e.replaceText(0, trimmed, flags)
+}
+
+// TrimTextRecursive calls TrimText on this element and on each of its
+// descendant elements. Character data following an element's end tag, as
+// returned by Tail, is not modified.
+func (e *Element) TrimTextRecursive(collapse bool) {
+	e.TrimText(collapse)
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			c.TrimTextRecursive(collapse)
+		}
+	}
+}
+
 // SetText replaces all character data immediately following an element's
 // opening tag with the requested string.
 func (e *Element) SetText(text string) {
@@ -488,11 +1849,27 @@ func (e *Element) SetText(text string) {
 }
 
 // SetCData replaces all character data immediately following an element's
-// opening tag with a CDATA section.
+// opening tag with a CDATA section. The text is not checked for the sequence
+// "]]>", which cannot appear inside a CDATA section and produces invalid XML
+// when written. Use SetCDataSplit if the text might contain it.
 func (e *Element) SetCData(text string) {
 	e.replaceText(0, text, cdataFlag)
 }
 
+// SetCDataSplit replaces all character data immediately following an
+// element's opening tag with one or more CDATA sections. Wherever the text
+// contains the sequence "]]>", it is split between two adjacent sections so
+// that the serialized element remains valid XML, e.g. "a]]>b" is written as
+// <![CDATA[a]]]]><![CDATA[>b]]>. The element's Text is unchanged by the
+// split.
+func (e *Element) SetCDataSplit(text string) {
+	parts := splitCData(text)
+	e.replaceText(0, parts[0], cdataFlag)
+	for i, p := range parts[1:] {
+		e.InsertChildAt(i+1, newCharData(p, cdataFlag, nil))
+	}
+}
+
 // Tail returns all character data immediately following the element's end
 // tag.
 func (e *Element) Tail() string {
@@ -518,6 +1895,21 @@ func (e *Element) Tail() string {
 	return text
 }
 
+// SetTextf replaces all character data immediately following the element's
+// opening tag with text formatted according to the 'format' specifier, in the
+// manner of fmt.Sprintf.
+func (e *Element) SetTextf(format string, args ...interface{}) {
+	e.SetText(fmt.Sprintf(format, args...))
+}
+
+// SetTailf replaces all character data immediately following the element's
+// end tag with text formatted according to the 'format' specifier, in the
+// manner of fmt.Sprintf. Like SetTail, it does nothing if the element has no
+// parent.
+func (e *Element) SetTailf(format string, args ...interface{}) {
+	e.SetTail(fmt.Sprintf(format, args...))
+}
+
 // SetTail replaces all character data immediately following the element's end
 // tag with the requested string.
 func (e *Element) SetTail(text string) {
@@ -587,6 +1979,61 @@ func (e *Element) findTermCharDataIndex(start int) int {
 	return len(e.Child)
 }
 
+// SubstituteEntities replaces every entity reference of the form &name; in
+// the character data contained by this element and its descendants with
+// the value that 'entities' maps the name to. References to names missing
+// from the map are left unchanged, as are CDATA sections, in which entity
+// references aren't recognized. The replacement values are inserted as they
+// are, without looking for references within them. The function returns the
+// total number of references replaced. It is useful for text that still
+// holds entity references after reading, such as references to undefined
+// entities kept by a non-strict parser or references that were escaped in
+// the source.
+func (e *Element) SubstituteEntities(entities map[string]string) int {
+	count := 0
+	for _, c := range e.Child {
+		switch c := c.(type) {
+		case *CharData:
+			if c.IsCData() {
+				continue
+			}
+			if s, n := substituteEntities(c.Data, entities); n > 0 {
+				c.SetData(s)
+				count += n
+			}
+		case *Element:
+			count += c.SubstituteEntities(entities)
+		}
+	}
+	return count
+}
+
+// ReplaceTextAll replaces every occurrence of the string 'old' with the
+// string 'repl' in all character data tokens contained by this element and
+// its descendants. CDATA sections are modified only if 'includeCData' is
+// true. The function returns the total number of replacements made.
+func (e *Element) ReplaceTextAll(old, repl string, includeCData bool) int {
+	if old == "" {
+		return 0
+	}
+	count := 0
+	for _, c := range e.Child {
+		switch c := c.(type) {
+		case *CharData:
+			if c.IsCData() && !includeCData {
+				continue
+			}
+			if n := strings.Count(c.Data, old); n > 0 {
+				c.SetData(strings.Replace(c.Data, old, repl, -1))
+				count += n
+			}
+		case *Element:
+			count += c.ReplaceTextAll(old, repl, includeCData)
+		}
+	}
+	return count
+}
+
 // CreateElement creates a new element with the specified tag (i.e., name) and
 // adds it as the last child token of this element. The tag may include a
 // prefix followed by a colon.
@@ -595,10 +2042,32 @@ func (e *Element) CreateElement(tag string) *Element {
 	return newElement(space, stag, e)
 }
 
+// AddFragmentString parses the XML fragment 'xmlFragment' using the provided
+// read settings and adds the tokens it contains, which may include several
+// elements as well as character data and other tokens, as the last children
+// of this element. Namespace prefixes used by the fragment are resolved in
+// the context of this element after the tokens are added. If the fragment
+// can't be parsed, an error is returned and the element is not modified.
+func (e *Element) AddFragmentString(xmlFragment string, settings ReadSettings) error {
+	frag := newElement("", "", nil)
+	if _, err := frag.readFrom(strings.NewReader(xmlFragment), settings); err != nil {
+		return err
+	}
+	children := frag.Child
+	frag.Child = nil
+	for _, c := range children {
+		c.setParent(nil)
+	}
+	e.InsertChildrenAt(len(e.Child), children...)
+	return nil
+}
+
 // AddChild adds the token 't' as the last child of the element. If token 't'
 // was already the child of another element, it is first removed from its
-// parent element.
+// parent element. It panics with ErrCycle if 't' is this element or one of
+// its ancestors.
 func (e *Element) AddChild(t Token) {
+	e.checkCycle(t)
 	if t.Parent() != nil {
 		t.Parent().RemoveChild(t)
 	}
@@ -610,7 +2079,8 @@ func (e *Element) AddChild(t Token) {
 // 'ex' does not appear in this element's list of child tokens, then 't' is
 // added to the end of this element's list of child tokens. If token 't' is
 // already the child of another element, it is first removed from the other
-// element's list of child tokens.
+// element's list of child tokens. It panics with ErrCycle if 't' is this
+// element or one of its ancestors.
 //
 // Deprecated: InsertChild is deprecated. Use InsertChildAt instead.
 func (e *Element) InsertChild(ex Token, t Token) {
@@ -618,12 +2088,14 @@ func (e *Element) InsertChild(ex Token, t Token) {
 		e.AddChild(t)
 		return
 	}
+	e.checkCycle(t)
 
 	if t.Parent() != nil {
 		t.Parent().RemoveChild(t)
 	}
 
 	t.setParent(e)
+	e.dropChildIndex()
 
 	i := ex.Index()
 	e.Child = append(e.Child, nil)
@@ -635,15 +2107,40 @@ func (e *Element) InsertChild(ex Token, t Token) {
 	}
 }
 
+// MoveTo removes this element from its parent, if it has one, and inserts it
+// into the list of child tokens of 'newParent' just before the requested
+// 'index'. The index refers to the list of child tokens as it was before the
+// element was removed, so when the element is moved within the same parent,
+// it ends up just before the token that was at the index. If the index is
+// greater than or equal to the length of the list of child tokens, the
+// element is added to the end of the list. MoveTo returns ErrCycle, and
+// leaves the tree unchanged, if 'newParent' is this element or one of its
+// descendants.
+func (e *Element) MoveTo(newParent *Element, index int) error {
+	if e.Contains(newParent) {
+		return ErrCycle
+	}
+	if e.parent == newParent && e.index < index {
+		index--
+	}
+	if e.parent != nil {
+		e.parent.RemoveChild(e)
+	}
+	newParent.InsertChildAt(index, e)
+	return nil
+}
+
 // InsertChildAt inserts the token 't' into this element's list of child
 // tokens just before the requested 'index'. If the index is greater than or
 // equal to the length of the list of child tokens, then the token 't' is
-// added to the end of the list of child tokens.
+// added to the end of the list of child tokens. It panics with ErrCycle if
+// 't' is this element or one of its ancestors.
 func (e *Element) InsertChildAt(index int, t Token) {
 	if index >= len(e.Child) {
 		e.AddChild(t)
 		return
 	}
+	e.checkCycle(t)
 
 	if t.Parent() != nil {
 		if t.Parent() == e && t.Index() > index {
@@ -653,6 +2150,7 @@ func (e *Element) InsertChildAt(index int, t Token) {
 	}
 
 	t.setParent(e)
+	e.dropChildIndex()
 
 	e.Child = append(e.Child, nil)
 	copy(e.Child[index+1:], e.Child[index:])
@@ -663,6 +2161,76 @@ func (e *Element) InsertChildAt(index int, t Token) {
 	}
 }
 
+// InsertChildrenAt inserts the tokens 'tokens' into this element's list of
+// child tokens just before the requested 'index', preserving their order. If
+// the index is greater than or equal to the length of the list of child
+// tokens, then the tokens are added to the end of the list of child tokens.
+// Any token that is already the child of an element, including this one, is
+// first removed from that element's list of child tokens. Inserting many
+// tokens this way is considerably faster than calling InsertChildAt for each
+// of them. It panics with ErrCycle, without inserting any of the tokens, if
+// one of them is this element or one of its ancestors.
+func (e *Element) InsertChildrenAt(index int, tokens ...Token) {
+	if len(tokens) == 0 {
+		return
+	}
+	for _, t := range tokens {
+		e.checkCycle(t)
+	}
+	if index > len(e.Child) {
+		index = len(e.Child)
+	}
+
+	// Copy the tokens, since they may have been sliced from e.Child.
+	ts := make([]Token, len(tokens))
+	copy(ts, tokens)
+
+	// Detach the tokens from their parents. Tokens that are children of this
+	// element are unparented here and compacted out below in a single pass.
+	start := index
+	own := false
+	for _, t := range ts {
+		switch p := t.Parent(); {
+		case p == e:
+			if t.Index() < index {
+				index--
+			}
+			t.setParent(nil)
+			own = true
+		case p != nil:
+			p.RemoveChild(t)
+		}
+	}
+	if own {
+		j := 0
+		for _, c := range e.Child {
+			if c.Parent() == e {
+				e.Child[j] = c
+				j++
+			}
+		}
+		for k := j; k < len(e.Child); k++ {
+			e.Child[k] = nil
+		}
+		e.Child = e.Child[:j]
+		start = 0
+	}
+
+	for _, t := range ts {
+		t.setParent(e)
+	}
+	e.dropChildIndex()
+
+	n := len(e.Child)
+	e.Child = append(e.Child, ts...)
+	copy(e.Child[index+len(ts):], e.Child[index:n])
+	copy(e.Child[index:], ts)
+
+	for j := start; j < len(e.Child); j++ {
+		e.Child[j].setIndex(j)
+	}
+}
+
 // RemoveChild attempts to remove the token 't' from this element's list of
 // child tokens. If the token 't' was a child of this element, then it is
 // removed and returned. Otherwise, nil is returned.
@@ -682,6 +2250,9 @@ func (e *Element) RemoveChildAt(index int) Token {
 	}
 
 	t := e.Child[index]
+	if _, ok := t.(*Element); ok {
+		e.dropChildIndex()
+	}
 	for j := index + 1; j < len(e.Child); j++ {
 		e.Child[j].setIndex(j - 1)
 	}
@@ -691,96 +2262,655 @@ func (e *Element) RemoveChildAt(index int) Token {
 	return t
 }
 
-var cdataSection = []byte("<![CDATA[")
+// Splice replaces the child token appearing in slot 'index' of this
+// element's list of child tokens with the tokens 'replacement', preserving
+// their order, and returns the replaced token. Any replacement token that is
+// already the child of an element, including this one, is first removed from
+// that element's list of child tokens. If the index is out of bounds, the
+// list of child tokens is left unchanged and nil is returned. It panics with
+// ErrCycle, without modifying the element, if one of the replacement tokens
+// is this element or one of its ancestors.
+func (e *Element) Splice(index int, replacement ...Token) Token {
+	for _, r := range replacement {
+		e.checkCycle(r)
+	}
+	t := e.RemoveChildAt(index)
+	if t == nil {
+		return nil
+	}
+	e.InsertChildrenAt(index, replacement...)
+	return t
+}
 
-// ReadFrom reads XML from the reader 'ri' and stores the result as a new
-// child of this element.
-func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
-	var (
-		offset int64
-		buf    bytes.Buffer
-	)
+// Unwrap replaces this element, within its parent's list of child tokens,
+// with the element's own child tokens, leaving the element childless and
+// unparented. If the element has no parent, Unwrap does nothing.
+func (e *Element) Unwrap() {
+	p := e.parent
+	if p == nil {
+		return
+	}
+	children := e.Child
+	e.Child = nil
+	e.dropChildIndex()
+	for _, c := range children {
+		c.setParent(nil)
+		c.setIndex(-1)
+	}
+	p.Splice(e.index, children...)
+}
 
-	r := newCountReader(ri)
+var cdataSection = []byte("<![CDATA[")
 
-	// Tee decoder reads to a buffer for inspection
-	reader := io.TeeReader(r, &buf)
+// A Diagnostic describes a problem in the input that was tolerated while a
+// document was read. See Document.ReadFromDiag.
+type Diagnostic struct {
+	Offset  int64  // input offset of the token at which the problem was found
+	Message string // description of the problem and how it was handled
+}
 
-	dec := xml.NewDecoder(reader)
-	dec.CharsetReader = settings.CharsetReader
-	dec.Strict = !settings.Permissive
-	dec.Entity = settings.Entity
-	var stack stack
-	stack.push(e)
-	for {
-		t, err := dec.RawToken()
-		switch {
-		case err == io.EOF:
-			if len(stack.data) != 1 {
-				return r.bytes, ErrXML
-			}
+// String returns the diagnostic's offset and message.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("offset %d: %s", d.Offset, d.Message)
+}
 
-			return r.bytes, nil
-		case err != nil:
-			return r.bytes, err
-		case stack.empty():
-			return r.bytes, ErrXML
-		}
+// A decoder reads raw XML tokens from a reader and identifies the character
+// data tokens that were read from CDATA sections. It also records the source
+// text of tokens when verbatim reading is enabled.
+type decoder struct {
+	r              *countReader
+	dec            *xml.Decoder
+	buf            bytes.Buffer
+	offset         int64
+	start          int64 // input offset at which the last token read began
+	verbatim       bool
+	trackOffsets   bool
+	trackPositions bool
+	repairTags     bool
+	expand         bool
+	coalesce       bool
+	lastCharData   *CharData // the last character data token created
+	raw            []byte    // source text of the last token read
+	diags          []Diagnostic
+	line, col      int // input position at the current offset
+	startLine      int // input position at which the last token read began
+	startCol       int
+}
+
+// newDecoder creates a decoder that reads XML from the reader 'ri' using the
+// provided read settings.
+func newDecoder(ri io.Reader, settings ReadSettings) (*decoder, error) {
+	if settings.Decompress {
+		var err error
+		if ri, err = decompress(ri); err != nil {
+			return nil, err
+		}
+	}
+	if settings.ValidateEncoding {
+		var err error
+		if ri, err = validateEncoding(ri, settings.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	if settings.Encoding != "" {
+		var err error
+		if ri, err = CharsetReader(settings.Encoding, ri); err != nil {
+			return nil, err
+		}
+		settings.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+	}
+
+	d := &decoder{
+		r:              newCountReader(ri),
+		verbatim:       settings.Verbatim,
+		trackOffsets:   settings.TrackOffsets,
+		trackPositions: settings.TrackPositions,
+		repairTags:     settings.RepairTags,
+		expand:         settings.ExpandNamespaces,
+		coalesce:       settings.CoalesceText,
+		line:           1,
+		col:            1,
+	}
+
+	// Tee decoder reads to a buffer for inspection
+	d.dec = xml.NewDecoder(io.TeeReader(d.r, &d.buf))
+	d.dec.CharsetReader = settings.CharsetReader
+	d.dec.Strict = !settings.Permissive
+	d.dec.Entity = settings.Entity
+	return d, nil
+}
+
+// decompress returns a reader that decompresses the data read from 'r' if it
+// starts with the gzip magic bytes, or a reader of the unmodified data
+// otherwise.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// token returns the next raw XML token. The returned flags describe the
+// token's content if it is character data.
+func (d *decoder) token() (t xml.Token, flags charDataFlags, err error) {
+	t, err = d.dec.RawToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cd, ok := t.(xml.CharData); ok {
+		if isWhitespace(string(cd)) {
+			flags = whitespaceFlag
+		}
+
+		peek := d.buf.Bytes()
+		if len(peek) > 9 {
+			peek = peek[0:9]
+		}
+
+		if bytes.EqualFold(peek, cdataSection) {
+			flags = flags | cdataFlag
+		}
+	}
+
+	// Calculate the number of read bytes from the last offset.
+	read := d.dec.InputOffset() - d.offset
+
+	// Advance the buffer so that it's located at the input offset.
+	d.raw = d.buf.Next(int(read))
+
+	d.start, d.offset = d.offset, d.dec.InputOffset()
+	if d.trackPositions {
+		d.advancePosition()
+	}
+	return t, flags, nil
+}
+
+// newElement creates an element from the start element token 't' and adds
+// it to the parent element.
+func (d *decoder) newElement(t xml.StartElement, parent *Element) *Element {
+	e := newElement(t.Name.Space, t.Name.Local, parent)
+	for _, a := range t.Attr {
+		n := len(e.Attr)
+		e.createAttr(a.Name.Space, a.Name.Local, a.Value, e)
+		if len(e.Attr) == n {
+			d.warn("duplicate attribute %s on element <%s>; earlier value dropped",
+				spaceJoin(a.Name.Space, a.Name.Local), e.FullTag())
+		}
+	}
+	if d.verbatim {
+		e.verbatim = &verbatimElement{
+			start: string(d.raw),
+			space: e.Space,
+			tag:   e.Tag,
+			attr:  append([]Attr(nil), e.Attr...),
+		}
+	}
+	if d.trackOffsets || d.trackPositions {
+		e.source = &sourceRange{start: -1, end: -1}
+		if d.trackOffsets {
+			e.source.start = d.start
+		}
+		if d.trackPositions {
+			e.source.line, e.source.col = d.startLine, d.startCol
+		}
+	}
+	return e
+}
+
+// advancePosition records the line and column at which the last token read
+// began, and advances the current line and column past its source text.
+func (d *decoder) advancePosition() {
+	d.startLine, d.startCol = d.line, d.col
+	for _, b := range d.raw {
+		switch {
+		case b == '\n':
+			d.line++
+			d.col = 1
+		case b&0xc0 != 0x80:
+			d.col++
+		}
+	}
+}
+
+// endElement records the source text of the element's end tag, which has
+// just been read.
+func (d *decoder) endElement(e *Element) {
+	if e.verbatim != nil {
+		e.verbatim.end = string(d.raw)
+	}
+	if e.source != nil {
+		e.source.end = d.offset
+	}
+	if d.expand {
+		e.expandNamespaces()
+	}
+}
+
+// autoCloseElement closes an element whose end tag is missing from the
+// input. The element's end is taken to be the start of the last token read.
+func (d *decoder) autoCloseElement(e *Element, reason string) {
+	d.warn("element <%s> not closed; closed at %s", e.FullTag(), reason)
+	e.verbatim = nil
+	if e.source != nil {
+		e.source.end = d.start
+	}
+	if d.expand {
+		e.expandNamespaces()
+	}
+}
+
+// warn records a diagnostic for the last token read.
+func (d *decoder) warn(format string, args ...interface{}) {
+	d.diags = append(d.diags, Diagnostic{
+		Offset:  d.start,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// newCharData creates a character data token from 't' and adds it to the
+// parent element. When text is coalesced and the parent's last child token
+// is the character data token created just before, 't' is merged into that
+// token instead. It returns the token holding the character data.
+func (d *decoder) newCharData(t xml.CharData, flags charDataFlags, parent *Element) *CharData {
+	if d.coalesce && d.lastCharData != nil && parent != nil && len(parent.Child) > 0 && parent.Child[len(parent.Child)-1] == d.lastCharData {
+		c := d.lastCharData
+		c.Data += string(t)
+		c.flags = c.flags&flags&cdataFlag | whitespaceFlags(c.Data)
+		if c.verbatim != nil {
+			c.verbatim.source += string(d.raw)
+			c.verbatim.data = c.Data
+			c.verbatim.cdata = c.IsCData()
+		}
+		return c
+	}
+
+	c := newCharData(string(t), flags, parent)
+	if d.verbatim {
+		c.verbatim = &verbatimCharData{
+			source: string(d.raw),
+			data:   c.Data,
+			cdata:  c.IsCData(),
+		}
+	}
+	if d.coalesce {
+		d.lastCharData = c
+	}
+	return c
+}
+
+// newProcInst creates a processing instruction token from 't', adds it to
+// the parent element and returns it.
+func (d *decoder) newProcInst(t xml.ProcInst, parent *Element) *ProcInst {
+	p := newProcInst(t.Target, string(t.Inst), parent)
+	if d.verbatim {
+		p.verbatim = &verbatimProcInst{
+			source: string(d.raw),
+			target: p.Target,
+			inst:   p.Inst,
+		}
+	}
+	return p
+}
+
+// ReadFrom reads XML from the reader 'ri' and stores the result as a new
+// child of this element.
+func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
+	n, _, err = e.readFromDiag(ri, settings)
+	return n, err
+}
+
+// readFromDiag reads XML from the reader 'ri' and stores the result as a new
+// child of this element. It also returns the diagnostics recorded while
+// reading.
+func (e *Element) readFromDiag(ri io.Reader, settings ReadSettings) (n int64, diags []Diagnostic, err error) {
+	d, err := newDecoder(ri, settings)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = d.read(e)
+	return d.r.bytes, d.diags, err
+}
+
+// read reads XML tokens until the end of the input, adding the tokens to
+// the element 'e'.
+func (d *decoder) read(e *Element) error {
+	var stack stack
+	stack.push(e)
+	for {
+		t, flags, err := d.token()
+		switch {
+		case err == io.EOF:
+			if len(stack.data) != 1 {
+				if !d.repairTags {
+					return ErrXML
+				}
+				d.start = d.offset
+				for len(stack.data) > 1 {
+					d.autoCloseElement(stack.pop().(*Element), "end of input")
+				}
+			}
+
+			return nil
+		case err != nil:
+			return err
+		case stack.empty():
+			return ErrXML
+		}
 
 		top := stack.peek().(*Element)
 
 		switch t := t.(type) {
 		case xml.StartElement:
-			e := newElement(t.Name.Space, t.Name.Local, top)
-			for _, a := range t.Attr {
-				e.createAttr(a.Name.Space, a.Name.Local, a.Value, e)
-			}
-			stack.push(e)
+			stack.push(d.newElement(t, top))
 		case xml.EndElement:
 			if top.Tag != t.Name.Local || top.Space != t.Name.Space {
-				return r.bytes, ErrXML
+				if !d.repairTags {
+					return ErrXML
+				}
+				d.recoverEndElement(t, &stack)
+				continue
 			}
+			d.endElement(top)
 			stack.pop()
 		case xml.CharData:
-			data := string(t)
+			d.newCharData(t, flags, top)
+		case xml.Comment:
+			newComment(string(t), top)
+		case xml.Directive:
+			newDirective(string(t), top)
+		case xml.ProcInst:
+			d.newProcInst(t, top)
+		}
+	}
+}
 
-			var flags charDataFlags
-			if isWhitespace(data) {
-				flags = whitespaceFlag
-			}
+// recoverEndElement handles an end tag that doesn't match the innermost open
+// element. If the end tag matches an enclosing open element, the elements
+// nested within it are closed automatically. Otherwise the end tag is
+// dropped.
+func (d *decoder) recoverEndElement(t xml.EndElement, stack *stack) {
+	fullTag := spaceJoin(t.Name.Space, t.Name.Local)
+	for i := len(stack.data) - 1; i > 0; i-- {
+		e := stack.data[i].(*Element)
+		if e.Tag != t.Name.Local || e.Space != t.Name.Space {
+			continue
+		}
+		for len(stack.data)-1 > i {
+			d.autoCloseElement(stack.pop().(*Element), "</"+fullTag+">")
+		}
+		d.endElement(e)
+		stack.pop()
+		return
+	}
+	d.warn("unexpected end tag </%s> dropped", fullTag)
+}
 
-			peek := buf.Bytes()
-			if len(peek) > 9 {
-				peek = peek[0:9]
+// FindFirst reads XML from the reader 'r' and returns the first element
+// matched by the XPath-like 'path' string, evaluated from the document. It
+// stops reading as soon as the matched element's end tag has been read, and
+// it keeps only the matched element and its ancestors in memory while
+// searching. The returned element contains its complete subtree but has no
+// parent. The function returns nil if no matching element is found.
+//
+// Because elements are matched before their contents are read, the path may
+// contain only the '.', '/', '//', '*' and tag selectors, attribute filters,
+// and function filters other than text().
+func FindFirst(r io.Reader, path string, settings ReadSettings) (*Element, error) {
+	p, err := CompilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkStream(); err != nil {
+		return nil, err
+	}
+
+	doc := NewDocument()
+	matcher := newPather()
+	d, err := newDecoder(r, settings)
+	if err != nil {
+		return nil, err
+	}
+	stack := []*Element{&doc.Element}
+	var match *Element
+	for {
+		t, flags, err := d.token()
+		switch {
+		case err == io.EOF:
+			if len(stack) != 1 {
+				return nil, ErrXML
 			}
+			return nil, nil
+		case err != nil:
+			return nil, err
+		}
 
-			if bytes.EqualFold(peek, cdataSection) {
-				flags = flags | cdataFlag
+		top := stack[len(stack)-1]
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := d.newElement(t, top)
+			stack = append(stack, e)
+			if match == nil && matcher.matchStream(stack, 0, p.segments) {
+				match = e
 			}
+		case xml.EndElement:
+			if len(stack) == 1 || top.Tag != t.Name.Local || top.Space != t.Name.Space {
+				return nil, ErrXML
+			}
+			d.endElement(top)
+			stack = stack[:len(stack)-1]
 
-			newCharData(data, flags, top)
+			// Discard elements that aren't part of the match.
+			if match == nil || top == match {
+				top.parent.RemoveChild(top)
+			}
+			if top == match {
+				return match, nil
+			}
+		case xml.CharData:
+			if match != nil {
+				d.newCharData(t, flags, top)
+			}
 		case xml.Comment:
-			newComment(string(t), top)
+			if match != nil {
+				newComment(string(t), top)
+			}
 		case xml.Directive:
-			newDirective(string(t), top)
+			if match != nil {
+				newDirective(string(t), top)
+			}
 		case xml.ProcInst:
-			newProcInst(t.Target, string(t.Inst), top)
+			if match != nil {
+				d.newProcInst(t, top)
+			}
 		}
+	}
+}
 
-		// Calculate the number of read bytes from the last offset.
-		read := dec.InputOffset() - offset
+// StreamTransform reads XML from the reader 'r' one token at a time, passes
+// each token to the function 'edit', and immediately writes the token that
+// 'edit' returns to the writer 'w', so that only the token being processed
+// and its enclosing elements are held in memory. If 'edit' returns nil, the
+// token is dropped.
+//
+// Each element is passed to 'edit' when its start tag is read, with its
+// attributes but without any child tokens. If 'edit' returns the element
+// itself, possibly after renaming it or changing its attributes, its start
+// tag is written, followed by any child tokens that 'edit' added to it, and
+// the element's content in the input is then transformed in turn. If 'edit'
+// returns nil, the element and all of its content are dropped. If it returns
+// any other token, that token is written in place of the element and its
+// content. End tags are not passed to 'edit'. An element whose content is
+// entirely dropped is written as an empty element.
+//
+// The tokens passed to 'edit' have their enclosing elements as parents, so
+// that methods such as GetPath can be used, but the enclosing elements don't
+// list them among their child tokens. Elements are passed to 'edit' with
+// their namespaces expanded if ReadSettings.ExpandNamespaces is set.
+//
+// Tokens are written as Document.WriteTo writes them, so that settings such
+// as Verbatim and MaxLineWidth apply, except that EmptyWhitespace is ignored
+// since an element's start tag is written before its content is read. The
+// output written before an error occurs is flushed to 'w'.
+func StreamTransform(r io.Reader, w io.Writer, readSettings ReadSettings, writeSettings WriteSettings, edit func(t Token) Token) (err error) {
+	d, err := newDecoder(r, readSettings)
+	if err != nil {
+		return err
+	}
+
+	type frame struct {
+		name     xml.Name // the element's name in the input
+		e        *Element
+		verbatim bool // the element's start tag was written verbatim
+		endTag   bool // an empty element is written with an end tag
+		bindings int  // the number of prefix bindings outside the element
+	}
+	var stack []frame
+	var skipped []xml.Name // the names of the open elements being dropped
+	s := &writeSettings
+	b := bufio.NewWriter(w)
+	defer func() {
+		if ferr := b.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	var cw XMLWriter = b
+	if s.MaxLineWidth > 0 {
+		cw = trackColumns(b)
+	}
+	xw := withPrefixes(cw)
+	open := false // the last start tag written is missing its closing '>'
+	closeStartTag := func() {
+		if open {
+			xw.WriteByte('>')
+			open = false
+		}
+	}
+
+	for {
+		t, flags, err := d.token()
+		switch {
+		case err == io.EOF:
+			if len(stack) != 0 || len(skipped) != 0 {
+				return ErrXML
+			}
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if len(skipped) > 0 {
+			switch t := t.(type) {
+			case xml.StartElement:
+				skipped = append(skipped, t.Name)
+			case xml.EndElement:
+				if skipped[len(skipped)-1] != t.Name {
+					return ErrXML
+				}
+				skipped = skipped[:len(skipped)-1]
+			}
+			continue
+		}
 
-		// Advance the buffer so that it's located at the input offset.
-		_ = buf.Next(int(read))
+		var parent *Element
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].e
+		}
 
-		offset = dec.InputOffset()
+		var tok Token
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := d.newElement(t, nil)
+			e.setParent(parent)
+			if d.expand {
+				e.expandNamespaces()
+			}
+			tok = e
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].name != t.Name {
+				return ErrXML
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			switch {
+			case f.verbatim:
+				xw.Write(d.raw)
+			case !open:
+				f.e.writeEndTag(xw)
+			case f.endTag:
+				xw.WriteByte('>')
+				f.e.writeEndTag(xw)
+			default:
+				xw.Write([]byte{'/', '>'})
+			}
+			open = false
+			xw.restore(f.bindings)
+			continue
+		case xml.CharData:
+			tok = d.newCharData(t, flags, nil)
+		case xml.Comment:
+			tok = newComment(string(t), nil)
+		case xml.Directive:
+			tok = newDirective(string(t), nil)
+		case xml.ProcInst:
+			tok = d.newProcInst(t, nil)
+		}
+		tok.setParent(parent)
+
+		out := edit(tok)
+		if out == nil {
+			if t, ok := t.(xml.StartElement); ok {
+				skipped = append(skipped, t.Name)
+			}
+			continue
+		}
+		closeStartTag()
+
+		e, ok := tok.(*Element)
+		switch {
+		case !ok:
+			out.WriteTo(xw, s)
+		case out != tok:
+			out.WriteTo(xw, s)
+			skipped = append(skipped, t.(xml.StartElement).Name)
+		default:
+			// In verbatim mode, keep the end tag of an element read with one.
+			f := frame{name: t.(xml.StartElement).Name, e: e, bindings: len(xw.bindings)}
+			children := s.filterChildren(e.Child)
+			selfClosing := e.verbatim != nil && strings.HasSuffix(e.verbatim.start, "/>")
+			f.endTag = s.CanonicalEndTags || (s.Verbatim && e.verbatim != nil && !selfClosing)
+			if s.Verbatim && e.verbatimUnchanged() && (len(children) == 0 || !selfClosing) {
+				xw.WriteString(e.verbatim.start)
+				f.verbatim = true
+			} else {
+				closeLen := 2
+				if len(children) > 0 || f.endTag {
+					closeLen = 1
+				}
+				e.writeStartTag(xw, s, closeLen)
+				open = true
+				if len(children) > 0 {
+					closeStartTag()
+				}
+			}
+			for _, c := range children {
+				c.WriteTo(xw, s)
+			}
+			stack = append(stack, f)
+		}
 	}
 }
 
 // SelectAttr finds an element attribute matching the requested 'key' and, if
 // found, returns a pointer to the matching attribute. The function returns
 // nil if no matching attribute is found. The key may include a namespace
-// prefix followed by a colon.
+// prefix followed by a colon. The pointer remains valid only until the
+// element's attributes are next changed; see Attr.
 func (e *Element) SelectAttr(key string) *Attr {
 	space, skey := spaceDecompose(key)
 	for i, a := range e.Attr {
@@ -805,6 +2935,312 @@ func (e *Element) SelectAttrValue(key, dflt string) string {
 	return dflt
 }
 
+// SelectAttrNS finds an element attribute whose local key is 'key' and whose
+// namespace URI, as reported by Attr.NamespaceURI, is 'uri', and returns a
+// pointer to it. Unlike SelectAttr, the literal prefix is ignored. The xml
+// prefix matches the XML namespace URI, an empty 'uri' matches only
+// unprefixed attributes, and attributes whose prefixes are not declared
+// match no namespace. The function returns nil if no matching attribute is
+// found.
+func (e *Element) SelectAttrNS(uri, key string) *Attr {
+	for i := range e.Attr {
+		if a := &e.Attr[i]; a.Key == key && a.inNamespace(uri) {
+			return a
+		}
+	}
+	return nil
+}
+
+// CreateAttrNS creates an attribute with the local key 'key' in the
+// namespace 'uri' and the specified 'value', and adds it to this element. If
+// a matching attribute, as found by SelectAttrNS, already exists, then its
+// value is replaced. The attribute is given the nearest prefix declared for
+// the namespace on this element or its ancestors; if there is none, a
+// declaration for a new prefix of the form "nsN" is added to this element.
+// An empty 'uri' creates an unprefixed attribute.
+func (e *Element) CreateAttrNS(uri, key, value string) *Attr {
+	if a := e.SelectAttrNS(uri, key); a != nil {
+		a.Value = value
+		return a
+	}
+
+	var prefix string
+	switch uri {
+	case "":
+	case xmlNamespaceURI:
+		prefix = "xml"
+	default:
+		var ok bool
+		if prefix, ok = e.declaredPrefix(uri, false); !ok {
+			for i := 0; ; i++ {
+				prefix = "ns" + strconv.Itoa(i)
+				if e.findLocalNamespaceURI(prefix) == "" && e.SelectAttr(prefix+":"+key) == nil {
+					break
+				}
+			}
+			e.createAttr("xmlns", prefix, uri, e)
+		}
+	}
+	return e.createAttr(prefix, key, value, e)
+}
+
+// LookupAttr finds an element attribute matching the requested 'key' and
+// returns its value and true if found, or the empty string and false if no
+// matching attribute is found. Unlike SelectAttrValue, it distinguishes a
+// missing attribute from one whose value is empty or equal to a default. The
+// key may include a namespace prefix followed by a colon.
+func (e *Element) LookupAttr(key string) (value string, present bool) {
+	space, skey := spaceDecompose(key)
+	for _, a := range e.Attr {
+		if spaceMatch(space, a.Space) && skey == a.Key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// AttrKeys returns the keys of this element's attributes, including their
+// namespace prefixes, as returned by Attr.FullKey, in the order in which
+// the attributes appear. It returns nil if the element has no attributes.
+func (e *Element) AttrKeys() []string {
+	if len(e.Attr) == 0 {
+		return nil
+	}
+	keys := make([]string, len(e.Attr))
+	for i := range e.Attr {
+		keys[i] = e.Attr[i].FullKey()
+	}
+	return keys
+}
+
+// AttrFullKeys returns the keys of this element's attributes qualified by
+// their namespace URIs, in the order in which the attributes appear. The key
+// of an attribute in a namespace is written in Clark notation, as in
+// "{urn:x}key", which is also accepted in paths. The xml prefix is bound to
+// the XML namespace, and namespace declarations belong to the namespace
+// "http://www.w3.org/2000/xmlns/". The keys of attributes without a prefix,
+// and of those whose prefix is not declared, are returned as by
+// Attr.FullKey. It returns nil if the element has no attributes.
+func (e *Element) AttrFullKeys() []string {
+	if len(e.Attr) == 0 {
+		return nil
+	}
+	keys := make([]string, len(e.Attr))
+	for i := range e.Attr {
+		keys[i] = e.Attr[i].clarkKey()
+	}
+	return keys
+}
+
+// SelectAttrValuesFromChildren returns the values of the attribute matching
+// 'attrKey' on each child element with the given 'tag', in document order.
+// Child elements without a matching attribute are skipped. The tag and key
+// may include a namespace prefix followed by a colon.
+func (e *Element) SelectAttrValuesFromChildren(tag, attrKey string) []string {
+	var values []string
+	for _, c := range e.SelectElements(tag) {
+		if a := c.SelectAttr(attrKey); a != nil {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// AttrInt returns the value of the element attribute matching 'key' as an
+// integer. If no matching attribute is found or its value is not a valid
+// decimal integer, the function returns the 'dflt' value instead. See
+// ParseAttrInt.
+func (e *Element) AttrInt(key string, dflt int) int {
+	if v, err := e.ParseAttrInt(key); err == nil {
+		return v
+	}
+	return dflt
+}
+
+// AttrBool returns the value of the element attribute matching 'key' as a
+// boolean. If no matching attribute is found or its value is not a valid
+// boolean, the function returns the 'dflt' value instead. See ParseAttrBool.
+func (e *Element) AttrBool(key string, dflt bool) bool {
+	if v, err := e.ParseAttrBool(key); err == nil {
+		return v
+	}
+	return dflt
+}
+
+// AttrFloat returns the value of the element attribute matching 'key' as a
+// floating-point number. If no matching attribute is found or its value is
+// not a valid number, the function returns the 'dflt' value instead. See
+// ParseAttrFloat.
+func (e *Element) AttrFloat(key string, dflt float64) float64 {
+	if v, err := e.ParseAttrFloat(key); err == nil {
+		return v
+	}
+	return dflt
+}
+
+// ParseAttrInt parses the value of the element attribute matching 'key' as
+// a decimal integer, ignoring any leading and trailing whitespace. It
+// returns ErrAttrNotFound if there is no matching attribute, or an error
+// describing the invalid value if it can't be parsed. The key may include a
+// namespace prefix followed by a colon.
+func (e *Element) ParseAttrInt(key string) (int, error) {
+	a := e.SelectAttr(key)
+	if a == nil {
+		return 0, ErrAttrNotFound
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(a.Value))
+	if err != nil {
+		return 0, invalidAttrValue(a, "integer")
+	}
+	return v, nil
+}
+
+// ParseAttrBool parses the value of the element attribute matching 'key' as
+// a boolean, ignoring case and any leading and trailing whitespace. The
+// values "true", "yes" and "1" are true, and "false", "no" and "0" are false.
+// It returns ErrAttrNotFound if there is no matching attribute, or an error
+// describing the invalid value if it is not one of these. The key may
+// include a namespace prefix followed by a colon.
+func (e *Element) ParseAttrBool(key string) (bool, error) {
+	a := e.SelectAttr(key)
+	if a == nil {
+		return false, ErrAttrNotFound
+	}
+	switch strings.ToLower(strings.TrimSpace(a.Value)) {
+	case "true", "yes", "1":
+		return true, nil
+	case "false", "no", "0":
+		return false, nil
+	default:
+		return false, invalidAttrValue(a, "boolean")
+	}
+}
+
+// ParseAttrFloat parses the value of the element attribute matching 'key'
+// as a 64-bit floating-point number, ignoring any leading and trailing
+// whitespace. It returns ErrAttrNotFound if there is no matching attribute,
+// or an error describing the invalid value if it can't be parsed. The key
+// may include a namespace prefix followed by a colon.
+func (e *Element) ParseAttrFloat(key string) (float64, error) {
+	a := e.SelectAttr(key)
+	if a == nil {
+		return 0, ErrAttrNotFound
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(a.Value), 64)
+	if err != nil {
+		return 0, invalidAttrValue(a, "number")
+	}
+	return v, nil
+}
+
+// invalidAttrValue returns an error reporting that the attribute's value is
+// not a valid value of the named kind.
+func invalidAttrValue(a *Attr, kind string) error {
+	return fmt.Errorf("etree: attribute %s has invalid %s value %q", a.FullKey(), kind, a.Value)
+}
+
+// HasSignificantText returns true if any of the element's character data
+// children, including CDATA sections, contains a character other than
+// whitespace, or has been marked significant with CharData.SetSignificant.
+// Only the element's direct children are examined.
+func (e *Element) HasSignificantText() bool {
+	for _, t := range e.Child {
+		if cd, ok := t.(*CharData); ok && !cd.isIndentation() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMixedContent returns true if the element has mixed content: at least one
+// child element and at least one character data child containing a
+// character other than whitespace, or marked significant with
+// CharData.SetSignificant, as reported by HasSignificantText. Whitespace used
+// only to indent child elements does not make an element's content mixed.
+func (e *Element) IsMixedContent() bool {
+	var hasElement, hasText bool
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *Element:
+			hasElement = true
+		case *CharData:
+			hasText = hasText || !t.isIndentation()
+		}
+		if hasElement && hasText {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats holds counts describing the size of an element tree. See
+// Element.Stats and Document.Stats.
+type Stats struct {
+	Elements   int // number of elements
+	Attrs      int // number of attributes
+	Text       int // number of character data tokens, including CDATA sections
+	Comments   int // number of comments
+	ProcInsts  int // number of processing instructions
+	Directives int // number of directives
+	MaxDepth   int // maximum element nesting depth
+	TextBytes  int // total length in bytes of all character data
+}
+
+// Stats returns statistics describing the size of the subtree rooted at this
+// element, including the element itself, which has a depth of 1.
+func (e *Element) Stats() Stats {
+	var st Stats
+	st.add(e, 1)
+	return st
+}
+
+// Stats returns statistics describing the size of the whole document. The
+// root element has a depth of 1.
+func (d *Document) Stats() Stats {
+	var st Stats
+	for _, c := range d.Child {
+		st.add(c, 1)
+	}
+	return st
+}
+
+// add adds the token 't', found at the given depth, and its descendants to
+// the statistics.
+func (st *Stats) add(t Token, depth int) {
+	switch t := t.(type) {
+	case *Element:
+		st.Elements++
+		st.Attrs += len(t.Attr)
+		if depth > st.MaxDepth {
+			st.MaxDepth = depth
+		}
+		for _, c := range t.Child {
+			st.add(c, depth+1)
+		}
+	case *CharData:
+		st.Text++
+		st.TextBytes += len(t.Data)
+	case *Comment:
+		st.Comments++
+	case *ProcInst:
+		st.ProcInsts++
+	case *Directive:
+		st.Directives++
+	}
+}
+
+// Children returns a copy of this element's list of child tokens, or nil if
+// it has none. Unlike the Child field, the returned slice is not changed when
+// child tokens are added, removed or moved, and changing the returned slice
+// doesn't change the element, so it can be ranged over safely while the
+// element is being modified. The tokens themselves are not copied.
+func (e *Element) Children() []Token {
+	if len(e.Child) == 0 {
+		return nil
+	}
+	return append([]Token(nil), e.Child...)
+}
+
 // ChildElements returns all elements that are children of this element.
 func (e *Element) ChildElements() []*Element {
 	var elements []*Element
@@ -816,11 +3252,60 @@ func (e *Element) ChildElements() []*Element {
 	return elements
 }
 
+// ChildElementsFunc returns all elements that are children of this element
+// and for which the function 'pred' returns true.
+func (e *Element) ChildElementsFunc(pred func(e *Element) bool) []*Element {
+	var elements []*Element
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok && pred(c) {
+			elements = append(elements, c)
+		}
+	}
+	return elements
+}
+
+// WalkAttrs calls the function fn for each attribute of this element and
+// of each of its descendant elements, in document order, passing the
+// attribute and the element that owns it. Attributes of an element are
+// visited in the order in which they appear in its Attr slice, before those
+// of its descendants. The walk stops as soon as fn returns false.
+func (e *Element) WalkAttrs(fn func(e *Element, a *Attr) bool) {
+	e.walkAttrs(fn)
+}
+
+// walkAttrs implements WalkAttrs. It returns false if the walk was stopped.
+func (e *Element) walkAttrs(fn func(e *Element, a *Attr) bool) bool {
+	for i := range e.Attr {
+		if !fn(e, &e.Attr[i]) {
+			return false
+		}
+	}
+	for _, c := range e.Child {
+		if ce, ok := c.(*Element); ok && !ce.walkAttrs(fn) {
+			return false
+		}
+	}
+	return true
+}
+
 // SelectElement returns the first child element with the given 'tag' (i.e.,
 // name). The function returns nil if no child element matching the tag is
 // found. The tag may include a namespace prefix followed by a colon.
+//
+// The namespace prefix is compared literally, and a tag without a prefix
+// matches child elements with any prefix or none at all. For example,
+// SelectElement("item") may return an element written as <ns:item>. Use
+// SelectElementNS to match child elements by namespace URI instead.
 func (e *Element) SelectElement(tag string) *Element {
 	space, stag := spaceDecompose(tag)
+	if e.childIndex != nil {
+		for _, c := range e.childIndex[stag] {
+			if spaceMatch(space, c.Space) {
+				return c
+			}
+		}
+		return nil
+	}
 	for _, t := range e.Child {
 		if c, ok := t.(*Element); ok && spaceMatch(space, c.Space) && stag == c.Tag {
 			return c
@@ -831,9 +3316,18 @@ func (e *Element) SelectElement(tag string) *Element {
 
 // SelectElements returns a slice of all child elements with the given 'tag'
 // (i.e., name). The tag may include a namespace prefix followed by a colon.
+// The prefix is matched as described for SelectElement.
 func (e *Element) SelectElements(tag string) []*Element {
 	space, stag := spaceDecompose(tag)
 	var elements []*Element
+	if e.childIndex != nil {
+		for _, c := range e.childIndex[stag] {
+			if spaceMatch(space, c.Space) {
+				elements = append(elements, c)
+			}
+		}
+		return elements
+	}
 	for _, t := range e.Child {
 		if c, ok := t.(*Element); ok && spaceMatch(space, c.Space) && stag == c.Tag {
 			elements = append(elements, c)
@@ -842,11 +3336,104 @@ func (e *Element) SelectElements(tag string) []*Element {
 	return elements
 }
 
+// EnsureChildElement returns the first child element with the given 'tag',
+// as SelectElement does, or creates a new child element with the tag and
+// adds it to the end of this element's list of child tokens if there is
+// none. The tag may include a namespace prefix followed by a colon.
+func (e *Element) EnsureChildElement(tag string) *Element {
+	if c := e.SelectElement(tag); c != nil {
+		return c
+	}
+	return e.CreateElement(tag)
+}
+
+// EnsureChildWithAttr returns the first child element with the given 'tag'
+// that has an attribute matching 'attrKey' whose value is 'attrValue', or
+// creates a new child element with the tag and attribute and adds it to the
+// end of this element's list of child tokens if there is none. It is useful
+// for updating keyed lists of child elements, such as <param name="x">
+// elements, idempotently. The tag and key may include a namespace prefix
+// followed by a colon.
+func (e *Element) EnsureChildWithAttr(tag, attrKey, attrValue string) *Element {
+	for _, c := range e.SelectElements(tag) {
+		if v, ok := c.LookupAttr(attrKey); ok && v == attrValue {
+			return c
+		}
+	}
+	c := e.CreateElement(tag)
+	c.CreateAttr(attrKey, attrValue)
+	return c
+}
+
+// EnsurePath follows the slash-separated list of tags in 'path', such as
+// "a/b/c", from this element, calling EnsureChildElement for each tag to
+// find or create each element along the way. It returns the last element
+// reached, or this element itself if the path contains no tags. Empty tags
+// in the path are ignored. Unlike the Find methods, EnsurePath does not
+// interpret path selectors or filters.
+func (e *Element) EnsurePath(path string) *Element {
+	for _, tag := range strings.Split(path, "/") {
+		if tag != "" {
+			e = e.EnsureChildElement(tag)
+		}
+	}
+	return e
+}
+
+// SelectElementNS returns the first child element whose local name is 'tag'
+// and whose namespace URI, as reported by NamespaceURI, is 'uri'. Unlike
+// SelectElement, the literal prefix is ignored, so an element in a default
+// namespace declared with xmlns="..." matches, and an empty 'uri' matches
+// only elements that are not in any namespace. The function returns nil if
+// no matching child element is found.
+func (e *Element) SelectElementNS(uri, tag string) *Element {
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok && c.Tag == tag && c.NamespaceURI() == uri {
+			return c
+		}
+	}
+	return nil
+}
+
+// SelectElementsNS returns a slice of all child elements whose local name is
+// 'tag' and whose namespace URI is 'uri'. See SelectElementNS.
+func (e *Element) SelectElementsNS(uri, tag string) []*Element {
+	var elements []*Element
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok && c.Tag == tag && c.NamespaceURI() == uri {
+			elements = append(elements, c)
+		}
+	}
+	return elements
+}
+
+// BuildChildIndex builds an index of this element's child elements keyed by
+// tag. While the index exists, SelectElement and SelectElements use it
+// instead of scanning the list of child tokens, which speeds up repeated
+// lookups on elements with many children. The index is discarded whenever a
+// child element is added to or removed from this element through one of its
+// methods, or renamed with Rename or RenameAll. It is not updated if the
+// Child slice is modified directly or if a child element's Tag is assigned
+// directly; call BuildChildIndex again after doing so.
+func (e *Element) BuildChildIndex() {
+	e.childIndex = make(map[string][]*Element)
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			e.childIndex[c.Tag] = append(e.childIndex[c.Tag], c)
+		}
+	}
+}
+
+// dropChildIndex discards the element's child index, if it has one.
+func (e *Element) dropChildIndex() {
+	e.childIndex = nil
+}
+
 // FindElement returns the first element matched by the XPath-like 'path'
 // string. The function returns nil if no child element is found using the
 // path. It panics if an invalid path string is supplied.
 func (e *Element) FindElement(path string) *Element {
-	return e.FindElementPath(MustCompilePath(path))
+	return e.FindElementPath(compileCachedPath(path))
 }
 
 // FindElementPath returns the first element matched by the 'path' object. The
@@ -860,17 +3447,113 @@ func (e *Element) FindElementPath(path Path) *Element {
 	return nil
 }
 
+// FindElementErr returns the first element matched by the XPath-like 'path'
+// string, like FindElement. Instead of returning nil, it returns ErrNotFound
+// if no element is found using the path, and instead of panicking, it
+// returns an ErrPath if an invalid path string is supplied.
+func (e *Element) FindElementErr(path string) (*Element, error) {
+	p, err := tryCompileCachedPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if found := e.FindElementPath(p); found != nil {
+		return found, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindExactlyOne returns the only element matched by the XPath-like 'path'
+// string. It returns ErrNotFound if no element is found using the path,
+// ErrMultiple if more than one element is found, and an ErrPath if an
+// invalid path string is supplied.
+func (e *Element) FindExactlyOne(path string) (*Element, error) {
+	p, err := tryCompileCachedPath(path)
+	if err != nil {
+		return nil, err
+	}
+	switch elements := e.FindElementsPath(p); len(elements) {
+	case 0:
+		return nil, ErrNotFound
+	case 1:
+		return elements[0], nil
+	default:
+		return nil, ErrMultiple
+	}
+}
+
 // FindElements returns a slice of elements matched by the XPath-like 'path'
 // string. The function returns nil if no child element is found using the
 // path. It panics if an invalid path string is supplied.
 func (e *Element) FindElements(path string) []*Element {
-	return e.FindElementsPath(MustCompilePath(path))
+	return e.FindElementsPath(compileCachedPath(path))
+}
+
+// FindElementsPath returns a slice of elements matched by the 'path' object.
+func (e *Element) FindElementsPath(path Path) []*Element {
+	p := newPather()
+	return p.traverse(e, path)
+}
+
+// FindElementsReverse returns a slice of the elements matched by the
+// XPath-like 'path' string, in the reverse of the order in which FindElements
+// returns them. Removing the elements from their parents in this order
+// leaves the positions of the elements not yet removed unchanged. The
+// function returns nil if no element is found using the path. It panics if
+// an invalid path string is supplied.
+func (e *Element) FindElementsReverse(path string) []*Element {
+	return e.FindElementsPathReverse(compileCachedPath(path))
+}
+
+// FindElementsPathReverse returns a slice of the elements matched by the
+// 'path' object, in the reverse of the order in which FindElementsPath
+// returns them.
+func (e *Element) FindElementsPathReverse(path Path) []*Element {
+	elements := e.FindElementsPath(path)
+	for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+		elements[i], elements[j] = elements[j], elements[i]
+	}
+	return elements
+}
+
+// FindElementsAcross returns a slice of the elements matched by the
+// XPath-like 'path' string when it is evaluated from each of the elements in
+// 'roots', concatenating the results in the order of the roots. The path is
+// compiled only once. Nil roots are skipped. It panics if an invalid path
+// string is supplied.
+func FindElementsAcross(roots []*Element, path string) []*Element {
+	return FindElementsAcrossPath(roots, compileCachedPath(path))
+}
+
+// FindElementsAcrossPath returns a slice of the elements matched by the
+// 'path' object when it is evaluated from each of the elements in 'roots'.
+// See FindElementsAcross.
+func FindElementsAcrossPath(roots []*Element, path Path) []*Element {
+	var elements []*Element
+	for _, e := range roots {
+		if e != nil {
+			elements = append(elements, e.FindElementsPath(path)...)
+		}
+	}
+	return elements
 }
 
-// FindElementsPath returns a slice of elements matched by the 'path' object.
-func (e *Element) FindElementsPath(path Path) []*Element {
+// CountElements returns the number of elements matched by the XPath-like
+// 'path' string. It is equivalent to len(e.FindElements(path)), but it does
+// not build the slice of results; the matched elements are still recorded
+// internally while the path is evaluated, so memory use is only reduced by
+// the size of that slice. It panics if an invalid path string is supplied.
+func (e *Element) CountElements(path string) int {
+	return e.CountElementsPath(compileCachedPath(path))
+}
+
+// CountElementsPath returns the number of elements matched by the 'path'
+// object. It is equivalent to len(e.FindElementsPath(path)), but it does not
+// build the slice of results. See CountElements.
+func (e *Element) CountElementsPath(path Path) int {
 	p := newPather()
-	return p.traverse(e, path)
+	p.countOnly = true
+	p.traverse(e, path)
+	return len(p.inResults)
 }
 
 // GetPath returns the absolute path of the element. The absolute path is the
@@ -891,6 +3574,199 @@ func (e *Element) GetPath() string {
 	return "/" + strings.Join(path, "/")
 }
 
+// A PathToken describes one step of the absolute path to an element. See
+// Element.PathTokens.
+type PathToken struct {
+	Element  *Element // the element reached by this step
+	Space    string   // the element's namespace prefix
+	Tag      string   // the element's tag
+	Position int      // 1-based position among siblings with the same tag
+}
+
+// PathTokens returns the steps of the absolute path from the document's root
+// to the element, starting with the root element and ending with the element
+// itself. The Position of each step counts the element and its preceding
+// siblings that a path step with the element's full tag would match, so an
+// unprefixed tag counts siblings with any namespace prefix. Together with
+// the tag, the position identifies the element unambiguously, as in the
+// path "/a/b[2]/c".
+func (e *Element) PathTokens() []PathToken {
+	var tokens []PathToken
+	for seg := e; seg != nil; seg = seg.Parent() {
+		if seg.Tag == "" {
+			continue
+		}
+		tokens = append(tokens, PathToken{
+			Element:  seg,
+			Space:    seg.Space,
+			Tag:      seg.Tag,
+			Position: seg.siblingPosition(),
+		})
+	}
+
+	// Reverse the tokens.
+	for i, j := 0, len(tokens)-1; i < j; i, j = i+1, j-1 {
+		tokens[i], tokens[j] = tokens[j], tokens[i]
+	}
+
+	return tokens
+}
+
+// IndexedPath returns the absolute path of the element like GetPath, but
+// with a positional predicate such as "[2]" added to every step that would
+// otherwise also match a sibling element. FindElement and the other path
+// methods return this element when given the indexed path, as long as the
+// element belongs to a document and the tree has not been modified in the
+// meantime.
+func (e *Element) IndexedPath() string {
+	path := []string{}
+	for _, tok := range e.PathTokens() {
+		seg := tok.Element.FullTag()
+		if tok.Position > 1 || tok.Element.siblingCount() > 1 {
+			seg += "[" + strconv.Itoa(tok.Position) + "]"
+		}
+		path = append(path, seg)
+	}
+	return "/" + strings.Join(path, "/")
+}
+
+// siblingPosition returns the 1-based position of the element among its
+// parent's child elements that match its full tag.
+func (e *Element) siblingPosition() int {
+	p := e.Parent()
+	if p == nil || e.index < 0 {
+		return 1
+	}
+	pos := 1
+	for _, c := range p.Child[:e.index] {
+		if c, ok := c.(*Element); ok && spaceMatch(e.Space, c.Space) && e.Tag == c.Tag {
+			pos++
+		}
+	}
+	return pos
+}
+
+// siblingCount returns the number of the parent's child elements that match
+// the element's full tag, including the element itself.
+func (e *Element) siblingCount() int {
+	p := e.Parent()
+	if p == nil {
+		return 1
+	}
+	n := 0
+	for _, c := range p.Child {
+		if c, ok := c.(*Element); ok && spaceMatch(e.Space, c.Space) && e.Tag == c.Tag {
+			n++
+		}
+	}
+	return n
+}
+
+// A FlatNode describes one element of a flattened element tree. See
+// Element.Flatten.
+type FlatNode struct {
+	Element *Element          // the element described
+	Path    string            // the element's path, as returned by IndexedPath
+	Attrs   map[string]string // the element's attribute values keyed by FullKey
+	Text    string            // the element's text, as returned by Text
+}
+
+// Flatten returns a list describing each of the element's descendant
+// elements, in document order. If 'leavesOnly' is true, only descendants
+// without child elements of their own are included. The Attrs map of a
+// FlatNode is nil if the element has no attributes.
+func (e *Element) Flatten(leavesOnly bool) []FlatNode {
+	var nodes []FlatNode
+	path := e.IndexedPath()
+	if path == "/" {
+		path = ""
+	}
+	e.flatten(leavesOnly, path, &nodes)
+	return nodes
+}
+
+// flatten appends a FlatNode for each of the element's descendants to the
+// list 'nodes'. The string 'path' holds the element's IndexedPath, or is
+// empty if the element is a document. The paths of the descendants are
+// built from it as they are visited, counting each list of siblings only
+// once.
+func (e *Element) flatten(leavesOnly bool, path string, nodes *[]FlatNode) {
+	// An element with an unprefixed tag is counted among the siblings with
+	// the same tag and any prefix, as in IndexedPath.
+	counts := make(map[string]int)
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			counts[c.Tag]++
+			if c.Space != "" {
+				counts[c.FullTag()]++
+			}
+		}
+	}
+
+	positions := make(map[string]int)
+	for _, t := range e.Child {
+		c, ok := t.(*Element)
+		if !ok {
+			continue
+		}
+		positions[c.Tag]++
+		key := c.Tag
+		if c.Space != "" {
+			key = c.FullTag()
+			positions[key]++
+		}
+
+		cpath := path
+		if c.Tag != "" {
+			cpath += "/" + c.FullTag()
+			if pos := positions[key]; pos > 1 || counts[key] > 1 {
+				cpath += "[" + strconv.Itoa(pos) + "]"
+			}
+		}
+
+		if !leavesOnly || !c.hasChildElement() {
+			p := cpath
+			if p == "" {
+				p = "/"
+			}
+			n := FlatNode{Element: c, Path: p, Text: c.Text()}
+			if len(c.Attr) > 0 {
+				n.Attrs = make(map[string]string, len(c.Attr))
+				for _, a := range c.Attr {
+					n.Attrs[a.FullKey()] = a.Value
+				}
+			}
+			*nodes = append(*nodes, n)
+		}
+		c.flatten(leavesOnly, cpath, nodes)
+	}
+}
+
+// hasChildElement returns true if the element has at least one child
+// element.
+func (e *Element) hasChildElement() bool {
+	for _, c := range e.Child {
+		if _, ok := c.(*Element); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPathTo returns the path from this element down to the 'descendant'
+// element, such as "./b/c", or "." if 'descendant' is this element. It is
+// equivalent to descendant.GetRelativePath(e), except that it returns the
+// empty string if 'descendant' is not this element or one of its
+// descendants.
+func (e *Element) GetPathTo(descendant *Element) string {
+	for seg := descendant; seg != nil; seg = seg.Parent() {
+		if seg == e {
+			return descendant.GetRelativePath(e)
+		}
+	}
+	return ""
+}
+
 // GetRelativePath returns the path of this element relative to the 'source'
 // element. If the two elements are not part of the same element tree, then
 // the function returns the empty string.
@@ -964,146 +3840,593 @@ func (e *Element) GetRelativePath(source *Element) string {
 
 // indent recursively inserts proper indentation between an XML element's
 // child tokens.
-func (e *Element) indent(depth int, indent indentFunc) {
+func (e *Element) indent(depth int, indent indentFunc, s *WriteSettings) {
 	e.stripIndent()
-	n := len(e.Child)
-	if n == 0 {
+	if len(e.Child) == 0 {
 		return
 	}
 
-	oldChild := e.Child
-	e.Child = make([]Token, 0, n*2+1)
-	isCharData, firstNonCharData := false, true
-	for _, c := range oldChild {
+	e.Child = e.indentedChildren(e.Child, depth, indent, s)
+	for i, c := range e.Child {
+		c.setParent(e)
+		c.setIndex(i)
+
+		// Recursively process child elements.
+		if ce, ok := c.(*Element); ok {
+			ce.indent(depth+1, indent, s)
+		}
+	}
+}
+
+// indentedChildren returns a new list of child tokens containing the tokens
+// in 'child', which must not include any indentation, with character data
+// tokens for indentation inserted between them. The inserted tokens are not
+// bound to a parent.
+func (e *Element) indentedChildren(child []Token, depth int, indent indentFunc, s *WriteSettings) []Token {
+	n := len(child)
+	if n == 0 {
+		return child
+	}
+
+	children := make([]Token, 0, n*2+1)
+	isCharData, firstNonCharData, inline := false, true, false
+	for i, c := range child {
 		// Insert NL+indent before child if it's not character data.
 		// Exceptions: when it's the first non-character-data child, or when
-		// the child is at root depth.
+		// the child is at root depth, or when it's a leading comment kept
+		// inline.
 		_, isCharData = c.(*CharData)
+		if _, ok := c.(*Comment); ok && i == 0 && depth > 0 {
+			inline = s.InlineLeadingComments
+		}
 		if !isCharData {
-			if !firstNonCharData || depth > 0 {
+			if (!firstNonCharData || depth > 0) && !(i == 0 && inline) {
 				s := indent(depth)
 				if s != "" {
-					newCharData(s, whitespaceFlag, e)
+					children = append(children, newCharData(s, whitespaceFlag, nil))
 				}
 			}
 			firstNonCharData = false
 		}
 
-		e.addChild(c)
+		children = append(children, c)
+	}
+
+	// Insert NL+indent before the last child.
+	if !isCharData && !(n == 1 && inline) {
+		if !firstNonCharData || depth > 0 {
+			s := indent(depth - 1)
+			if s != "" {
+				children = append(children, newCharData(s, whitespaceFlag, nil))
+			}
+		}
+	}
+	return children
+}
+
+// writeIndented serializes the element as if it had been indented at the
+// given depth, without modifying it.
+func (e *Element) writeIndented(w *prefixWriter, s *WriteSettings, depth int, indent indentFunc) {
+	child := make([]Token, 0, len(e.Child))
+	for _, c := range s.filterChildren(e.Child) {
+		if cd, ok := c.(*CharData); !ok || !cd.isIndentation() {
+			child = append(child, c)
+		}
+	}
+	children := e.indentedChildren(child, depth, indent, s)
+	e.writeTo(w, s, children, func(c Token) {
+		if ce, ok := c.(*Element); ok {
+			ce.writeIndented(w, s, depth+1, indent)
+		} else {
+			c.WriteTo(w, s)
+		}
+	})
+}
+
+// WriteIndentedTo serializes the element and its descendants to the writer
+// 'w' using the provided write settings, indented by 'spaces' spaces per
+// depth level, and returns the number of bytes written and any error
+// encountered. The element is written as if it were the root element of a
+// document that had been indented with Document.Indent, but the element
+// tree is not modified. Pass etree.NoIndent for 'spaces' if you want no
+// indentation at all.
+func (e *Element) WriteIndentedTo(w io.Writer, settings WriteSettings, spaces int) (n int64, err error) {
+	indent := spaceIndent(spaces, settings.UseCRLF)
+	cw := newCountWriter(limitOutput(w, settings.MaxOutputBytes))
+	b := bufio.NewWriter(cw)
+	var xw XMLWriter = b
+	if settings.MaxLineWidth > 0 {
+		xw = trackColumns(b)
+	}
+	e.writeIndented(withPrefixes(xw), &settings, 1, indent)
+	b.WriteString(indent(-1))
+	err, n = b.Flush(), cw.bytes
+	return
+}
+
+// StripWhitespace recursively removes all character data tokens containing
+// only whitespace from this element and its descendants. CDATA sections,
+// character data containing any non-whitespace characters and character data
+// marked significant with CharData.SetSignificant are preserved.
+func (e *Element) StripWhitespace() {
+	j := 0
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && !cd.IsCData() && !cd.IsSignificant() && isWhitespace(cd.Data) {
+			cd.setParent(nil)
+			cd.setIndex(-1)
+			continue
+		}
+		if ce, ok := c.(*Element); ok {
+			ce.StripWhitespace()
+		}
+		e.Child[j] = c
+		e.Child[j].setIndex(j)
+		j++
+	}
+	for k := j; k < len(e.Child); k++ {
+		e.Child[k] = nil
+	}
+	e.Child = e.Child[:j]
+}
+
+// Compact recursively reallocates the Child and Attr slices of this element
+// and its descendants so that their capacity matches their length. Editing a
+// document can leave these slices with a large amount of unused capacity;
+// Compact releases it, at the cost of copying every slice it shrinks. It is
+// intended for documents that are kept in memory for a long time after they
+// have been modified.
+func (e *Element) Compact() {
+	if cap(e.Child) > len(e.Child) {
+		e.Child = append([]Token(nil), e.Child...)
+	}
+	if cap(e.Attr) > len(e.Attr) {
+		e.Attr = append([]Attr(nil), e.Attr...)
+	}
+	for _, c := range e.Child {
+		if ce, ok := c.(*Element); ok {
+			ce.Compact()
+		}
+	}
+}
+
+// stripIndent removes any previously inserted indentation.
+func (e *Element) stripIndent() {
+	// Count the number of non-indent child tokens
+	n := len(e.Child)
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && cd.isIndentation() {
+			n--
+		}
+	}
+	if n == len(e.Child) {
+		return
+	}
+
+	// Strip out indent CharData
+	newChild := make([]Token, n)
+	j := 0
+	for _, c := range e.Child {
+		if cd, ok := c.(*CharData); ok && cd.isIndentation() {
+			continue
+		}
+		newChild[j] = c
+		newChild[j].setIndex(j)
+		j++
+	}
+	e.Child = newChild
+}
+
+// dup duplicates the element.
+func (e *Element) dup(parent *Element) Token {
+	ne := &Element{
+		Space:    e.Space,
+		Tag:      e.Tag,
+		Attr:     make([]Attr, len(e.Attr)),
+		Child:    make([]Token, len(e.Child)),
+		parent:   parent,
+		index:    e.index,
+		verbatim: e.verbatim,
+		source:   e.source,
+	}
+	for i, t := range e.Child {
+		ne.Child[i] = t.dup(ne)
+	}
+	copy(ne.Attr, e.Attr)
+	return ne
+}
+
+// Parent returns this element's parent element. It returns nil if this
+// element has no parent.
+func (e *Element) Parent() *Element {
+	return e.parent
+}
+
+// Contains returns true if the element 'other' is this element or one of
+// its descendants. It returns false if 'other' is nil.
+func (e *Element) Contains(other *Element) bool {
+	for ; other != nil; other = other.parent {
+		if other == e {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDescendantOf returns true if this element is a descendant of the
+// element 'ancestor', i.e., if 'ancestor' contains this element and is not
+// the element itself.
+func (e *Element) IsDescendantOf(ancestor *Element) bool {
+	return ancestor != nil && e.parent != nil && ancestor.Contains(e.parent)
+}
+
+// Index returns the index of this element within its parent element's
+// list of child tokens. If this element has no parent, then the function
+// returns -1.
+func (e *Element) Index() int {
+	return e.index
+}
+
+// SiblingIndex returns the 1-based position of this element among its
+// parent's child elements having exactly the same namespace prefix and tag,
+// i.e., one more than the number of such elements preceding it. If this
+// element has no parent, then the function returns 1. Unlike Index, the
+// position is computed by scanning the parent's preceding child tokens, so
+// it takes time proportional to the element's index. It differs from the
+// Position reported by PathTokens for unprefixed elements, which also counts
+// siblings having any namespace prefix.
+func (e *Element) SiblingIndex() int {
+	if e.parent == nil || e.index < 0 {
+		return 1
+	}
+	n := 1
+	for _, c := range e.parent.Child[:e.index] {
+		if c, ok := c.(*Element); ok && c.Space == e.Space && c.Tag == e.Tag {
+			n++
+		}
+	}
+	return n
+}
+
+// setParent replaces this element token's parent.
+func (e *Element) setParent(parent *Element) {
+	e.parent = parent
+}
+
+// setIndex sets this element token's index within its parent's Child slice.
+func (e *Element) setIndex(index int) {
+	e.index = index
+}
+
+// WriteTo serializes the element to the writer w.
+func (e *Element) WriteTo(w XMLWriter, s *WriteSettings) {
+	pw, ok := w.(*prefixWriter)
+	if !ok {
+		if s.MaxLineWidth > 0 {
+			w = trackColumns(w)
+		}
+		pw = withPrefixes(w)
+	}
+	e.writeTo(pw, s, s.filterChildren(e.Child), func(c Token) { c.WriteTo(pw, s) })
+}
+
+// EncodeToken encodes the element and its descendants as a sequence of
+// encoding/xml tokens written to the encoder 'enc', so that the element can
+// be embedded in output produced with the standard library's xml.Encoder.
+// If the element is a Document, its child tokens are encoded instead. The
+// encoder is not flushed.
+//
+// Since the encoder identifies namespaces by URI rather than by prefix,
+// each element and attribute name is converted to an xml.Name whose Space
+// holds the namespace URI reported by NamespaceURI and whose Local holds the
+// local name. The encoder then writes its own namespace declarations, which
+// may use different prefixes, and the element's namespace declaration
+// attributes are omitted. Prefixes bound to no namespace are kept as part of
+// Local, and the xml prefix is mapped to the XML namespace URI. Character
+// data is encoded as xml.CharData, so CDATA sections become escaped text.
+func (e *Element) EncodeToken(enc *xml.Encoder) error {
+	if e.Tag == "" && e.parent == nil {
+		return encodeChildTokens(enc, e.Child, "")
+	}
+	return e.encodeToken(enc, "")
+}
+
+// encodeToken encodes the element as EncodeToken does. The 'dflt' parameter
+// holds the default namespace URI the encoder has declared in the current
+// scope, which must be undeclared for elements in no namespace.
+func (e *Element) encodeToken(enc *xml.Encoder, dflt string) error {
+	start := xml.StartElement{Name: e.xmlName()}
+	switch {
+	case start.Name.Space != "":
+		dflt = start.Name.Space
+	case dflt != "":
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xmlns"}})
+		dflt = ""
+	}
+	for i := range e.Attr {
+		if a := &e.Attr[i]; !a.IsNamespaceDecl() {
+			start.Attr = append(start.Attr, xml.Attr{Name: a.xmlName(), Value: a.Value})
+		}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := encodeChildTokens(enc, e.Child, dflt); err != nil {
+		return err
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// encodeChildTokens encodes each of the tokens in 'child' to the encoder.
+func encodeChildTokens(enc *xml.Encoder, child []Token, dflt string) error {
+	for _, c := range child {
+		var err error
+		switch c := c.(type) {
+		case *Element:
+			err = c.encodeToken(enc, dflt)
+		case *CharData:
+			err = enc.EncodeToken(xml.CharData(c.Data))
+		case *Comment:
+			err = enc.EncodeToken(xml.Comment(c.Data))
+		case *Directive:
+			err = enc.EncodeToken(xml.Directive(c.Data))
+		case *ProcInst:
+			err = enc.EncodeToken(xml.ProcInst{Target: c.Target, Inst: []byte(c.Inst)})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xmlName returns the element's name as an encoding/xml name, as described
+// by EncodeToken.
+func (e *Element) xmlName() xml.Name {
+	uri := e.NamespaceURI()
+	if e.Space != "" && uri == "" {
+		return xml.Name{Local: e.FullTag()}
+	}
+	return xml.Name{Space: uri, Local: e.Tag}
+}
+
+// writeTo serializes the element to the writer, with the tokens in
+// 'children' in place of its child tokens. Each child token is serialized by
+// calling 'writeChild'.
+func (e *Element) writeTo(w *prefixWriter, s *WriteSettings, children []Token, writeChild func(c Token)) {
+	if s.EmptyWhitespace && allWhitespaceText(children) {
+		children = nil
+	}
+	if s.Verbatim && e.writeVerbatim(w, children, writeChild) {
+		return
+	}
+	defer w.restore(len(w.bindings))
+
+	// In verbatim mode, keep the end tag of an element read with one.
+	endTag := len(children) > 0 || s.CanonicalEndTags ||
+		(s.Verbatim && e.verbatim != nil && e.verbatim.end != "")
+
+	closeLen := 2
+	if endTag {
+		closeLen = 1
+	}
+	e.writeStartTag(w, s, closeLen)
+	if len(children) > 0 {
+		w.WriteByte('>')
+		for _, c := range children {
+			writeChild(c)
+		}
+		e.writeEndTag(w)
+	} else {
+		if endTag {
+			w.WriteByte('>')
+			e.writeEndTag(w)
+		} else {
+			w.Write([]byte{'/', '>'})
+		}
+	}
+}
+
+// writeStartTag writes the element's start tag and attributes, without the
+// '>' or "/>" that closes the tag, which is expected to take 'closeLen'
+// characters when deciding whether to wrap the attributes. The tag ends with
+// declarations of the prefixes 'w' binds to namespace URIs used by the tag
+// that no declaration in the element tree binds; they remain in scope until
+// the element's bindings are restored.
+func (e *Element) writeStartTag(w *prefixWriter, s *WriteSettings, closeLen int) {
+	mark := len(w.bindings)
+	tag := e.writtenTag(w)
+	cw, wrap := columns(w)
+	wrap = wrap && s.MaxLineWidth > 0 && cw.blank && cw.indented
+	w.WriteByte('<')
+	w.WriteString(tag)
+	if !wrap {
+		for i := range e.Attr {
+			a := &e.Attr[i]
+			w.WriteByte(' ')
+			a.writeTo(w, s, e.writtenName(a.Space, a.Key, false, w))
+		}
+		for _, b := range w.bindings[mark:] {
+			w.WriteByte(' ')
+			b.writeTo(w, s)
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	attrs := make([]string, 0, len(e.Attr))
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		buf.Reset()
+		a.writeTo(&buf, s, e.writtenName(a.Space, a.Key, false, w))
+		attrs = append(attrs, buf.String())
+	}
+	for _, b := range w.bindings[mark:] {
+		buf.Reset()
+		b.writeTo(&buf, s)
+		attrs = append(attrs, buf.String())
+	}
+	writeWrappedAttrs(cw, s, attrs, closeLen)
+}
+
+// writeEndTag writes the element's end tag.
+func (e *Element) writeEndTag(w *prefixWriter) {
+	w.Write([]byte{'<', '/'})
+	w.WriteString(e.writtenTag(w))
+	w.WriteByte('>')
+}
+
+// writeWrappedAttrs writes the serialized attributes 'attrs' following an
+// element's tag name, wrapping them onto separate lines if the start tag,
+// including the 'closeLen' characters that close it, would extend past the
+// maximum line width.
+func writeWrappedAttrs(cw *columnWriter, s *WriteSettings, attrs []string, closeLen int) {
+	if len(attrs) == 0 {
+		return
+	}
+	width := cw.col + closeLen
+	for _, a := range attrs {
+		width += 1 + utf8.RuneCountInString(a)
+	}
 
-		// Recursively process child elements.
-		if ce, ok := c.(*Element); ok {
-			ce.indent(depth+1, indent)
+	cw.WriteByte(' ')
+	cw.WriteString(attrs[0])
+	if width <= s.MaxLineWidth {
+		for _, a := range attrs[1:] {
+			cw.WriteByte(' ')
+			cw.WriteString(a)
 		}
+		return
 	}
 
-	// Insert NL+indent before the last child.
-	if !isCharData {
-		if !firstNonCharData || depth > 0 {
-			s := indent(depth - 1)
-			if s != "" {
-				newCharData(s, whitespaceFlag, e)
-			}
-		}
+	// Align the attributes with the first one, which follows the line's
+	// indentation, the tag name and a space.
+	newline := "\n"
+	if s.UseCRLF {
+		newline = "\r\n"
+	}
+	align := string(cw.indent) + strings.Repeat(" ", cw.col-len(cw.indent)-utf8.RuneCountInString(attrs[0]))
+	for _, a := range attrs[1:] {
+		cw.WriteString(newline)
+		cw.WriteString(align)
+		cw.WriteString(a)
 	}
 }
 
-// stripIndent removes any previously inserted indentation.
-func (e *Element) stripIndent() {
-	// Count the number of non-indent child tokens
-	n := len(e.Child)
-	for _, c := range e.Child {
-		if cd, ok := c.(*CharData); ok && cd.IsWhitespace() {
-			n--
-		}
+// writeVerbatim serializes the element using the source text of its tags,
+// if it has been recorded and the element's name and attributes haven't
+// changed since it was read. It returns false if nothing was written.
+func (e *Element) writeVerbatim(w *prefixWriter, children []Token, writeChild func(c Token)) bool {
+	if !e.verbatimUnchanged() {
+		return false
 	}
-	if n == len(e.Child) {
-		return
+
+	// A self-closing tag can't be reused once the element has children.
+	v := e.verbatim
+	selfClosing := v.end == ""
+	if selfClosing && len(children) > 0 {
+		return false
 	}
 
-	// Strip out indent CharData
-	newChild := make([]Token, n)
-	j := 0
-	for _, c := range e.Child {
-		if cd, ok := c.(*CharData); ok && cd.IsWhitespace() {
-			continue
+	w.WriteString(v.start)
+	if !selfClosing {
+		for _, c := range children {
+			writeChild(c)
 		}
-		newChild[j] = c
-		newChild[j].setIndex(j)
-		j++
+		w.WriteString(v.end)
 	}
-	e.Child = newChild
+	return true
 }
 
-// dup duplicates the element.
-func (e *Element) dup(parent *Element) Token {
-	ne := &Element{
-		Space:  e.Space,
-		Tag:    e.Tag,
-		Attr:   make([]Attr, len(e.Attr)),
-		Child:  make([]Token, len(e.Child)),
-		parent: parent,
-		index:  e.index,
+// verbatimUnchanged returns true if the source text of the element's tags
+// has been recorded and the element's name and attributes haven't changed
+// since it was read.
+func (e *Element) verbatimUnchanged() bool {
+	v := e.verbatim
+	if v == nil || v.space != e.Space || v.tag != e.Tag || len(v.attr) != len(e.Attr) {
+		return false
 	}
-	for i, t := range e.Child {
-		ne.Child[i] = t.dup(ne)
+	for i := range v.attr {
+		if !v.attr[i].Equal(e.Attr[i]) {
+			return false
+		}
 	}
-	copy(ne.Attr, e.Attr)
-	return ne
+	return true
 }
 
-// Parent returns this element's parent element. It returns nil if this
-// element has no parent.
-func (e *Element) Parent() *Element {
-	return e.parent
+// String serializes the element and all its descendants into a string using
+// the default write settings. It implements the fmt.Stringer interface, so
+// the element's XML is printed when the element is formatted using the %v or
+// %s verbs. The entire subtree is serialized regardless of its size.
+func (e *Element) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var buf bytes.Buffer
+	s := newWriteSettings()
+	e.WriteTo(&buf, &s)
+	return buf.String()
 }
 
-// Index returns the index of this element within its parent element's
-// list of child tokens. If this element has no parent, then the function
-// returns -1.
-func (e *Element) Index() int {
-	return e.index
+// OuterXML returns the serialization of the element and all its descendants
+// using the default write settings. It is equivalent to String, except
+// that it can't be called on a nil element.
+func (e *Element) OuterXML() string {
+	return e.OuterXMLWS(newWriteSettings())
 }
 
-// setParent replaces this element token's parent.
-func (e *Element) setParent(parent *Element) {
-	e.parent = parent
+// OuterXMLWS returns the serialization of the element and all its
+// descendants using the provided write settings.
+func (e *Element) OuterXMLWS(settings WriteSettings) string {
+	var buf bytes.Buffer
+	e.WriteTo(&buf, &settings)
+	return buf.String()
 }
 
-// setIndex sets this element token's index within its parent's Child slice.
-func (e *Element) setIndex(index int) {
-	e.index = index
+// InnerXML returns the serialization of the element's child tokens and their
+// descendants using the default write settings. The element's own start and
+// end tags are not included.
+func (e *Element) InnerXML() string {
+	return e.InnerXMLWS(newWriteSettings())
 }
 
-// WriteTo serializes the element to the writer w.
-func (e *Element) WriteTo(w XMLWriter, s *WriteSettings) {
-	w.WriteByte('<')
-	w.WriteString(e.FullTag())
-	for _, a := range e.Attr {
-		w.WriteByte(' ')
-		a.WriteTo(w, s)
+// InnerXMLWS returns the serialization of the element's child tokens and
+// their descendants using the provided write settings. The element's own
+// start and end tags are not included.
+func (e *Element) InnerXMLWS(settings WriteSettings) string {
+	var buf bytes.Buffer
+	var w XMLWriter = &buf
+	if settings.MaxLineWidth > 0 {
+		w = trackColumns(w)
 	}
-	if len(e.Child) > 0 {
-		w.WriteByte('>')
-		for _, c := range e.Child {
-			c.WriteTo(w, s)
-		}
-		w.Write([]byte{'<', '/'})
-		w.WriteString(e.FullTag())
-		w.WriteByte('>')
-	} else {
-		if s.CanonicalEndTags {
-			w.Write([]byte{'>', '<', '/'})
-			w.WriteString(e.FullTag())
-			w.WriteByte('>')
-		} else {
-			w.Write([]byte{'/', '>'})
-		}
+	for _, c := range settings.filterChildren(e.Child) {
+		c.WriteTo(w, &settings)
+	}
+	return buf.String()
+}
+
+// GoString returns a compact description of the element's structure. It
+// implements the fmt.GoStringer interface used by the %#v formatting verb.
+func (e *Element) GoString() string {
+	if e == nil {
+		return "(*etree.Element)(nil)"
+	}
+	return fmt.Sprintf("&etree.Element{Space:%q, Tag:%q, Attr:%d, Child:%d}",
+		e.Space, e.Tag, len(e.Attr), len(e.Child))
+}
+
+// checkCycle panics with ErrCycle if the token 't' is the element e or one
+// of its ancestors, since making it a child of e would create a cycle.
+func (e *Element) checkCycle(t Token) {
+	if c, ok := t.(*Element); ok && c.Contains(e) {
+		panic(ErrCycle)
 	}
 }
 
 // addChild adds a child token to the element e.
 func (e *Element) addChild(t Token) {
+	if _, ok := t.(*Element); ok {
+		e.dropChildIndex()
+	}
 	t.setParent(e)
 	t.setIndex(len(e.Child))
 	e.Child = append(e.Child, t)
@@ -1112,12 +4435,51 @@ func (e *Element) addChild(t Token) {
 // CreateAttr creates an attribute with the specified 'key' and 'value' and
 // adds it to this element. If an attribute with same key already exists on
 // this element, then its value is replaced. The key may include a namespace
-// prefix followed by a colon.
+// prefix followed by a colon. The returned pointer remains valid only until
+// the element's attributes are next changed; see Attr.
 func (e *Element) CreateAttr(key, value string) *Attr {
 	space, skey := spaceDecompose(key)
 	return e.createAttr(space, skey, value, e)
 }
 
+// SetAttrs creates or updates an attribute of this element for each entry
+// in the 'attrs' map, as if CreateAttr were called with each key and value.
+// Because the iteration order of a map is unspecified, the order in which
+// new attributes are added to the element is nondeterministic; use
+// SetAttrsOrdered when the order of the attributes matters.
+func (e *Element) SetAttrs(attrs map[string]string) {
+	for k, v := range attrs {
+		e.CreateAttr(k, v)
+	}
+}
+
+// SetAttrsOrdered creates or updates an attribute of this element for each
+// key in 'keys', using the value at the same index in 'values', as if
+// CreateAttr were called for each pair in order. It panics if the two slices
+// have different lengths.
+func (e *Element) SetAttrsOrdered(keys []string, values []string) {
+	if len(keys) != len(values) {
+		panic("etree: SetAttrsOrdered called with mismatched keys and values")
+	}
+	for i, k := range keys {
+		e.CreateAttr(k, values[i])
+	}
+}
+
+// ReplaceAttrs replaces all of this element's attributes with copies of the
+// attributes in 'attrs', in the same order, and binds each copy to this
+// element so that Attr.Element and Attr.NamespaceURI work as expected.
+// Assigning to the Attr field directly leaves the attributes bound to
+// whichever element they were taken from. The 'attrs' slice is not retained,
+// and no check is made for duplicate keys.
+func (e *Element) ReplaceAttrs(attrs []Attr) {
+	e.Attr = make([]Attr, len(attrs))
+	for i, a := range attrs {
+		a.element = e
+		e.Attr[i] = a
+	}
+}
+
 // createAttr is a helper function that creates attributes.
 func (e *Element) createAttr(space, key, value string, parent *Element) *Attr {
 	for i, a := range e.Attr {
@@ -1156,6 +4518,78 @@ func (e *Element) RemoveAttr(key string) *Attr {
 	return nil
 }
 
+// RemoveAttrNS removes the first attribute of this element with the local
+// key 'key' in the namespace 'uri', as found by SelectAttrNS. It returns a
+// copy of the removed attribute if a match is found. If no match is found,
+// it returns nil.
+func (e *Element) RemoveAttrNS(uri, key string) *Attr {
+	for i := range e.Attr {
+		if a := e.Attr[i]; a.Key == key && a.inNamespace(uri) {
+			e.Attr = append(e.Attr[0:i], e.Attr[i+1:]...)
+			return &Attr{
+				Space:   a.Space,
+				Key:     a.Key,
+				Value:   a.Value,
+				element: nil,
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveAttrsNS removes every attribute of this element in the namespace
+// 'uri', matched as described for SelectAttrNS, and returns the number of
+// attributes removed. The declaration of the namespace itself is not
+// removed. An empty 'uri' removes all unprefixed attributes other than
+// namespace declarations.
+func (e *Element) RemoveAttrsNS(uri string) int {
+	return e.RemoveAttrsFunc(func(a Attr) bool {
+		return a.inNamespace(uri) && !a.IsNamespaceDecl()
+	})
+}
+
+// RemoveAttrsFunc removes every attribute of this element for which the
+// function 'pred' returns true, and returns the number of attributes
+// removed. The function is called with a copy of each attribute, bound to
+// this element, before any attribute is removed, so that the namespace URIs
+// of the attributes are resolved against the element's original namespace
+// declarations. The order of the remaining attributes is preserved.
+func (e *Element) RemoveAttrsFunc(pred func(a Attr) bool) int {
+	remove := make([]bool, len(e.Attr))
+	for i, a := range e.Attr {
+		remove[i] = pred(a)
+	}
+	j := 0
+	for i, a := range e.Attr {
+		if !remove[i] {
+			e.Attr[j] = a
+			j++
+		}
+	}
+	n := len(e.Attr) - j
+	e.Attr = e.Attr[:j]
+	return n
+}
+
+// SeparateNamespaceDecls reorders this element's attributes so that its
+// namespace declarations, as reported by Attr.IsNamespaceDecl, come before
+// all of its other attributes. The relative order of the declarations and
+// the relative order of the other attributes are preserved.
+func (e *Element) SeparateNamespaceDecls() {
+	attrs := make([]Attr, 0, len(e.Attr))
+	for _, a := range e.Attr {
+		if a.IsNamespaceDecl() {
+			attrs = append(attrs, a)
+		}
+	}
+	for _, a := range e.Attr {
+		if !a.IsNamespaceDecl() {
+			attrs = append(attrs, a)
+		}
+	}
+	copy(e.Attr, attrs)
+}
+
 // SortAttrs sorts this element's attributes lexicographically by key.
 func (e *Element) SortAttrs() {
 	sort.Sort(byAttr(e.Attr))
@@ -1179,6 +4613,184 @@ func (a byAttr) Less(i, j int) bool {
 	return sp < 0
 }
 
+// SortFlags modify the order in which SortChildrenByText and
+// SortChildrenByAttr sort child elements.
+type SortFlags int
+
+const (
+	// SortDescending sorts child elements in descending rather than
+	// ascending order.
+	SortDescending SortFlags = 1 << iota
+
+	// SortNumeric compares sequences of decimal digits within the sort keys
+	// by their numeric values, so that "item2" sorts before "item10".
+	SortNumeric
+)
+
+// SortChildElements sorts this element's child elements using the function
+// 'less', which reports whether element 'a' should be placed before element
+// 'b'. The sort is stable. Child tokens that are not elements, such as
+// character data and comments, keep their positions in the list of child
+// tokens, and the sorted elements fill the positions previously occupied by
+// elements.
+func (e *Element) SortChildElements(less func(a, b *Element) bool) {
+	var slots []int
+	var elements []*Element
+	for i, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			slots = append(slots, i)
+			elements = append(elements, c)
+		}
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		return less(elements[i], elements[j])
+	})
+	e.dropChildIndex()
+	for i, c := range elements {
+		e.Child[slots[i]] = c
+		c.setIndex(slots[i])
+	}
+}
+
+// SortChildrenByText sorts this element's child elements by their text, as
+// returned by Text. See SortChildElements.
+func (e *Element) SortChildrenByText(flags SortFlags) {
+	e.sortChildrenBy(func(c *Element) string { return c.Text() }, flags)
+}
+
+// SortChildrenByAttr sorts this element's child elements by the values of
+// their attributes matching 'attrKey'. Elements without a matching attribute
+// sort as if the value were empty. The key may include a namespace prefix
+// followed by a colon. See SortChildElements.
+func (e *Element) SortChildrenByAttr(attrKey string, flags SortFlags) {
+	e.sortChildrenBy(func(c *Element) string { return c.SelectAttrValue(attrKey, "") }, flags)
+}
+
+// ReorderChildren reorders this element's child elements so that their tags
+// follow the sequence given by 'order', as required by a schema that defines
+// the element's content as a sequence. Elements whose tags appear earlier in
+// the sequence are placed first, and elements with the same tag keep their
+// relative order. Elements whose tags don't appear in the sequence are placed
+// at the position of the entry "*" if the sequence contains one, or after all
+// other elements otherwise. Entries may include a namespace prefix followed
+// by a colon; an entry without a prefix matches a tag with any prefix unless
+// an entry for the prefixed tag also exists. Other child tokens keep their
+// positions, as they do with SortChildElements.
+func (e *Element) ReorderChildren(order []string) {
+	full := make(map[string]int, len(order))
+	local := make(map[string]int, len(order))
+	other := len(order)
+	for i := len(order) - 1; i >= 0; i-- {
+		space, tag := spaceDecompose(order[i])
+		switch {
+		case order[i] == "*":
+			other = i
+		case space == "":
+			local[tag] = i
+		default:
+			full[order[i]] = i
+		}
+	}
+
+	rank := make(map[*Element]int)
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			r, ok := full[c.FullTag()]
+			if !ok {
+				if r, ok = local[c.Tag]; !ok {
+					r = other
+				}
+			}
+			rank[c] = r
+		}
+	}
+	e.SortChildElements(func(a, b *Element) bool { return rank[a] < rank[b] })
+}
+
+// sortChildrenBy sorts this element's child elements by the string keys
+// returned by the function 'key'.
+func (e *Element) sortChildrenBy(key func(c *Element) string, flags SortFlags) {
+	less := func(a, b string) bool { return a < b }
+	if flags&SortNumeric != 0 {
+		less = numericLess
+	}
+	if flags&SortDescending != 0 {
+		e.SortChildElements(func(a, b *Element) bool { return less(key(b), key(a)) })
+	} else {
+		e.SortChildElements(func(a, b *Element) bool { return less(key(a), key(b)) })
+	}
+}
+
+// DedupeAttrs removes from this element every attribute whose namespace
+// prefix and key duplicate those of an earlier attribute. The first
+// occurrence of each attribute is kept, since it is the one found by
+// SelectAttr. The function returns copies of the removed attributes whose
+// values differed from the value of the kept attribute, which indicate
+// conflicts. It returns nil if there were no conflicts.
+func (e *Element) DedupeAttrs() []Attr {
+	var conflicts []Attr
+	j := 0
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		dup := false
+		for k := 0; k < j; k++ {
+			if e.Attr[k].Space == a.Space && e.Attr[k].Key == a.Key {
+				if e.Attr[k].Value != a.Value {
+					conflicts = append(conflicts, Attr{
+						Space:   a.Space,
+						Key:     a.Key,
+						Value:   a.Value,
+						element: nil,
+					})
+				}
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			e.Attr[j] = *a
+			j++
+		}
+	}
+	e.Attr = e.Attr[:j]
+	return conflicts
+}
+
+// AttrsByNamespace returns copies of this element's attributes grouped by
+// namespace prefix. Each key of the returned map is a prefix, with the empty
+// string for unprefixed attributes, and attributes are listed in the order
+// in which they appear on the element. Namespace declarations are grouped
+// like other attributes, under "xmlns" for prefixed declarations and the
+// empty string for default namespace declarations. The copies remain bound to
+// this element, so Attr.NamespaceURI works as expected. The function
+// returns nil if the element has no attributes.
+func (e *Element) AttrsByNamespace() map[string][]Attr {
+	if len(e.Attr) == 0 {
+		return nil
+	}
+	groups := make(map[string][]Attr)
+	for _, a := range e.Attr {
+		groups[a.Space] = append(groups[a.Space], a)
+	}
+	return groups
+}
+
+// Equal returns true if this attribute has the same namespace prefix, key
+// and value as the 'other' attribute.
+func (a *Attr) Equal(other Attr) bool {
+	return a.Space == other.Space && a.Key == other.Key && a.Value == other.Value
+}
+
+// writtenKey returns the attribute's complete key as it is written by its
+// element, replacing a namespace URI held in Space by a prefix as
+// Element.writtenTag does.
+func (a *Attr) writtenKey(pw *prefixWriter) string {
+	if a.element == nil {
+		return a.FullKey()
+	}
+	return a.element.writtenName(a.Space, a.Key, false, pw)
+}
+
 // FullKey returns this attribute's complete key, including namespace prefix
 // if present.
 func (a *Attr) FullKey() string {
@@ -1197,23 +4809,87 @@ func (a *Attr) Element() *Element {
 // The function returns the empty string if the attribute is unprefixed or
 // if the attribute is part of the XML default namespace.
 func (a *Attr) NamespaceURI() string {
-	if a.Space == "" {
+	switch {
+	case a.Space == "":
 		return ""
+	case !isNCName(a.Space):
+		return a.Space // expanded by ReadSettings.ExpandNamespaces
 	}
 	return a.element.findLocalNamespaceURI(a.Space)
 }
 
+// inNamespace reports whether the attribute is in the namespace 'uri', as
+// described by Element.SelectAttrNS.
+func (a *Attr) inNamespace(uri string) bool {
+	switch {
+	case uri == "" || a.Space == "":
+		return uri == a.Space
+	case a.Space == "xml":
+		return uri == xmlNamespaceURI
+	default:
+		return a.NamespaceURI() == uri
+	}
+}
+
+// clarkKey returns the attribute's key qualified by its namespace URI in
+// Clark notation, as described by Element.AttrFullKeys.
+func (a *Attr) clarkKey() string {
+	var uri string
+	switch {
+	case a.Space == "xmlns" || (a.Space == "" && a.Key == "xmlns"):
+		uri = xmlnsNamespaceURI
+	case a.Space == "xml":
+		uri = xmlNamespaceURI
+	case a.Space != "":
+		uri = a.NamespaceURI()
+	}
+	if uri == "" {
+		return a.FullKey()
+	}
+	return "{" + uri + "}" + a.Key
+}
+
+// QName returns the attribute's namespace-qualified name: the namespace URI
+// reported by NamespaceURI and the local name stored in Key.
+func (a *Attr) QName() (uri, local string) {
+	return a.NamespaceURI(), a.Key
+}
+
+// xmlName returns the attribute's name as an encoding/xml name, as described
+// by Element.EncodeToken.
+func (a *Attr) xmlName() xml.Name {
+	if a.Space == "xml" {
+		return xml.Name{Space: xmlNamespaceURI, Local: a.Key}
+	}
+	uri := a.NamespaceURI()
+	if a.Space != "" && uri == "" {
+		return xml.Name{Local: a.FullKey()}
+	}
+	return xml.Name{Space: uri, Local: a.Key}
+}
+
+// IsNamespaceDecl returns true if the attribute is a namespace declaration:
+// either an xmlns attribute declaring the default namespace or an attribute
+// with the xmlns prefix declaring a namespace prefix.
+func (a *Attr) IsNamespaceDecl() bool {
+	return a.Space == "xmlns" || (a.Space == "" && a.Key == "xmlns")
+}
+
 // WriteTo serializes the attribute to the writer.
 func (a *Attr) WriteTo(w XMLWriter, s *WriteSettings) {
-	w.WriteString(a.FullKey())
+	pw, _ := w.(*prefixWriter)
+	a.writeTo(w, s, a.writtenKey(pw))
+}
+
+// writeTo serializes the attribute to the writer with the key 'key'.
+func (a *Attr) writeTo(w XMLWriter, s *WriteSettings, key string) {
+	w.WriteString(key)
 	w.WriteString(`="`)
-	var m escapeMode
-	if s.CanonicalAttrVal {
-		m = escapeCanonicalAttr
+	if s.RawAttrValue != nil && s.RawAttrValue(a) {
+		w.WriteString(a.Value)
 	} else {
-		m = escapeNormal
+		s.escape(w, a.Value, true)
 	}
-	escapeString(w, a.Value, m)
 	w.WriteByte('"')
 }
 
@@ -1265,6 +4941,36 @@ func (e *Element) CreateCData(data string) *CharData {
 	return newCharData(data, cdataFlag, e)
 }
 
+// InsertTextAt creates a CharData token containing simple text data and
+// inserts it into this element's list of child tokens just before the
+// requested 'index', as InsertChildAt does. It returns the new token, which
+// is flagged as whitespace if the text contains only whitespace, as it would
+// be if it had been read from a document.
+func (e *Element) InsertTextAt(index int, text string) *CharData {
+	c := newCharData(text, whitespaceFlags(text), nil)
+	e.InsertChildAt(index, c)
+	return c
+}
+
+// InsertCDataAt creates a CharData token containing a CDATA section with
+// 'data' as its content and inserts it into this element's list of child
+// tokens just before the requested 'index', as InsertChildAt does. It
+// returns the new token.
+func (e *Element) InsertCDataAt(index int, data string) *CharData {
+	c := newCharData(data, cdataFlag|whitespaceFlags(data), nil)
+	e.InsertChildAt(index, c)
+	return c
+}
+
+// whitespaceFlags returns the whitespace flag if the string 's' contains
+// only whitespace, or no flags otherwise.
+func whitespaceFlags(s string) charDataFlags {
+	if isWhitespace(s) {
+		return whitespaceFlag
+	}
+	return 0
+}
+
 // CreateCharData creates a CharData token simple text data and adds it to the
 // end of this element's list of child tokens.
 //
@@ -1298,6 +5004,34 @@ func (c *CharData) IsWhitespace() bool {
 	return (c.flags & whitespaceFlag) != 0
 }
 
+// SetSignificant marks this CharData token as significant, or clears the
+// mark if 'significant' is false. Significant character data is preserved
+// even if it contains only whitespace: Indent, IndentTabs, StripWhitespace
+// and the other methods that remove or replace indentation leave it alone,
+// as do the EmptyWhitespace and ChildFilter write settings. Use it for
+// whitespace that matters, such as the content of an element with
+// xml:space="preserve". The mark is kept when the data is changed with
+// SetData.
+func (c *CharData) SetSignificant(significant bool) {
+	if significant {
+		c.flags |= significantFlag
+	} else {
+		c.flags &= ^significantFlag
+	}
+}
+
+// IsSignificant returns true if this CharData token has been marked
+// significant with SetSignificant.
+func (c *CharData) IsSignificant() bool {
+	return (c.flags & significantFlag) != 0
+}
+
+// isIndentation returns true if this CharData token contains only whitespace
+// that may be treated as indentation, because it is not marked significant.
+func (c *CharData) isIndentation() bool {
+	return c.flags&(whitespaceFlag|significantFlag) == whitespaceFlag
+}
+
 // Parent returns this CharData token's parent element, or nil if it has no
 // parent.
 func (c *CharData) Parent() *Element {
@@ -1314,10 +5048,11 @@ func (c *CharData) Index() int {
 // dup duplicates the character data.
 func (c *CharData) dup(parent *Element) Token {
 	return &CharData{
-		Data:   c.Data,
-		flags:  c.flags,
-		parent: parent,
-		index:  c.index,
+		Data:     c.Data,
+		flags:    c.flags,
+		parent:   parent,
+		index:    c.index,
+		verbatim: c.verbatim,
 	}
 }
 
@@ -1334,18 +5069,32 @@ func (c *CharData) setIndex(index int) {
 
 // WriteTo serializes character data to the writer.
 func (c *CharData) WriteTo(w XMLWriter, s *WriteSettings) {
+	c.writeTo(w, s)
+
+	// Record that indentation began the line, so that a start tag following
+	// it may be wrapped.
+	if cw, ok := columns(w); ok && cw.blank && c.isIndentation() && strings.IndexByte(c.Data, '\n') >= 0 {
+		cw.indented = true
+	}
+}
+
+// writeTo serializes character data to the writer.
+func (c *CharData) writeTo(w XMLWriter, s *WriteSettings) {
+	if v := c.verbatim; s.Verbatim && v != nil && v.data == c.Data && v.cdata == c.IsCData() {
+		w.WriteString(v.source)
+		return
+	}
+
 	if c.IsCData() {
 		w.WriteString(`<![CDATA[`)
-		w.WriteString(c.Data)
-		w.WriteString(`]]>`)
-	} else {
-		var m escapeMode
-		if s.CanonicalText {
-			m = escapeCanonicalText
+		if s.normalizeCRLF(c.Data) {
+			writeCRLF(w, c.Data)
 		} else {
-			m = escapeNormal
+			w.WriteString(c.Data)
 		}
-		escapeString(w, c.Data, m)
+		w.WriteString(`]]>`)
+	} else {
+		s.escape(w, c.Data, false)
 	}
 }
 
@@ -1373,6 +5122,13 @@ func (e *Element) CreateComment(comment string) *Comment {
 	return newComment(comment, e)
 }
 
+// CreateCommentf creates a comment token whose text is formatted according
+// to the 'format' specifier, in the manner of fmt.Sprintf, and adds it as
+// the last child token of this element.
+func (e *Element) CreateCommentf(format string, args ...interface{}) *Comment {
+	return newComment(fmt.Sprintf(format, args...), e)
+}
+
 // dup duplicates the comment.
 func (c *Comment) dup(parent *Element) Token {
 	return &Comment{
@@ -1437,6 +5193,13 @@ func (e *Element) CreateDirective(data string) *Directive {
 	return newDirective(data, e)
 }
 
+// CreateDirectivef creates an XML directive token whose data is formatted
+// according to the 'format' specifier, in the manner of fmt.Sprintf, and adds
+// it as the last child token of this element.
+func (e *Element) CreateDirectivef(format string, args ...interface{}) *Directive {
+	return newDirective(fmt.Sprintf(format, args...), e)
+}
+
 // dup duplicates the directive.
 func (d *Directive) dup(parent *Element) Token {
 	return &Directive{
@@ -1507,10 +5270,11 @@ func (e *Element) CreateProcInst(target, inst string) *ProcInst {
 // dup duplicates the procinst.
 func (p *ProcInst) dup(parent *Element) Token {
 	return &ProcInst{
-		Target: p.Target,
-		Inst:   p.Inst,
-		parent: parent,
-		index:  p.index,
+		Target:   p.Target,
+		Inst:     p.Inst,
+		parent:   parent,
+		index:    p.index,
+		verbatim: p.verbatim,
 	}
 }
 
@@ -1538,13 +5302,73 @@ func (p *ProcInst) setIndex(index int) {
 	p.index = index
 }
 
+// Attr parses the processing instruction's Inst string as a sequence of
+// pseudo-attributes of the form key="value" or key='value', as used by
+// instructions such as <?xml-stylesheet type="text/xsl" href="a.xsl"?>, and
+// returns the value of the first one named 'key'. Character and predefined
+// entity references in the value are replaced by the characters they
+// represent. If the instruction has no such pseudo-attribute, 'ok' is false.
+// Parsing stops at the first text that is not a well-formed pseudo-attribute.
+func (p *ProcInst) Attr(key string) (value string, ok bool) {
+	for _, a := range parsePseudoAttrs(p.Inst) {
+		if a.key == key {
+			return a.value, true
+		}
+	}
+	return "", false
+}
+
+// Attrs returns a map of the pseudo-attributes found in the processing
+// instruction's Inst string, keyed by name. If a name appears more than
+// once, the first value is used. See Attr.
+func (p *ProcInst) Attrs() map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range parsePseudoAttrs(p.Inst) {
+		if _, ok := attrs[a.key]; !ok {
+			attrs[a.key] = a.value
+		}
+	}
+	return attrs
+}
+
+// SetAttr sets the value of the processing instruction's pseudo-attribute
+// named 'key', rewriting the Inst string. If the pseudo-attribute exists,
+// only its value is replaced and the rest of the Inst string is preserved.
+// Otherwise, the pseudo-attribute is appended. The value is written within
+// double quotes and escaped like an element attribute value.
+func (p *ProcInst) SetAttr(key, value string) {
+	quoted := `"` + EscapeText(value, true, nil) + `"`
+	for _, a := range parsePseudoAttrs(p.Inst) {
+		if a.key == key {
+			p.Inst = p.Inst[:a.start] + quoted + p.Inst[a.end:]
+			return
+		}
+	}
+	if p.Inst != "" && !isWhitespace(p.Inst[len(p.Inst)-1:]) {
+		p.Inst += " "
+	}
+	p.Inst += key + "=" + quoted
+}
+
 // WriteTo serializes the processing instruction to the writer.
 func (p *ProcInst) WriteTo(w XMLWriter, s *WriteSettings) {
+	if v := p.verbatim; s.Verbatim && v != nil && v.target == p.Target && v.inst == p.Inst {
+		w.WriteString(v.source)
+		return
+	}
+
+	inst := p.Inst
+	if s.CanonicalXMLDecl && p.Target == "xml" {
+		if decl, ok := canonicalXMLDecl(inst); ok {
+			inst = decl
+		}
+	}
+
 	w.WriteString("<?")
 	w.WriteString(p.Target)
-	if p.Inst != "" {
+	if inst != "" {
 		w.WriteByte(' ')
-		w.WriteString(p.Inst)
+		w.WriteString(inst)
 	}
 	w.WriteString("?>")
 }
@@ -5,10 +5,21 @@
 package etree
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf16"
 )
 
 func newDocumentFromString(t *testing.T, s string) *Document {
@@ -275,6 +286,86 @@ func TestPreserveCDATA(t *testing.T) {
 	}
 }
 
+func TestCharsetReader(t *testing.T) {
+	cases := []struct {
+		charset, input, text string
+	}{
+		{"ISO-8859-1", "caf\xe9 \x93", "caf\u00e9 \u0093"},
+		{"latin1", "\xa9\xff", "\u00a9\u00ff"},
+		{"Windows-1252", "\x93hi\x94 \x80\x81", "\u201chi\u201d \u20ac\u0081"},
+		{"US-ASCII", "ab\xe9", "ab\ufffd"},
+		{"UTF-8", "caf\u00e9", "caf\u00e9"},
+	}
+	for _, c := range cases {
+		s := `<?xml version="1.0" encoding="` + c.charset + `"?><a>` + c.input + `</a>`
+		doc := NewDocument()
+		doc.ReadSettings.CharsetReader = CharsetReader
+		_, err := doc.ReadFrom(iotest.OneByteReader(strings.NewReader(s)))
+		if err != nil {
+			t.Errorf("etree: failed to read %s document: %v", c.charset, err)
+			continue
+		}
+		checkStrEq(t, doc.Root().Text(), c.text)
+	}
+
+	_, err := CharsetReader("ebcdic", strings.NewReader(""))
+	if err == nil {
+		t.Error("etree: CharsetReader accepted an unsupported charset")
+	}
+}
+
+func TestDocumentReadEncoding(t *testing.T) {
+	text := "caf\u00e9 \U0001F600"
+	s := `<?xml version="1.0" encoding="UTF-16"?><a b="` + text + `">` + text + `</a>`
+	units := utf16.Encode([]rune(s))
+
+	encode := func(bigEndian, bom bool) []byte {
+		var b []byte
+		seq := units
+		if bom {
+			seq = append([]uint16{0xFEFF}, seq...)
+		}
+		for _, u := range seq {
+			if bigEndian {
+				b = append(b, byte(u>>8), byte(u))
+			} else {
+				b = append(b, byte(u), byte(u>>8))
+			}
+		}
+		return b
+	}
+
+	cases := []struct {
+		encoding  string
+		bigEndian bool
+		bom       bool
+	}{
+		{"UTF-16", false, true},
+		{"UTF-16", true, true},
+		{"UTF-16", true, false},
+		{"UTF-16LE", false, false},
+		{"UTF-16LE", false, true},
+		{"UTF-16BE", true, true},
+	}
+	for _, c := range cases {
+		doc := NewDocument()
+		doc.ReadSettings.Encoding = c.encoding
+		_, err := doc.ReadFrom(iotest.OneByteReader(bytes.NewReader(encode(c.bigEndian, c.bom))))
+		if err != nil {
+			t.Errorf("etree: failed to read %s document: %v", c.encoding, err)
+			continue
+		}
+		checkStrEq(t, doc.Root().Text(), text)
+		checkStrEq(t, doc.Root().SelectAttrValue("b", ""), text)
+	}
+
+	doc := NewDocument()
+	doc.ReadSettings.Encoding = "ebcdic"
+	if doc.ReadFromString(s) == nil {
+		t.Error("etree: ReadFrom accepted an unsupported encoding")
+	}
+}
+
 func TestDocumentReadPermissive(t *testing.T) {
 	s := "<select disabled></select>"
 
@@ -291,6 +382,135 @@ func TestDocumentReadPermissive(t *testing.T) {
 	}
 }
 
+func TestDocumentSettingChaining(t *testing.T) {
+	doc := NewDocument().WithPermissive(true).WithCRLF(true).WithCanonicalEndTags(true)
+	checkBoolEq(t, doc.ReadSettings.Permissive, true)
+	checkBoolEq(t, doc.WriteSettings.UseCRLF, true)
+	checkBoolEq(t, doc.WriteSettings.CanonicalEndTags, true)
+
+	if err := doc.ReadFromString(`<select disabled><option/></select>`); err != nil {
+		t.Fatal(err)
+	}
+	s, err := doc.WithIndent(2).WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, "<select disabled=\"disabled\">\r\n  <option></option>\r\n</select>\r\n")
+
+	doc.WithPermissive(false).WithCRLF(false).WithCanonicalEndTags(false)
+	checkBoolEq(t, doc.ReadSettings.Permissive, false)
+	checkBoolEq(t, doc.WriteSettings.UseCRLF, false)
+	checkBoolEq(t, doc.WriteSettings.CanonicalEndTags, false)
+}
+
+// chunkReader returns its data a few bytes at a time, calling 'onRead'
+// after each read.
+type chunkReader struct {
+	data   string
+	onRead func()
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	if len(p) > 4 {
+		p = p[:4]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	r.onRead()
+	return n, nil
+}
+
+func TestDocumentReadFromContext(t *testing.T) {
+	s := `<a><b>text</b><c/></a>`
+
+	doc := NewDocument()
+	n, err := doc.ReadFromContext(context.Background(), strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, int(n), len(s))
+	checkStrEq(t, doc.Root().FindElement("b").Text(), "text")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reads := 0
+	r := &chunkReader{data: s, onRead: func() {
+		if reads++; reads == 2 {
+			cancel()
+		}
+	}}
+	_, err = NewDocument().ReadFromContext(ctx, r)
+	if err != context.Canceled {
+		t.Errorf("etree: ReadFromContext returned %v, wanted %v", err, context.Canceled)
+	}
+	checkIntEq(t, reads, 2)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	_, err = NewDocument().ReadFromContext(ctx, strings.NewReader(s))
+	if err != context.DeadlineExceeded {
+		t.Errorf("etree: ReadFromContext returned %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDocumentReadDiag(t *testing.T) {
+	s := `<a x="1" x="2"><b><c></b></d><e>`
+
+	doc := NewDocument()
+	_, _, err := doc.ReadFromDiag(strings.NewReader(s))
+	if err != ErrXML {
+		t.Fatalf("etree: expected ErrXML, got %v", err)
+	}
+
+	// Permissive alone doesn't repair mismatched or missing end tags.
+	for _, input := range []string{`<a><b></a>`, `<a><b>`, `<a></b></a>`, s} {
+		doc = NewDocument()
+		doc.ReadSettings.Permissive = true
+		if err := doc.ReadFromString(input); err != ErrXML {
+			t.Errorf("etree: reading %s returned %v, expected ErrXML", input, err)
+		}
+		if _, _, err := doc.ReadFromDiag(strings.NewReader(input)); err != ErrXML {
+			t.Errorf("etree: ReadFromDiag of %s returned %v, expected ErrXML", input, err)
+		}
+	}
+
+	doc = NewDocument()
+	doc.ReadSettings.Permissive = true
+	doc.ReadSettings.RepairTags = true
+	doc.ReadSettings.TrackOffsets = true
+	n, diags, err := doc.ReadFromDiag(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, int(n), len(s))
+
+	expected := []string{
+		`offset 0: duplicate attribute x on element <a>; earlier value dropped`,
+		`offset 21: element <c> not closed; closed at </b>`,
+		`offset 25: unexpected end tag </d> dropped`,
+		`offset 32: element <e> not closed; closed at end of input`,
+		`offset 32: element <a> not closed; closed at end of input`,
+	}
+	checkIntEq(t, len(diags), len(expected))
+	for i := 0; i < len(diags) && i < len(expected); i++ {
+		checkStrEq(t, diags[i].String(), expected[i])
+	}
+
+	str, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, str, `<a x="2"><b><c/></b><e/></a>`)
+
+	c := doc.FindElement("//c")
+	start, end, ok := c.SourceRange()
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, s[start:end], "<c>")
+}
+
 func TestDocumentReadHTMLEntities(t *testing.T) {
 	s := `<store>
 	<book lang="en">
@@ -312,6 +532,116 @@ func TestDocumentReadHTMLEntities(t *testing.T) {
 	}
 }
 
+func TestDocumentReadDecompress(t *testing.T) {
+	s := `<store><book lang="en"><title>Great Expectations</title></book></store>`
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	compressed := buf.Bytes()
+
+	doc := NewDocument()
+	err := doc.ReadFromBytes(compressed)
+	if err == nil {
+		t.Fatal("etree: incorrect ReadFromBytes result")
+	}
+
+	doc = NewDocument()
+	doc.ReadSettings.Decompress = true
+	n, err := doc.ReadFrom(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal("etree: incorrect ReadFrom result")
+	}
+	checkIntEq(t, int(n), len(s))
+	checkDocEq(t, doc, s)
+
+	// Uncompressed input is read unchanged.
+	doc = NewDocument()
+	doc.ReadSettings.Decompress = true
+	err = doc.ReadFromString(s)
+	if err != nil {
+		t.Fatal("etree: incorrect ReadFromString result")
+	}
+	checkDocEq(t, doc, s)
+
+	// A truncated gzip stream is reported as an error.
+	doc = NewDocument()
+	doc.ReadSettings.Decompress = true
+	err = doc.ReadFromBytes(compressed[:5])
+	if err == nil {
+		t.Fatal("etree: incorrect ReadFromBytes result")
+	}
+}
+
+func TestDocumentReadTrackOffsets(t *testing.T) {
+	s := `<?xml version="1.0"?>
+<root a="1">
+  <child>text</child>
+  <empty/>
+  <!-- comment -->
+</root>`
+
+	doc := NewDocument()
+	doc.ReadSettings.TrackOffsets = true
+	err := doc.ReadFromString(s)
+	if err != nil {
+		t.Fatal("etree: incorrect ReadFromString result")
+	}
+
+	for _, tag := range []string{"root", "child", "empty"} {
+		e := doc.FindElement("//" + tag)
+		start, end, ok := e.SourceRange()
+		if !ok {
+			t.Fatalf("etree: no source range for element %s", tag)
+		}
+		checkStrEq(t, s[start:end], e.String())
+	}
+
+	_, _, ok := doc.SourceRange()
+	checkBoolEq(t, ok, false)
+	_, _, ok = NewElement("new").SourceRange()
+	checkBoolEq(t, ok, false)
+
+	doc = newDocumentFromString(t, s)
+	_, _, ok = doc.Root().SourceRange()
+	checkBoolEq(t, ok, false)
+}
+
+func TestDocumentReadTrackPositions(t *testing.T) {
+	s := "<?xml version=\"1.0\"?>\n<root>\n  <a x=\"é\"><b/></a>\r\n\t<!-- c --><c>\ntext</c><d/>\n</root>"
+
+	doc := NewDocument()
+	doc.ReadSettings.TrackPositions = true
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path      string
+		line, col int
+	}{
+		{"/root", 2, 1},
+		{"//a", 3, 3},
+		{"//b", 3, 12},
+		{"//c", 4, 12},
+		{"//d", 5, 9},
+	}
+	for _, c := range cases {
+		line, col, ok := doc.FindElement(c.path).SourcePos()
+		checkBoolEq(t, ok, true)
+		if line != c.line || col != c.col {
+			t.Errorf("etree: SourcePos(%s) = %d:%d, wanted %d:%d", c.path, line, col, c.line, c.col)
+		}
+	}
+	if _, _, ok := doc.Root().SourceRange(); ok {
+		t.Error("etree: SourceRange available without TrackOffsets")
+	}
+	if _, _, ok := NewElement("x").SourcePos(); ok {
+		t.Error("etree: SourcePos available for a new element")
+	}
+}
+
 func TestEscapeCodes(t *testing.T) {
 	cases := []struct {
 		input         string
@@ -365,6 +695,275 @@ func TestEscapeCodes(t *testing.T) {
 	}
 }
 
+func TestEscapeText(t *testing.T) {
+	input := "&<>'\"\t\n\r"
+	checkStrEq(t, EscapeText(input, false, nil), "&amp;&lt;&gt;&apos;&quot;\t\n\r")
+	checkStrEq(t, EscapeText(input, true, nil), "&amp;&lt;&gt;&apos;&quot;\t\n\r")
+
+	settings := newWriteSettings()
+	settings.CanonicalText = true
+	settings.CanonicalAttrVal = true
+	checkStrEq(t, EscapeText(input, false, &settings), "&amp;&lt;&gt;'\"\t\n&#xD;")
+	checkStrEq(t, EscapeText(input, true, &settings), "&amp;&lt;>'&quot;&#x9;&#xA;&#xD;")
+
+	settings.Escaper = func(w XMLWriter, s string, inAttr bool) {
+		w.WriteString(strings.ToUpper(s))
+	}
+	checkStrEq(t, EscapeText("abc", false, &settings), "ABC")
+
+	cases := []struct {
+		input, output string
+	}{
+		{"plain", "plain"},
+		{"&amp;&lt;&gt;&apos;&quot;", "&<>'\""},
+		{"&#65;&#x42;&#x1F600;", "AB\U0001F600"},
+		{"a &amp b; &unknown; &#xZZ; &#0; &", "a &amp b; &unknown; &#xZZ; &#0; &"},
+		{"&amp;amp;", "&amp;"},
+	}
+	for _, c := range cases {
+		checkStrEq(t, UnescapeText(c.input), c.output)
+	}
+
+	for _, s := range []string{input, "a&b<c>d\"e'f", "caf\u00e9 &#x;"} {
+		checkStrEq(t, UnescapeText(EscapeText(s, true, nil)), s)
+	}
+}
+
+func TestProcInstAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml-stylesheet type="text/xsl"  href = 'a.xsl?x=1&amp;y=2' ?><root/>`)
+	p := doc.Child[0].(*ProcInst)
+
+	v, ok := p.Attr("type")
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, v, "text/xsl")
+	v, ok = p.Attr("href")
+	checkBoolEq(t, ok, true)
+	checkStrEq(t, v, "a.xsl?x=1&y=2")
+	_, ok = p.Attr("media")
+	checkBoolEq(t, ok, false)
+
+	attrs := p.Attrs()
+	checkIntEq(t, len(attrs), 2)
+	checkStrEq(t, attrs["type"], "text/xsl")
+
+	p.SetAttr("type", `a"b`)
+	p.SetAttr("media", "screen")
+	checkStrEq(t, p.Inst, `type="a&quot;b"  href = 'a.xsl?x=1&amp;y=2' media="screen"`)
+	v, _ = p.Attr("type")
+	checkStrEq(t, v, `a"b`)
+
+	p = NewProcInst("target", "")
+	p.SetAttr("a", "1")
+	checkStrEq(t, p.Inst, `a="1"`)
+
+	p = NewProcInst("target", `a="1" b c="3"`)
+	checkIntEq(t, len(p.Attrs()), 1)
+	_, ok = p.Attr("c")
+	checkBoolEq(t, ok, false)
+}
+
+func TestCreateFormatted(t *testing.T) {
+	doc := NewDocument()
+	c := doc.CreateCommentf(" generated by %s v%d ", "tool", 2)
+	d := doc.CreateDirectivef("DOCTYPE %s", "html")
+	doc.CreateElement("html")
+
+	checkStrEq(t, c.Data, " generated by tool v2 ")
+	checkStrEq(t, d.Data, "DOCTYPE html")
+	checkIntEq(t, d.Index(), 1)
+
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, `<!-- generated by tool v2 --><!DOCTYPE html><html/>`)
+}
+
+func TestTrimText(t *testing.T) {
+	s := "<a>\n  two \t words\n  <b>  <![CDATA[ x  y ]]> </b> tail <c>\n</c><d>same</d></a>"
+
+	doc := newDocumentFromString(t, s)
+	doc.Root().TrimText(false)
+	checkStrEq(t, doc.Root().String(), "<a>two \t words<b>  <![CDATA[ x  y ]]> </b> tail <c>\n</c><d>same</d></a>")
+
+	doc = newDocumentFromString(t, s)
+	doc.Root().TrimTextRecursive(true)
+	checkStrEq(t, doc.Root().String(), "<a>two words<b>x y</b> tail <c/><d>same</d></a>")
+
+	doc = newDocumentFromString(t, "<a><![CDATA[ x ]]></a>")
+	doc.Root().TrimText(false)
+	checkStrEq(t, doc.Root().String(), "<a><![CDATA[x]]></a>")
+}
+
+func TestSetTextfTailf(t *testing.T) {
+	doc := newDocumentFromString(t, `<p>old<b>bold</b>old tail</p>`)
+	p := doc.Root()
+	b := p.SelectElement("b")
+	p.SetTextf("%d items, ", 3)
+	b.SetTextf("%.1f%%", 99.5)
+	b.SetTailf(" of %s.", "them")
+	checkStrEq(t, p.String(), `<p>3 items, <b>99.5%</b> of them.</p>`)
+
+	e := NewElement("orphan")
+	e.SetTailf("%d", 1)
+	checkIntEq(t, len(e.Child), 0)
+}
+
+func TestStats(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?><!DOCTYPE a><a x="1" y="2"><!--c--><b z="3">text<c><![CDATA[da]]></c></b><?pi?>tail</a>`)
+
+	st := doc.Stats()
+	expected := Stats{Elements: 3, Attrs: 3, Text: 3, Comments: 1, ProcInsts: 2, Directives: 1, MaxDepth: 3, TextBytes: 10}
+	if st != expected {
+		t.Errorf("etree: Document.Stats() = %+v, wanted %+v", st, expected)
+	}
+
+	st = doc.FindElement("//b").Stats()
+	expected = Stats{Elements: 2, Attrs: 1, Text: 2, MaxDepth: 2, TextBytes: 6}
+	if st != expected {
+		t.Errorf("etree: Element.Stats() = %+v, wanted %+v", st, expected)
+	}
+}
+
+func TestIsMixedContent(t *testing.T) {
+	s := `<root>
+	<a>text <b/> more</a>
+	<c>
+		<d/>
+	</c>
+	<e>only text</e>
+	<f><![CDATA[x]]><g/></f>
+	<h><!-- comment --><i/></h>
+</root>`
+	doc := newDocumentFromString(t, s)
+	cases := []struct {
+		path          string
+		mixed, hasTxt bool
+	}{
+		{"a", true, true},
+		{"c", false, false},
+		{"e", false, true},
+		{"f", true, true},
+		{"h", false, false},
+		{"a/b", false, false},
+	}
+	for _, c := range cases {
+		e := doc.Root().FindElement(c.path)
+		if e.IsMixedContent() != c.mixed {
+			t.Errorf("etree: IsMixedContent(%s) = %v, wanted %v", c.path, !c.mixed, c.mixed)
+		}
+		if e.HasSignificantText() != c.hasTxt {
+			t.Errorf("etree: HasSignificantText(%s) = %v, wanted %v", c.path, !c.hasTxt, c.hasTxt)
+		}
+	}
+
+	c := doc.Root().FindElement("c")
+	c.Child[0].(*CharData).SetSignificant(true)
+	checkBoolEq(t, c.HasSignificantText(), true)
+	checkBoolEq(t, c.IsMixedContent(), true)
+}
+
+func TestCustomEscaper(t *testing.T) {
+	doc := NewDocument()
+	e := doc.CreateElement("e")
+	e.CreateAttr("a", "x`\v<")
+	e.CreateText("y`\v<")
+	e.CreateCData("`")
+
+	doc.WriteSettings.Escaper = func(w XMLWriter, s string, inAttr bool) {
+		if inAttr {
+			w.WriteString("attr:")
+		}
+		r := strings.NewReplacer("`", "&#x60;", "\v", "&#xB;", "<", "&lt;")
+		r.WriteString(w, s)
+	}
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+	checkStrEq(t, s, "<e a=\"attr:x&#x60;&#xB;&lt;\">y&#x60;&#xB;&lt;<![CDATA[`]]></e>")
+}
+
+func TestRawAttrValue(t *testing.T) {
+	doc := NewDocument()
+	a := doc.CreateElement("a")
+	a.CreateAttr("raw", "x &amp; y &#x3C;")
+	a.CreateAttr("text", "x &amp; y")
+	a.CreateAttr("lines", "1\n2")
+	doc.WriteSettings.UseCRLF = true
+
+	doc.WriteSettings.RawAttrValue = func(attr *Attr) bool {
+		return attr.Key == "raw" || attr.Key == "lines"
+	}
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, "<a raw=\"x &amp; y &#x3C;\" text=\"x &amp;amp; y\" lines=\"1\n2\"/>")
+
+	doc = newDocumentFromString(t, s)
+	checkStrEq(t, doc.Root().SelectAttrValue("raw", ""), "x & y <")
+	checkStrEq(t, doc.Root().SelectAttrValue("text", ""), "x &amp; y")
+}
+
+func TestChildFilter(t *testing.T) {
+	s := `<?xml version="1.0"?>
+<!--header-->
+<root>
+  <user>
+    <name>Alice</name>
+    <password>secret</password>
+  </user>
+  <password>other</password>
+  <box>
+    <password/>
+  </box>
+  <text>a<password/>b</text>
+</root>
+`
+	doc := newDocumentFromString(t, s)
+	doc.WriteSettings.ChildFilter = func(t Token) bool {
+		switch t := t.(type) {
+		case *Element:
+			return t.Tag != "password"
+		case *Comment:
+			return false
+		}
+		return true
+	}
+
+	expected := `<?xml version="1.0"?>
+<root>
+  <user>
+    <name>Alice</name>
+  </user>
+  <box/>
+  <text>ab</text>
+</root>
+`
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+	checkStrEq(t, out, expected)
+
+	// The tree itself is left unmodified.
+	checkIntEq(t, len(doc.FindElements("//password")), 4)
+	doc.WriteSettings.ChildFilter = nil
+	out, _ = doc.WriteToString()
+	checkStrEq(t, out, s)
+
+	// The filter is also applied when writing indented output.
+	var buf strings.Builder
+	settings := newWriteSettings()
+	settings.ChildFilter = func(t Token) bool {
+		e, ok := t.(*Element)
+		return !ok || e.Tag != "password"
+	}
+	doc.Root().SelectElement("user").WriteIndentedTo(&buf, settings, 1)
+	checkStrEq(t, buf.String(), "<user>\n <name>Alice</name>\n</user>\n")
+}
+
 func TestCanonical(t *testing.T) {
 	BOM := "\xef\xbb\xbf"
 
@@ -402,54 +1001,321 @@ func TestCanonical(t *testing.T) {
 	checkStrEq(t, s, expected)
 }
 
-func TestCopy(t *testing.T) {
-	s := `<store>
-	<book lang="en">
-		<title>Great Expectations</title>
-		<author>Charles Dickens</author>
-	</book>
-</store>`
+func TestCRLFValues(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateAttr("a", "x\ny")
+	root.CreateText("line1\nline2\r\nline3\n")
+	root.CreateCData("c1\nc2")
+	doc.WriteSettings.UseCRLF = true
 
-	doc := newDocumentFromString(t, s)
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, "<root a=\"x\r\ny\">line1\r\nline2\r\nline3\r\n<![CDATA[c1\r\nc2]]></root>")
 
-	s1, err := doc.WriteToString()
-	if err != nil {
-		t.Error("etree: incorrect WriteToString result")
-	}
+	doc.WriteSettings.CanonicalAttrVal = true
+	doc.WriteSettings.CanonicalText = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<root a=\"x&#xA;y\">line1\r\nline2&#xD;\r\nline3\r\n<![CDATA[c1\r\nc2]]></root>")
+
+	doc.WriteSettings.PreserveLineEndings = true
+	doc.WriteSettings.CanonicalAttrVal = false
+	doc.WriteSettings.CanonicalText = false
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<root a=\"x\ny\">line1\nline2\r\nline3\n<![CDATA[c1\nc2]]></root>")
+}
 
-	doc2 := doc.Copy()
-	checkIndexes(t, &doc2.Element)
-	s2, err := doc2.WriteToString()
-	if err != nil {
-		t.Error("etree: incorrect Copy result")
+func TestCanonicalXMLDecl(t *testing.T) {
+	cases := []struct {
+		input, want string
+	}{
+		{`<?xml version="1.0"?>`, `<?xml version="1.0"?>`},
+		{`<?xml  version = '1.0'   encoding='UTF-8'  ?>`, `<?xml version="1.0" encoding="UTF-8"?>`},
+		{"<?xml version='1.0'\n\tstandalone='yes' encoding=\"utf-8\"?>", `<?xml version="1.0" encoding="utf-8" standalone="yes"?>`},
+		{`<?xml version="1.0" bogus="x"?>`, `<?xml version="1.0" bogus="x"?>`},
+		{`<?xml version="1.0" version="1.1"?>`, `<?xml version="1.0" version="1.1"?>`},
+		{`<?xml version="1.0" junk?>`, `<?xml version="1.0" junk?>`},
 	}
-
-	if s1 != s2 {
-		t.Error("etree: mismatched Copy result")
-		t.Error("wanted:\n" + s1)
-		t.Error("got:\n" + s2)
+	for _, c := range cases {
+		doc := newDocumentFromString(t, c.input+`<a/>`)
+		doc.WriteSettings.CanonicalXMLDecl = true
+		s, err := doc.WriteToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStrEq(t, s, c.want+`<a/>`)
 	}
 
-	e1 := doc.FindElement("./store/book/title")
-	e2 := doc2.FindElement("./store/book/title")
-	if e1 == nil || e2 == nil {
-		t.Error("etree: incorrect FindElement result")
-	}
-	if e1 == e2 {
-		t.Error("etree: incorrect FindElement result")
+	doc := newDocumentFromString(t, `<?xml  version='1.0' ?><?pi  a='1' ?><a/>`)
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
 	}
+	checkStrEq(t, s, `<?xml version='1.0' ?><?pi a='1' ?><a/>`)
 
-	e1.parent.RemoveChildAt(e1.Index())
-	s1, _ = doc.WriteToString()
-	s2, _ = doc2.WriteToString()
-	if s1 == s2 {
-		t.Error("etree: incorrect result after RemoveElement")
+	doc.WriteSettings.CanonicalXMLDecl = true
+	s, err = doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
 	}
+	checkStrEq(t, s, `<?xml version="1.0"?><?pi a='1' ?><a/>`)
 }
 
-func TestGetPath(t *testing.T) {
-	s := `<a>
- <b1>
+func TestTrailingNewline(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?><root><a/></root>`)
+	doc.WriteSettings.TrailingNewline = true
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, "<?xml version=\"1.0\"?><root><a/></root>\n")
+
+	doc.WriteSettings.UseCRLF = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<?xml version=\"1.0\"?><root><a/></root>\r\n")
+
+	doc.Indent(2)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "<?xml version=\"1.0\"?>\r\n<root>\r\n  <a/>\r\n</root>\r\n")
+
+	doc = NewDocument()
+	doc.WriteSettings.TrailingNewline = true
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, "")
+}
+
+func TestMaxLineWidth(t *testing.T) {
+	write := func(doc *Document) string {
+		s, err := doc.WriteToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	doc := newDocumentFromString(t, `<root><item id="1" name="first" description="a long description"/><short a="1" b="2"/><single description="a single attribute that is much too long"><child x="é" y="2" z="3">text</child></single></root>`)
+	doc.WriteSettings.MaxLineWidth = 40
+	doc.Indent(2)
+
+	expected := `<root>
+  <item id="1"
+        name="first"
+        description="a long description"/>
+  <short a="1" b="2"/>
+  <single description="a single attribute that is much too long">
+    <child x="é" y="2" z="3">text</child>
+  </single>
+</root>
+`
+	checkStrEq(t, write(doc), expected)
+
+	doc.WriteSettings.MaxLineWidth = 25
+	doc.WriteSettings.UseCRLF = true
+	doc.IndentTabs()
+	expected = "<root>\r\n" +
+		"\t<item id=\"1\"\r\n" +
+		"\t      name=\"first\"\r\n" +
+		"\t      description=\"a long description\"/>\r\n" +
+		"\t<short a=\"1\" b=\"2\"/>\r\n" +
+		"\t<single description=\"a single attribute that is much too long\">\r\n" +
+		"\t\t<child x=\"é\"\r\n" +
+		"\t\t       y=\"2\"\r\n" +
+		"\t\t       z=\"3\">text</child>\r\n" +
+		"\t</single>\r\n" +
+		"</root>\r\n"
+	checkStrEq(t, write(doc), expected)
+
+	// Start tags that don't begin a line are never wrapped.
+	doc = newDocumentFromString(t, `<root><item id="1" name="first" description="a long description"/></root>`)
+	doc.WriteSettings.MaxLineWidth = 20
+	checkStrEq(t, doc.Root().SelectElement("item").String(), `<item id="1" name="first" description="a long description"/>`)
+	checkStrEq(t, write(doc), `<root><item id="1" name="first" description="a long description"/></root>`)
+
+	// Without indentation, start tags are never wrapped, even when they
+	// begin a line.
+	unindented := "<root aaaa=\"1111111\" bbbb=\"2222222\">text\n<b cccc=\"3333333\" dddd=\"4444444\"/>\n</root>"
+	doc = newDocumentFromString(t, unindented)
+	doc.WriteSettings.MaxLineWidth = 20
+	checkStrEq(t, write(doc), unindented)
+	doc.Root().RemoveChildAt(0)
+	doc.Root().InsertChildAt(0, NewText("\n"))
+	doc.Root().Child[0].(*CharData).SetSignificant(true)
+	checkStrEq(t, write(doc), "<root aaaa=\"1111111\" bbbb=\"2222222\">\n<b cccc=\"3333333\" dddd=\"4444444\"/>\n</root>")
+
+	// A root element placed on a new line by indentation is wrapped.
+	doc = newDocumentFromString(t, `<?xml version="1.0"?><root aaaa="1111111" bbbb="2222222"/>`)
+	doc.WriteSettings.MaxLineWidth = 20
+	doc.Indent(2)
+	checkStrEq(t, write(doc), "<?xml version=\"1.0\"?>\n<root aaaa=\"1111111\"\n      bbbb=\"2222222\"/>\n")
+}
+
+func TestEmptyWhitespace(t *testing.T) {
+	s := "<root>\n  <a>\n  </a>\n  <b> </b>\n  <c><![CDATA[ ]]></c>\n  <d> x </d>\n  <e/>\n</root>"
+	doc := newDocumentFromString(t, s)
+
+	doc.WriteSettings.EmptyWhitespace = true
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, "<root>\n  <a/>\n  <b/>\n  <c><![CDATA[ ]]></c>\n  <d> x </d>\n  <e/>\n</root>")
+
+	doc.WriteSettings.CanonicalEndTags = true
+	out, _ = doc.WriteToString()
+	checkStrEq(t, out, "<root>\n  <a></a>\n  <b></b>\n  <c><![CDATA[ ]]></c>\n  <d> x </d>\n  <e></e>\n</root>")
+
+	// The tree itself is left unmodified.
+	doc.WriteSettings = newWriteSettings()
+	out, _ = doc.WriteToString()
+	checkStrEq(t, out, s)
+}
+
+func TestVerbatim(t *testing.T) {
+	s := "<?xml  version='1.0' ?>\r\n<!DOCTYPE x>\r\n" +
+		"<root  a = 'x'\tb=\"&#x41;&apos;\" >\r\n" +
+		"  <empty></empty >\r\n" +
+		"  <self  />\r\n" +
+		"  <text>&#65;&amp;&gt;'\"</text>\r\n" +
+		"  <![CDATA[<cdata>]]>\r\n" +
+		"</root >"
+
+	doc := NewDocument()
+	doc.ReadSettings.Verbatim = true
+	doc.WriteSettings.Verbatim = true
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal("etree: failed to parse document")
+	}
+	out, _ := doc.WriteToString()
+	checkStrBinaryEq(t, out, s)
+
+	// Copies are written verbatim too.
+	out, _ = doc.Copy().WriteToString()
+	checkStrBinaryEq(t, out, s)
+
+	// Modified tokens are written normally.
+	root := doc.Root()
+	root.SelectElement("self").CreateElement("child")
+	root.SelectElement("text").SetText("B")
+	root.SelectElement("empty").CreateAttr("c", "1")
+	out, _ = doc.WriteToString()
+	checkStrBinaryEq(t, out, "<?xml  version='1.0' ?>\r\n<!DOCTYPE x>\r\n"+
+		"<root  a = 'x'\tb=\"&#x41;&apos;\" >\r\n"+
+		"  <empty c=\"1\"></empty>\r\n"+
+		"  <self><child/></self>\r\n"+
+		"  <text>B</text>\r\n"+
+		"  <![CDATA[<cdata>]]>\r\n"+
+		"</root >")
+
+	doc.WriteSettings.Verbatim = false
+	out, _ = doc.WriteToString()
+	checkStrBinaryEq(t, out, "<?xml version='1.0' ?>\n<!DOCTYPE x>\n"+
+		"<root a=\"x\" b=\"A&apos;\">\n"+
+		"  <empty c=\"1\"/>\n"+
+		"  <self><child/></self>\n"+
+		"  <text>B</text>\n"+
+		"  <![CDATA[<cdata>]]>\n"+
+		"</root>")
+}
+
+func TestCopy(t *testing.T) {
+	s := `<store>
+	<book lang="en">
+		<title>Great Expectations</title>
+		<author>Charles Dickens</author>
+	</book>
+</store>`
+
+	doc := newDocumentFromString(t, s)
+
+	s1, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: incorrect WriteToString result")
+	}
+
+	doc2 := doc.Copy()
+	checkIndexes(t, &doc2.Element)
+	s2, err := doc2.WriteToString()
+	if err != nil {
+		t.Error("etree: incorrect Copy result")
+	}
+
+	if s1 != s2 {
+		t.Error("etree: mismatched Copy result")
+		t.Error("wanted:\n" + s1)
+		t.Error("got:\n" + s2)
+	}
+
+	e1 := doc.FindElement("./store/book/title")
+	e2 := doc2.FindElement("./store/book/title")
+	if e1 == nil || e2 == nil {
+		t.Error("etree: incorrect FindElement result")
+	}
+	if e1 == e2 {
+		t.Error("etree: incorrect FindElement result")
+	}
+
+	e1.parent.RemoveChildAt(e1.Index())
+	s1, _ = doc.WriteToString()
+	s2, _ = doc2.WriteToString()
+	if s1 == s2 {
+		t.Error("etree: incorrect result after RemoveElement")
+	}
+}
+
+func TestCopyFiltered(t *testing.T) {
+	doc := newDocumentFromString(t, `<a x="1">
+  <!--c1-->
+  <?pi inst?>
+  <b>text<!--c2--><c/></b>
+  <d><![CDATA[ ]]></d>
+</a>`)
+	a := doc.Root()
+	orig := a.String()
+
+	c := a.CopyWithoutComments()
+	checkStrEq(t, c.String(), "<a x=\"1\">\n  \n  <?pi inst?>\n  <b>text<c/></b>\n  <d><![CDATA[ ]]></d>\n</a>")
+
+	c = a.CopyContentOnly()
+	checkStrEq(t, c.String(), `<a x="1"><b>text<c/></b><d><![CDATA[ ]]></d></a>`)
+	if c.Parent() != nil {
+		t.Error("etree: copy has a parent")
+	}
+	for i, t2 := range c.Child {
+		checkIntEq(t, t2.Index(), i)
+		if t2.Parent() != c {
+			t.Errorf("etree: copied child %d has the wrong parent", i)
+		}
+	}
+	checkStrEq(t, c.SelectElement("b").SelectElement("c").GetPath(), "/a/b/c")
+
+	c = a.CopyFiltered(func(t Token) bool {
+		e, ok := t.(*Element)
+		return !ok || e.Tag != "b"
+	})
+	checkBoolEq(t, c.SelectElement("b") == nil, true)
+	checkBoolEq(t, c.SelectElement("d") != nil, true)
+
+	checkStrEq(t, a.String(), orig)
+}
+
+func TestCopyStandalone(t *testing.T) {
+	s := `<root xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b" xmlns:unused="urn:unused">
+	<a:item b:attr="1" xml:lang="en"><child/><c:x xmlns:c="urn:c"/></a:item>
+	<a:other xmlns="" xmlns:a="urn:a2"><plain/></a:other>
+</root>`
+	doc := newDocumentFromString(t, s)
+
+	c := doc.FindElement("//a:item").CopyStandalone()
+	checkStrEq(t, c.String(), `<a:item xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b" b:attr="1" xml:lang="en"><child/><c:x xmlns:c="urn:c"/></a:item>`)
+	if c.Parent() != nil {
+		t.Error("etree: standalone copy has a parent")
+	}
+	doc2 := NewDocumentWithRoot(c)
+	checkStrEq(t, doc2.FindElement("//child").NamespaceURI(), "urn:default")
+
+	c = doc.FindElement("//a:other").CopyStandalone()
+	checkStrEq(t, c.String(), `<a:other xmlns="" xmlns:a="urn:a2"><plain/></a:other>`)
+
+	c = doc.Root().CopyStandalone()
+	checkStrEq(t, c.String(), doc.Root().String())
+}
+
+func TestGetPath(t *testing.T) {
+	s := `<a>
+ <b1>
   <c1>
    <d1/>
    <d1a/>
@@ -504,7 +1370,141 @@ func TestGetPath(t *testing.T) {
 		if p != c.topath {
 			t.Errorf("GetPath for '%s'. Expected '%s', got '%s'.\n", c.to, c.topath, p)
 		}
+
+		want := ""
+		if !strings.HasPrefix(c.relpath, "..") {
+			want = c.relpath
+		}
+		if pt := fe.GetPathTo(te); pt != want {
+			t.Errorf("GetPathTo from '%s' to '%s'. Expected '%s', got '%s'.\n", c.from, c.to, want, pt)
+		}
+	}
+
+	if p := doc.Root().GetPathTo(nil); p != "" {
+		t.Errorf("GetPathTo nil. Expected '', got '%s'.\n", p)
+	}
+}
+
+func TestPathTokens(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/><x:b><c/></x:b><b><c/><c/></b></a>`)
+	root := doc.Root()
+	c := root.ChildElements()[2].ChildElements()[1]
+
+	tokens := c.PathTokens()
+	checkIntEq(t, len(tokens), 3)
+	expected := []PathToken{
+		{root, "", "a", 1},
+		{root.ChildElements()[2], "", "b", 3},
+		{c, "", "c", 2},
+	}
+	for i, tok := range tokens {
+		if tok != expected[i] {
+			t.Errorf("etree: PathTokens step %d: got %+v, wanted %+v", i, tok, expected[i])
+		}
+	}
+
+	xb := root.SelectElement("x:b")
+	tokens = xb.PathTokens()
+	checkIntEq(t, len(tokens), 2)
+	checkStrEq(t, tokens[1].Space, "x")
+	checkIntEq(t, tokens[1].Position, 1)
+
+	tokens = NewElement("lone").PathTokens()
+	checkIntEq(t, len(tokens), 1)
+	checkIntEq(t, tokens[0].Position, 1)
+}
+
+func TestContains(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b><c/></b><d/></a>`)
+	a := doc.Root()
+	b := a.SelectElement("b")
+	c := b.SelectElement("c")
+	d := a.SelectElement("d")
+
+	checkBoolEq(t, a.Contains(c), true)
+	checkBoolEq(t, b.Contains(c), true)
+	checkBoolEq(t, a.Contains(a), true)
+	checkBoolEq(t, doc.Contains(d), true)
+	checkBoolEq(t, c.Contains(b), false)
+	checkBoolEq(t, d.Contains(c), false)
+	checkBoolEq(t, a.Contains(nil), false)
+
+	checkBoolEq(t, c.IsDescendantOf(a), true)
+	checkBoolEq(t, c.IsDescendantOf(b), true)
+	checkBoolEq(t, c.IsDescendantOf(c), false)
+	checkBoolEq(t, b.IsDescendantOf(c), false)
+	checkBoolEq(t, c.IsDescendantOf(d), false)
+	checkBoolEq(t, a.IsDescendantOf(&doc.Element), true)
+	checkBoolEq(t, a.IsDescendantOf(nil), false)
+
+	b.RemoveChild(c)
+	checkBoolEq(t, a.Contains(c), false)
+	checkBoolEq(t, c.IsDescendantOf(a), false)
+}
+
+func TestSiblingIndex(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/>text<x:b/><c/><b/><x:b/><b/></a>`)
+	expected := []int{1, 1, 1, 2, 2, 3}
+	for i, e := range doc.Root().ChildElements() {
+		checkIntEq(t, e.SiblingIndex(), expected[i])
+	}
+	checkIntEq(t, doc.Root().SiblingIndex(), 1)
+	checkIntEq(t, NewElement("lone").SiblingIndex(), 1)
+}
+
+func TestIndexedPath(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/><x:b><c/></x:b><b><c/><c/></b><d><c/></d></a>`)
+	root := doc.Root()
+	checkStrEq(t, root.IndexedPath(), "/a")
+	checkStrEq(t, root.SelectElement("d").SelectElement("c").IndexedPath(), "/a/d/c")
+	checkStrEq(t, root.ChildElements()[2].ChildElements()[1].IndexedPath(), "/a/b[3]/c[2]")
+	checkStrEq(t, root.SelectElement("x:b").IndexedPath(), "/a/x:b")
+	checkStrEq(t, doc.IndexedPath(), "/")
+
+	for _, d := range []*Document{doc, newDocumentFromString(t, testXML)} {
+		for _, e := range d.FindElements("//*") {
+			path := e.IndexedPath()
+			if f := d.FindElement(path); f != e {
+				t.Errorf("etree: FindElement(%q) did not return the original element", path)
+			}
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	doc := newDocumentFromString(t, `<store><book id="1"><title>A</title><author>X</author><author>Y</author></book><book id="2"/></store>`)
+
+	var paths []string
+	for _, n := range doc.Flatten(false) {
+		paths = append(paths, n.Path+"="+n.Text)
+	}
+	checkStrEq(t, strings.Join(paths, " "),
+		"/store= /store/book[1]= /store/book[1]/title=A /store/book[1]/author[1]=X /store/book[1]/author[2]=Y /store/book[2]=")
+
+	leaves := doc.Root().Flatten(true)
+	checkIntEq(t, len(leaves), 4)
+	checkStrEq(t, leaves[3].Path, "/store/book[2]")
+	checkStrEq(t, leaves[3].Attrs["id"], "2")
+	if leaves[0].Attrs != nil || leaves[0].Element != doc.FindElement("//title") {
+		t.Error("etree: incorrect flattened node")
+	}
+
+	doc = newDocumentFromString(t, `<r><a/><p:a><b/><b/></p:a><p:a/><q:a><c/></q:a><b/></r>`)
+	for i := 0; i < 1000; i++ {
+		doc.Root().CreateElement("w")
+	}
+	nodes := doc.Flatten(false)
+	checkIntEq(t, len(nodes), 1009)
+	for _, n := range nodes {
+		if n.Path != n.Element.IndexedPath() {
+			t.Errorf("etree: Flatten path %s, wanted %s", n.Path, n.Element.IndexedPath())
+		}
 	}
+	checkStrEq(t, nodes[2].Path, "/r/p:a[1]")
+	checkStrEq(t, nodes[4].Path, "/r/p:a[1]/b[2]")
+	checkStrEq(t, nodes[6].Path, "/r/q:a")
+	checkIntEq(t, len(doc.FindElement("//q:a").Flatten(false)), 1)
+	checkStrEq(t, doc.FindElement("//q:a").Flatten(false)[0].Path, "/r/q:a/c")
 }
 
 func TestInsertChild(t *testing.T) {
@@ -572,6 +1572,151 @@ func TestInsertChild(t *testing.T) {
 	checkStrEq(t, s4, expected4)
 }
 
+func TestMoveTo(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a/><b/><c/><d><e/></d></root>`)
+	root := doc.Root()
+	a, c, d, e := root.SelectElement("a"), root.SelectElement("c"), root.SelectElement("d"), doc.FindElement("//e")
+
+	if err := a.MoveTo(root, d.Index()); err != nil {
+		t.Fatal(err)
+	}
+	checkDocEq(t, doc, `<root><b/><c/><a/><d><e/></d></root>`)
+
+	if err := d.MoveTo(root, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkDocEq(t, doc, `<root><d><e/></d><b/><c/><a/></root>`)
+
+	if err := c.MoveTo(root, c.Index()); err != nil {
+		t.Fatal(err)
+	}
+	checkDocEq(t, doc, `<root><d><e/></d><b/><c/><a/></root>`)
+
+	if err := c.MoveTo(e, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkDocEq(t, doc, `<root><d><e><c/></e></d><b/><a/></root>`)
+	checkIndexes(t, &doc.Element)
+
+	if err := d.MoveTo(e, 0); err != ErrCycle {
+		t.Errorf("etree: expected ErrCycle, got %v", err)
+	}
+	if err := d.MoveTo(d, 0); err != ErrCycle {
+		t.Errorf("etree: expected ErrCycle, got %v", err)
+	}
+	checkDocEq(t, doc, `<root><d><e><c/></e></d><b/><a/></root>`)
+
+	n := NewElement("n")
+	if err := n.MoveTo(root, 99); err != nil {
+		t.Fatal(err)
+	}
+	checkDocEq(t, doc, `<root><d><e><c/></e></d><b/><a/><n/></root>`)
+}
+
+func TestAddChildCycle(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b><c/></b></a>`)
+	a, b, c := doc.Root(), doc.FindElement("//b"), doc.FindElement("//c")
+
+	expectCycle := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r != ErrCycle {
+				t.Errorf("etree: %s: expected ErrCycle panic, got %v", name, r)
+			}
+		}()
+		fn()
+	}
+	expectCycle("AddChild", func() { c.AddChild(a) })
+	expectCycle("AddChild self", func() { b.AddChild(b) })
+	expectCycle("InsertChildAt", func() { c.InsertChildAt(0, b) })
+	expectCycle("InsertChildrenAt", func() { b.InsertChildrenAt(0, NewElement("x"), a) })
+	expectCycle("InsertChild", func() { b.InsertChild(c, a) })
+	expectCycle("Splice", func() { b.Splice(0, a) })
+	expectCycle("SetRoot", func() { doc.SetRoot(&doc.Element) })
+	checkDocEq(t, doc, `<a><b><c/></b></a>`)
+	checkIndexes(t, &doc.Element)
+
+	c.AddChild(NewElement("d"))
+	a.AddChild(c)
+	checkDocEq(t, doc, `<a><b/><c><d/></c></a>`)
+}
+
+func TestInsertChildren(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a/><b/><c/><d/></root>`)
+	root := doc.Root()
+
+	other := newDocumentFromString(t, `<other><x/><y/></other>`)
+	x, y := other.FindElement("//x"), other.FindElement("//y")
+	root.InsertChildrenAt(1, x, NewComment("z"), y)
+	checkDocEq(t, doc, `<root><a/><x/><!--z--><y/><b/><c/><d/></root>`)
+	checkDocEq(t, other, `<other/>`)
+	checkIndexes(t, &doc.Element)
+
+	// Move existing children of the same element.
+	d, a := root.SelectElement("d"), root.SelectElement("a")
+	root.InsertChildrenAt(root.SelectElement("b").Index(), d, a)
+	checkDocEq(t, doc, `<root><x/><!--z--><y/><d/><a/><b/><c/></root>`)
+	checkIndexes(t, &doc.Element)
+
+	root.InsertChildrenAt(999, root.Child[:3]...)
+	checkDocEq(t, doc, `<root><d/><a/><b/><c/><x/><!--z--><y/></root>`)
+	checkIndexes(t, &doc.Element)
+
+	root.InsertChildrenAt(0)
+	checkDocEq(t, doc, `<root><d/><a/><b/><c/><x/><!--z--><y/></root>`)
+}
+
+func TestSplice(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a/><placeholder/><d/></root>`)
+	root := doc.Root()
+
+	p := root.SelectElement("placeholder")
+	d := root.SelectElement("d")
+	if r := root.Splice(p.Index(), NewElement("b"), NewText("t"), d); r != p {
+		t.Fatal("etree: Splice returned the wrong token")
+	}
+	checkDocEq(t, doc, `<root><a/><b/>t<d/></root>`)
+	checkIndexes(t, &doc.Element)
+	if p.Parent() != nil || p.Index() != -1 {
+		t.Error("etree: spliced token still has a parent")
+	}
+	if root.Splice(99, NewElement("x")) != nil {
+		t.Error("etree: Splice out of bounds returned a token")
+	}
+
+	doc = newDocumentFromString(t, `<root><a/><wrap>x<b/><c/></wrap><d/></root>`)
+	wrap := doc.FindElement("//wrap")
+	wrap.Unwrap()
+	checkDocEq(t, doc, `<root><a/>x<b/><c/><d/></root>`)
+	checkIndexes(t, &doc.Element)
+	for _, c := range doc.Root().Child {
+		if c.Parent() != doc.Root() {
+			t.Error("etree: unwrapped token has the wrong parent")
+		}
+	}
+	if wrap.Parent() != nil || len(wrap.Child) != 0 {
+		t.Error("etree: unwrapped element not detached")
+	}
+	wrap.Unwrap()
+}
+
+func TestInsertTextAt(t *testing.T) {
+	doc := newDocumentFromString(t, `<p><b/><i/></p>`)
+	p := doc.Root()
+
+	c := p.InsertTextAt(1, " and ")
+	checkStrEq(t, c.Data, " and ")
+	checkBoolEq(t, c.IsCData(), false)
+	cd := p.InsertCDataAt(0, "<raw>")
+	checkBoolEq(t, cd.IsCData(), true)
+	checkBoolEq(t, p.InsertTextAt(99, " ").IsWhitespace(), true)
+	checkStrEq(t, p.String(), `<p><![CDATA[<raw>]]><b/> and <i/> </p>`)
+	checkIndexes(t, &doc.Element)
+	if c.Parent() != p || c.Index() != 2 {
+		t.Error("etree: inserted text has the wrong position")
+	}
+}
+
 func TestCdata(t *testing.T) {
 	var tests = []struct {
 		in, out string
@@ -629,6 +1774,28 @@ func TestAddChild(t *testing.T) {
 	checkStrEq(t, s2, expected2)
 }
 
+func TestAddFragmentString(t *testing.T) {
+	doc := newDocumentFromString(t, `<root xmlns:p="urn:p"><first/></root>`)
+	root := doc.Root()
+
+	err := root.AddFragmentString(`<p:a x="1"/>text<b><c/></b><!--note-->`, ReadSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, root.String(), `<root xmlns:p="urn:p"><first/><p:a x="1"/>text<b><c/></b><!--note--></root>`)
+	checkIndexes(t, &doc.Element)
+	checkStrEq(t, root.SelectElement("p:a").NamespaceURI(), "urn:p")
+	if root.SelectElement("b").Parent() != root {
+		t.Error("etree: fragment element has the wrong parent")
+	}
+
+	err = root.AddFragmentString(`<d><e></d>`, ReadSettings{})
+	if err == nil {
+		t.Error("etree: expected an error for an invalid fragment")
+	}
+	checkIntEq(t, len(root.Child), 5)
+}
+
 func TestSetRoot(t *testing.T) {
 	s := `<?test a="wow"?>
 <book>
@@ -687,112 +1854,1512 @@ func TestSetRoot(t *testing.T) {
 	checkStrEq(t, s5, expected5)
 }
 
-func TestSortAttrs(t *testing.T) {
-	s := `<el foo='5' Foo='2' aaa='4' สวัสดี='7' AAA='1' a01='3' z='6' a:ZZZ='9' a:AAA='8'/>`
-	doc := newDocumentFromString(t, s)
-	doc.Root().SortAttrs()
-	doc.Indent(2)
-	out, _ := doc.WriteToString()
-	checkStrEq(t, out, `<el AAA="1" Foo="2" a01="3" aaa="4" foo="5" z="6" สวัสดี="7" a:AAA="8" a:ZZZ="9"/>`+"\n")
+func TestRootTag(t *testing.T) {
+	doc := NewDocument()
+	space, tag := doc.RootTag()
+	checkStrEq(t, space, "")
+	checkStrEq(t, tag, "")
+	checkStrEq(t, doc.RootAttrValue("version", "none"), "none")
+
+	s := `<?xml version="1.0"?><a:feed xmlns:a="urn:feed" version="2"/>`
+	doc = newDocumentFromString(t, s)
+	space, tag = doc.RootTag()
+	checkStrEq(t, space, "a")
+	checkStrEq(t, tag, "feed")
+	checkStrEq(t, doc.RootAttrValue("version", "none"), "2")
+	checkStrEq(t, doc.RootAttrValue("xmlns:a", "none"), "urn:feed")
+	checkStrEq(t, doc.RootAttrValue("missing", "none"), "none")
+}
+
+func TestChildIndex(t *testing.T) {
+	s := `<root xmlns:p="urn:p"><a/><b/><p:a/><a/><!--c--></root>`
+	doc := newDocumentFromString(t, s)
+	root := doc.Root()
+
+	root.BuildChildIndex()
+	checkIntEq(t, len(root.SelectElements("a")), 3)
+	checkIntEq(t, len(root.SelectElements("p:a")), 1)
+	checkIntEq(t, len(root.SelectElements("c")), 0)
+	checkElementEq(t, root.SelectElement("p:a"), root.ChildElements()[2])
+	checkElementEq(t, root.SelectElement("b"), root.ChildElements()[1])
+	checkElementEq(t, root.SelectElement("q:a"), nil)
+
+	c := root.CreateElement("c")
+	checkElementEq(t, root.SelectElement("c"), c)
+	root.BuildChildIndex()
+	root.RemoveChild(c)
+	checkElementEq(t, root.SelectElement("c"), nil)
+	root.BuildChildIndex()
+	root.InsertChildAt(0, c)
+	checkElementEq(t, root.SelectElement("c"), c)
+}
+
+func TestRename(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><old/><x:old><old/></x:old><keep/></root>`)
+	root := doc.Root()
+	root.BuildChildIndex()
+
+	keep := root.SelectElement("keep")
+	keep.Rename("p:kept")
+	checkStrEq(t, keep.Space, "p")
+	checkStrEq(t, keep.Tag, "kept")
+	if root.SelectElement("kept") != keep || root.SelectElement("keep") != nil {
+		t.Error("etree: child index not updated after Rename")
+	}
+	keep.Rename("plain")
+	checkStrEq(t, keep.FullTag(), "plain")
+
+	checkIntEq(t, root.RenameAll("old", "new"), 2)
+	checkDocEq(t, doc, `<root><new/><x:old><new/></x:old><plain/></root>`)
+	checkIntEq(t, root.RenameAll("x:old", "x:new"), 1)
+	checkDocEq(t, doc, `<root><new/><x:new><new/></x:new><plain/></root>`)
+	checkIntEq(t, root.RenameAll("missing", "x"), 0)
+
+	for _, tag := range []string{"a", "p:a", "_a-b.c1", "\u00e9l\u00e9ment", "x:y\u00b7"} {
+		if !IsValidTag(tag) {
+			t.Errorf("etree: IsValidTag(%q) should be true", tag)
+		}
+	}
+	for _, tag := range []string{"", "1a", "-a", "a b", "a:b:c", ":a", "a:", "a<b"} {
+		if IsValidTag(tag) {
+			t.Errorf("etree: IsValidTag(%q) should be false", tag)
+		}
+	}
+}
+
+func TestStringer(t *testing.T) {
+	doc := newDocumentFromString(t, `<?pi?><p:root a="1"><child>text</child></p:root>`)
+	root := doc.Root()
+
+	checkStrEq(t, fmt.Sprintf("%v", doc), `<?pi?><p:root a="1"><child>text</child></p:root>`)
+	checkStrEq(t, fmt.Sprintf("%s", root.SelectElement("child")), `<child>text</child>`)
+	checkStrEq(t, fmt.Sprintf("%#v", doc), `&etree.Document{Root:"p:root", Child:2}`)
+	checkStrEq(t, fmt.Sprintf("%#v", root), `&etree.Element{Space:"p", Tag:"root", Attr:1, Child:1}`)
+
+	var nilElement *Element
+	checkStrEq(t, fmt.Sprintf("%v", nilElement), `<nil>`)
+	checkStrEq(t, fmt.Sprintf("%#v", nilElement), `(*etree.Element)(nil)`)
+}
+
+func TestOuterInnerXML(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><p a="x">Hello <b>'world'</b><!--c--></p></root>`)
+	p := doc.FindElement("//p")
+
+	checkStrEq(t, p.OuterXML(), `<p a="x">Hello <b>&apos;world&apos;</b><!--c--></p>`)
+	checkStrEq(t, p.InnerXML(), `Hello <b>&apos;world&apos;</b><!--c-->`)
+	checkStrEq(t, p.SelectElement("b").InnerXML(), `&apos;world&apos;`)
+	checkStrEq(t, NewElement("empty").InnerXML(), "")
+
+	settings := WriteSettings{
+		CanonicalText: true,
+		ChildFilter: func(t Token) bool {
+			_, ok := t.(*Comment)
+			return !ok
+		},
+	}
+	checkStrEq(t, p.OuterXMLWS(settings), `<p a="x">Hello <b>'world'</b></p>`)
+	checkStrEq(t, p.InnerXMLWS(settings), `Hello <b>'world'</b>`)
+}
+
+func TestChildElementsFunc(t *testing.T) {
+	doc := newDocumentFromString(t, `<root><a id="1"/>text<b/><c id="2"><d id="3"/></c></root>`)
+	root := doc.Root()
+
+	hasID := func(e *Element) bool { return e.SelectAttr("id") != nil }
+	elements := root.ChildElementsFunc(hasID)
+	if len(elements) != 2 || elements[0].Tag != "a" || elements[1].Tag != "c" {
+		t.Error("etree: incorrect ChildElementsFunc result")
+	}
+
+	none := func(e *Element) bool { return false }
+	checkIntEq(t, len(root.ChildElementsFunc(none)), 0)
+}
+
+func TestWalkAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<a x="1" href="http://a"><b y="2"><c href="http://c"/></b><d/><e z="3"/></a>`)
+
+	var visited []string
+	doc.ForEachAttr(func(e *Element, a *Attr) bool {
+		if a.Element() != e {
+			t.Errorf("etree: attribute %s passed with wrong element", a.Key)
+		}
+		visited = append(visited, e.Tag+"@"+a.Key)
+		return true
+	})
+	checkStrEq(t, strings.Join(visited, ","), "a@x,a@href,b@y,c@href,e@z")
+
+	visited = nil
+	doc.Root().SelectElement("b").WalkAttrs(func(e *Element, a *Attr) bool {
+		visited = append(visited, e.Tag+"@"+a.Key)
+		return true
+	})
+	checkStrEq(t, strings.Join(visited, ","), "b@y,c@href")
+
+	visited = nil
+	doc.ForEachAttr(func(e *Element, a *Attr) bool {
+		if strings.HasPrefix(a.Value, "http://") {
+			visited = append(visited, a.Value)
+			a.Value = "https://" + a.Value[7:]
+		}
+		return len(visited) < 2
+	})
+	checkStrEq(t, strings.Join(visited, ","), "http://a,http://c")
+	checkDocEq(t, doc, `<a x="1" href="https://a"><b y="2"><c href="https://c"/></b><d/><e z="3"/></a>`)
+}
+
+func TestSeparateNamespaceDecls(t *testing.T) {
+	doc := newDocumentFromString(t, `<root b="1" xmlns:x="urn:x" x:a="2" xmlns="urn:d" c="3" xmlns:y="urn:y"/>`)
+	root := doc.Root()
+	var decls []bool
+	for i := range root.Attr {
+		decls = append(decls, root.Attr[i].IsNamespaceDecl())
+	}
+	checkStrEq(t, fmt.Sprint(decls), "[false true false true false true]")
+
+	root.SeparateNamespaceDecls()
+	checkStrEq(t, root.String(), `<root xmlns:x="urn:x" xmlns="urn:d" xmlns:y="urn:y" b="1" x:a="2" c="3"/>`)
+	if root.Attr[4].Element() != root {
+		t.Error("etree: attribute has the wrong element")
+	}
+}
+
+func TestSortAttrs(t *testing.T) {
+	s := `<el foo='5' Foo='2' aaa='4' สวัสดี='7' AAA='1' a01='3' z='6' a:ZZZ='9' a:AAA='8'/>`
+	doc := newDocumentFromString(t, s)
+	doc.Root().SortAttrs()
+	doc.Indent(2)
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<el AAA="1" Foo="2" a01="3" aaa="4" foo="5" z="6" สวัสดี="7" a:AAA="8" a:ZZZ="9"/>`+"\n")
+}
+
+func TestReorderChildren(t *testing.T) {
+	s := `<p><c n="1"/><x/><!--k--><a/><c n="2"/><p:b/><b/><y/></p>`
+
+	doc := newDocumentFromString(t, s)
+	doc.Root().ReorderChildren([]string{"a", "b", "c"})
+	checkStrEq(t, doc.Root().String(), `<p><a/><p:b/><!--k--><b/><c n="1"/><c n="2"/><x/><y/></p>`)
+
+	doc = newDocumentFromString(t, s)
+	doc.Root().ReorderChildren([]string{"*", "p:b", "b", "c"})
+	checkStrEq(t, doc.Root().String(), `<p><x/><a/><!--k--><y/><p:b/><b/><c n="1"/><c n="2"/></p>`)
+
+	doc = newDocumentFromString(t, s)
+	doc.Root().ReorderChildren([]string{"b", "p:b"})
+	checkStrEq(t, doc.Root().String(), `<p><b/><p:b/><!--k--><c n="1"/><x/><a/><c n="2"/><y/></p>`)
+	checkIndexes(t, &doc.Element)
+}
+
+func TestSortChildren(t *testing.T) {
+	s := `<list><i n="10">b</i><!--c--><i n="9">a</i>x<i>c</i><i n="item2">d</i><i n="item10">d</i></list>`
+	text := func(e *Element) string {
+		var parts []string
+		for _, c := range e.Child {
+			switch c := c.(type) {
+			case *Element:
+				parts = append(parts, c.SelectAttrValue("n", "-")+":"+c.Text())
+			case *CharData:
+				parts = append(parts, c.Data)
+			case *Comment:
+				parts = append(parts, "<!--"+c.Data+"-->")
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+
+	doc := newDocumentFromString(t, s)
+	list := doc.Root()
+	list.SortChildrenByText(0)
+	checkStrEq(t, text(list), `9:a <!--c--> 10:b x -:c item2:d item10:d`)
+	checkIndexes(t, list)
+
+	list.SortChildrenByText(SortDescending)
+	checkStrEq(t, text(list), `item2:d <!--c--> item10:d x -:c 10:b 9:a`)
+
+	list.SortChildrenByAttr("n", 0)
+	checkStrEq(t, text(list), `-:c <!--c--> 10:b x 9:a item10:d item2:d`)
+
+	list.SortChildrenByAttr("n", SortNumeric)
+	checkStrEq(t, text(list), `-:c <!--c--> 9:a x 10:b item2:d item10:d`)
+
+	list.SortChildrenByAttr("n", SortNumeric|SortDescending)
+	checkStrEq(t, text(list), `item10:d <!--c--> item2:d x 10:b 9:a -:c`)
+	checkIndexes(t, list)
+
+	list.SortChildElements(func(a, b *Element) bool { return false })
+	checkStrEq(t, text(list), `item10:d <!--c--> item2:d x 10:b 9:a -:c`)
+}
+
+func TestSetAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<el a="1" b="2"/>`)
+	el := doc.Root()
+
+	el.SetAttrsOrdered([]string{"c", "a", "x:d"}, []string{"3", "10", "4"})
+	checkDocEq(t, doc, `<el a="10" b="2" c="3" x:d="4"/>`)
+
+	el.SetAttrs(map[string]string{"b": "20", "e": "5"})
+	checkIntEq(t, len(el.Attr), 5)
+	checkStrEq(t, el.SelectAttrValue("b", ""), "20")
+	checkStrEq(t, el.SelectAttrValue("e", ""), "5")
+	for i := range el.Attr {
+		if el.Attr[i].Element() != el {
+			t.Errorf("etree: attribute %s has incorrect parent", el.Attr[i].FullKey())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("etree: SetAttrsOrdered did not panic on mismatched slices")
+		}
+	}()
+	el.SetAttrsOrdered([]string{"f"}, nil)
+}
+
+func TestReadCoalesceText(t *testing.T) {
+	input := `<a>one<![CDATA[<two>]]>three<b/><![CDATA[x]]><![CDATA[y]]><c/> <![CDATA[ ]]>` + "\n" + `</a>`
+
+	doc := NewDocument()
+	doc.ReadSettings.CoalesceText = true
+	doc.ReadSettings.Verbatim = true
+	if err := doc.ReadFromString(input); err != nil {
+		t.Fatal(err)
+	}
+	a := doc.Root()
+	checkIntEq(t, len(a.Child), 5)
+
+	cases := []struct {
+		index      int
+		data       string
+		cdata      bool
+		whitespace bool
+	}{
+		{0, "one<two>three", false, false},
+		{2, "xy", true, false},
+		{4, "  \n", false, true},
+	}
+	for _, c := range cases {
+		cd, ok := a.Child[c.index].(*CharData)
+		if !ok {
+			t.Fatalf("etree: child %d is not character data", c.index)
+		}
+		checkStrEq(t, cd.Data, c.data)
+		checkBoolEq(t, cd.IsCData(), c.cdata)
+		checkBoolEq(t, cd.IsWhitespace(), c.whitespace)
+	}
+	checkStrEq(t, a.Text(), "one<two>three")
+
+	doc.WriteSettings.Verbatim = true
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, input)
+
+	a.Child[0].(*CharData).Data = "changed"
+	s, err = doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, `<a>changed<b/><![CDATA[x]]><![CDATA[y]]><c/> <![CDATA[ ]]>`+"\n"+`</a>`)
+
+	doc = newDocumentFromString(t, input)
+	checkIntEq(t, len(doc.Root().Child), 10)
+}
+
+func TestReadExpandNamespaces(t *testing.T) {
+	docs := []string{
+		`<a:root xmlns:a="urn:x" xmlns:b="http://y.org/"><a:item b:id="1" plain="2"/></a:root>`,
+		`<root xmlns="urn:x"><item xmlns:c="http://y.org/" c:id="1" plain="2"/></root>`,
+	}
+	for _, s := range docs {
+		doc := NewDocument()
+		doc.ReadSettings.ExpandNamespaces = true
+		if err := doc.ReadFromString(s); err != nil {
+			t.Fatal(err)
+		}
+
+		root := doc.Root()
+		checkStrEq(t, root.Space, "urn:x")
+		checkStrEq(t, root.NamespaceURI(), "urn:x")
+		item := doc.FindElement("//{urn:x}item")
+		if item == nil {
+			t.Fatal("etree: expanded element not found")
+		}
+		checkStrEq(t, item.Space, "urn:x")
+		id := &item.Attr[len(item.Attr)-2]
+		checkStrEq(t, id.Space, "http://y.org/")
+		checkStrEq(t, id.Key, "id")
+		checkStrEq(t, id.NamespaceURI(), "http://y.org/")
+		checkStrEq(t, item.SelectAttr("plain").Space, "")
+
+		out, err := doc.WriteToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStrEq(t, out, s)
+	}
+
+	// Prefixes bound to no namespace and declarations are left alone, and
+	// verbatim reads still reproduce unmodified elements exactly.
+	doc := NewDocument()
+	doc.ReadSettings.ExpandNamespaces = true
+	doc.ReadSettings.Verbatim = true
+	doc.WriteSettings.Verbatim = true
+	s := `<p:a xmlns:p='urn:p'><q:b  p:k='v'/></p:a>`
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, doc.Root().Space, "urn:p")
+	checkStrEq(t, doc.Root().Attr[0].FullKey(), "xmlns:p")
+	b := doc.FindElement("//b")
+	checkStrEq(t, b.Space, "q")
+	checkStrEq(t, b.Attr[0].Space, "urn:p")
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, out, s)
+
+	b.CreateAttr("n", "1")
+	out, err = doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, out, `<p:a xmlns:p='urn:p'><q:b p:k="v" n="1"/></p:a>`)
+}
+
+func TestWriteUndeclaredNamespaces(t *testing.T) {
+	s := `<r xmlns:x="urn:x" xmlns="urn:d"><x:item x:a="1" b="2"><x:sub/><c xmlns:ns1="urn:o"><x:deep/></c></x:item><other/></r>`
+	doc := NewDocument()
+	doc.ReadSettings.ExpandNamespaces = true
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+	item := doc.FindElement("//{urn:x}item")
+
+	// The outermost element using an undeclared namespace declares a prefix
+	// for it, unless a declaration of the same prefix hides it.
+	c := item.Copy()
+	checkStrEq(t, c.String(), `<ns1:item ns1:a="1" b="2" xmlns:ns1="urn:x"><ns1:sub/>`+
+		`<ns2:c xmlns:ns1="urn:o" xmlns:ns2="urn:d"><ns3:deep xmlns:ns3="urn:x"/></ns2:c></ns1:item>`)
+	if errs := c.Validate(); errs != nil {
+		t.Errorf("etree: Validate reported %v for a copy", errs)
+	}
+	var buf bytes.Buffer
+	if _, err := c.WriteIndentedTo(&buf, WriteSettings{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, buf.String(), "<ns1:item ns1:a=\"1\" b=\"2\" xmlns:ns1=\"urn:x\">\n <ns1:sub/>\n"+
+		" <ns2:c xmlns:ns1=\"urn:o\" xmlns:ns2=\"urn:d\">\n  <ns3:deep xmlns:ns3=\"urn:x\"/>\n </ns2:c>\n</ns1:item>\n")
+
+	// Standalone copies declare the inherited prefixes bound to the URIs.
+	c = item.CopyStandalone()
+	checkStrEq(t, c.String(), `<x:item xmlns="urn:d" xmlns:x="urn:x" x:a="1" b="2"><x:sub/>`+
+		`<c xmlns:ns1="urn:o"><x:deep/></c></x:item>`)
+	checkStrEq(t, c.CopyStandalone().String(), c.String())
+
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, out, s)
+
+	// Detached elements, and elements given a namespace no declaration
+	// binds, declare generated prefixes.
+	other := doc.FindElement("//{urn:d}other")
+	doc.Root().RemoveChild(other)
+	checkStrEq(t, other.String(), `<ns1:other xmlns:ns1="urn:d"/>`)
+	e := doc.Root().CreateElement("e")
+	e.Space = "urn:new"
+	e.CreateAttr("k", "v").Space = "urn:new"
+	checkStrEq(t, e.CopyStandalone().String(), `<ns1:e xmlns:ns1="urn:new" ns1:k="v"/>`)
+	checkStrEq(t, doc.Root().String(), `<r xmlns:x="urn:x" xmlns="urn:d"><x:item x:a="1" b="2"><x:sub/>`+
+		`<c xmlns:ns1="urn:o"><x:deep/></c></x:item><ns1:e ns1:k="v" xmlns:ns1="urn:new"/></r>`)
+}
+
+func TestReplaceAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<root xmlns:p="urn:p"><a p:x="1" y="2" z="3"/><b/></root>`)
+	a := doc.FindElement("//a")
+	b := doc.FindElement("//b")
+
+	var attrs []Attr
+	for _, attr := range a.Attr {
+		if attr.Key != "y" {
+			attrs = append(attrs, attr)
+		}
+	}
+	b.ReplaceAttrs(attrs)
+	attrs[0].Value = "changed"
+
+	checkStrEq(t, b.String(), `<b p:x="1" z="3"/>`)
+	checkIntEq(t, len(a.Attr), 3)
+	for i := range b.Attr {
+		if b.Attr[i].Element() != b {
+			t.Errorf("etree: attribute %s not bound to its new element", b.Attr[i].FullKey())
+		}
+	}
+	checkStrEq(t, b.SelectAttr("p:x").NamespaceURI(), "urn:p")
+
+	b.ReplaceAttrs(nil)
+	checkIntEq(t, len(b.Attr), 0)
+	checkStrEq(t, b.String(), `<b/>`)
+}
+
+func TestRemoveAttrsNS(t *testing.T) {
+	doc := newDocumentFromString(t, `<a xmlns:xlink="http://www.w3.org/1999/xlink" xmlns:l="http://www.w3.org/1999/xlink" id="1" xlink:href="x" l:title="y" xlink:type="simple"/>`)
+	a := doc.Root()
+
+	attr := a.RemoveAttrNS("http://www.w3.org/1999/xlink", "title")
+	if attr == nil {
+		t.Fatal("etree: RemoveAttrNS found no attribute")
+	}
+	checkStrEq(t, attr.FullKey(), "l:title")
+	if a.RemoveAttrNS("http://www.w3.org/1999/xlink", "title") != nil {
+		t.Error("etree: RemoveAttrNS removed an attribute twice")
+	}
+
+	checkIntEq(t, a.RemoveAttrsNS("urn:none"), 0)
+	checkIntEq(t, a.RemoveAttrsNS("http://www.w3.org/1999/xlink"), 2)
+	checkStrEq(t, a.String(), `<a xmlns:xlink="http://www.w3.org/1999/xlink" xmlns:l="http://www.w3.org/1999/xlink" id="1"/>`)
+	checkIntEq(t, a.RemoveAttrsNS(""), 1)
+
+	// Prefixed attributes never match the empty namespace, and the xml
+	// prefix is bound to the XML namespace.
+	x := newDocumentFromString(t, `<x xml:lang="en" y:q="1" id="2" lang="3"/>`).Root()
+	checkStrEq(t, x.RemoveAttrNS("", "lang").FullKey(), "lang")
+	checkIntEq(t, x.RemoveAttrsNS(""), 1)
+	checkStrEq(t, x.String(), `<x xml:lang="en" y:q="1"/>`)
+	checkIntEq(t, x.RemoveAttrsNS("http://www.w3.org/XML/1998/namespace"), 1)
+	checkStrEq(t, x.String(), `<x y:q="1"/>`)
+
+	// Namespace URIs are resolved before any attribute is removed.
+	c := newDocumentFromString(t, `<c xmlns:p="urn:p" p:q="1"/>`).Root()
+	n := c.RemoveAttrsFunc(func(attr Attr) bool {
+		return attr.IsNamespaceDecl() || attr.NamespaceURI() == "urn:p"
+	})
+	checkIntEq(t, n, 2)
+	checkIntEq(t, len(c.Attr), 0)
+
+	b := newDocumentFromString(t, `<b x="1" y="22" z="3"/>`).Root()
+	n = b.RemoveAttrsFunc(func(attr Attr) bool { return len(attr.Value) == 1 })
+	checkIntEq(t, n, 2)
+	checkStrEq(t, b.String(), `<b y="22"/>`)
+}
+
+func TestAttrNS(t *testing.T) {
+	doc := newDocumentFromString(t, `<r xmlns:xl="http://www.w3.org/1999/xlink" xmlns:ns0="urn:taken"><a xl:href="#1" href="plain" xml:lang="en"/></r>`)
+	a := doc.FindElement("//a")
+
+	href := a.SelectAttrNS("http://www.w3.org/1999/xlink", "href")
+	if href == nil || href.Value != "#1" {
+		t.Fatal("etree: SelectAttrNS failed to find the xlink:href attribute")
+	}
+	checkStrEq(t, a.SelectAttrNS("", "href").Value, "plain")
+	if a.SelectAttrNS("urn:other", "href") != nil {
+		t.Error("etree: SelectAttrNS matched an attribute in the wrong namespace")
+	}
+
+	a.CreateAttrNS("http://www.w3.org/1999/xlink", "href", "#2")
+	a.CreateAttrNS("http://www.w3.org/1999/xlink", "title", "T")
+	a.CreateAttrNS("urn:new", "k", "1")
+	a.CreateAttrNS("urn:new", "j", "2")
+	a.CreateAttrNS("", "plain", "3")
+	a.CreateAttrNS("http://www.w3.org/XML/1998/namespace", "space", "preserve")
+	checkStrEq(t, a.String(), `<a xl:href="#2" href="plain" xml:lang="en" xl:title="T" xmlns:ns1="urn:new" ns1:k="1" ns1:j="2" plain="3" xml:space="preserve"/>`)
+	checkStrEq(t, a.SelectAttrNS("urn:new", "j").FullKey(), "ns1:j")
+
+	// The xml prefix is bound to the XML namespace, and prefixed attributes
+	// never match the empty namespace.
+	b := newDocumentFromString(t, `<b xml:lang="en" y:lang="undeclared" lang="x"/>`).Root()
+	checkStrEq(t, b.SelectAttrNS("", "lang").FullKey(), "lang")
+	checkStrEq(t, b.SelectAttrNS("http://www.w3.org/XML/1998/namespace", "lang").FullKey(), "xml:lang")
+	b.CreateAttrNS("http://www.w3.org/XML/1998/namespace", "lang", "fr")
+	b.CreateAttrNS("", "lang", "z")
+	checkStrEq(t, b.String(), `<b xml:lang="fr" y:lang="undeclared" lang="z"/>`)
+}
+
+func TestLookupAttr(t *testing.T) {
+	doc := newDocumentFromString(t, `<a empty="" v="1" p:k="2" xmlns:p="urn:p"/>`)
+	a := doc.Root()
+
+	cases := []struct {
+		key     string
+		value   string
+		present bool
+	}{
+		{"empty", "", true},
+		{"v", "1", true},
+		{"k", "2", true},
+		{"p:k", "2", true},
+		{"q:k", "", false},
+		{"missing", "", false},
+	}
+	for _, c := range cases {
+		value, present := a.LookupAttr(c.key)
+		if value != c.value || present != c.present {
+			t.Errorf("etree: LookupAttr(%q) = %q, %v, wanted %q, %v", c.key, value, present, c.value, c.present)
+		}
+	}
+}
+
+func TestAttrKeys(t *testing.T) {
+	doc := newDocumentFromString(t, `<root xmlns:p="urn:p" b="1" p:a="2" c="3" a="4"/>`)
+	root := doc.Root()
+	checkStrEq(t, strings.Join(root.AttrKeys(), ","), "xmlns:p,b,p:a,c,a")
+	checkStrEq(t, strings.Join(root.AttrFullKeys(), ","), "{http://www.w3.org/2000/xmlns/}p,b,{urn:p}a,c,a")
+
+	keys := root.AttrKeys()
+	keys[0] = "changed"
+	checkStrEq(t, root.Attr[0].FullKey(), "xmlns:p")
+
+	doc = newDocumentFromString(t, `<root xmlns="urn:d" xml:lang="en" y:q="1"/>`)
+	checkStrEq(t, strings.Join(doc.Root().AttrFullKeys(), ","),
+		"{http://www.w3.org/2000/xmlns/}xmlns,{http://www.w3.org/XML/1998/namespace}lang,y:q")
+
+	if NewElement("x").AttrKeys() != nil || NewElement("x").AttrFullKeys() != nil {
+		t.Error("etree: expected nil keys")
+	}
+}
+
+func TestSelectAttrValuesFromChildren(t *testing.T) {
+	doc := newDocumentFromString(t, `<select><option value="a"/><option/><group value="x"/><option value=""/><option value="b"/></select>`)
+	values := doc.Root().SelectAttrValuesFromChildren("option", "value")
+	checkStrEq(t, strings.Join(values, ","), "a,,b")
+	checkIntEq(t, len(values), 3)
+
+	if values := doc.Root().SelectAttrValuesFromChildren("missing", "value"); values != nil {
+		t.Errorf("etree: expected nil, got %v", values)
+	}
+}
+
+func TestTypedAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<el n=" 42 " neg="-7" bad="4x" yes="Yes" off="0" f="1.5e3" x:t="TRUE"/>`)
+	el := doc.Root()
+
+	checkIntEq(t, el.AttrInt("n", 0), 42)
+	checkIntEq(t, el.AttrInt("neg", 0), -7)
+	checkIntEq(t, el.AttrInt("bad", 5), 5)
+	checkIntEq(t, el.AttrInt("missing", 5), 5)
+	checkBoolEq(t, el.AttrBool("yes", false), true)
+	checkBoolEq(t, el.AttrBool("off", true), false)
+	checkBoolEq(t, el.AttrBool("x:t", false), true)
+	checkBoolEq(t, el.AttrBool("bad", true), true)
+	checkBoolEq(t, el.AttrFloat("f", 0) == 1500, true)
+	checkBoolEq(t, el.AttrFloat("bad", 2.5) == 2.5, true)
+
+	if _, err := el.ParseAttrInt("missing"); err != ErrAttrNotFound {
+		t.Error("etree: ParseAttrInt should return ErrAttrNotFound")
+	}
+	if _, err := el.ParseAttrBool("missing"); err != ErrAttrNotFound {
+		t.Error("etree: ParseAttrBool should return ErrAttrNotFound")
+	}
+	if _, err := el.ParseAttrFloat("missing"); err != ErrAttrNotFound {
+		t.Error("etree: ParseAttrFloat should return ErrAttrNotFound")
+	}
+	_, err := el.ParseAttrInt("bad")
+	checkStrEq(t, fmt.Sprint(err), `etree: attribute bad has invalid integer value "4x"`)
+	_, err = el.ParseAttrBool("n")
+	checkStrEq(t, fmt.Sprint(err), `etree: attribute n has invalid boolean value " 42 "`)
+	_, err = el.ParseAttrFloat("yes")
+	checkStrEq(t, fmt.Sprint(err), `etree: attribute yes has invalid number value "Yes"`)
+}
+
+func TestAttrsByNamespace(t *testing.T) {
+	doc := newDocumentFromString(t, `<a xmlns="urn:d" xmlns:x="urn:x" id="1" x:p="2" y:q="3" x:r="4" class="5"/>`)
+	a := doc.Root()
+
+	groups := a.AttrsByNamespace()
+	checkIntEq(t, len(groups), 4)
+	keys := func(space string) string {
+		var s []string
+		for _, attr := range groups[space] {
+			s = append(s, attr.FullKey()+"="+attr.Value)
+		}
+		return strings.Join(s, " ")
+	}
+	checkStrEq(t, keys(""), "xmlns=urn:d id=1 class=5")
+	checkStrEq(t, keys("xmlns"), "xmlns:x=urn:x")
+	checkStrEq(t, keys("x"), "x:p=2 x:r=4")
+	checkStrEq(t, keys("y"), "y:q=3")
+	checkStrEq(t, groups["x"][0].NamespaceURI(), "urn:x")
+
+	groups["x"][0].Value = "changed"
+	checkStrEq(t, a.SelectAttrValue("x:p", ""), "2")
+
+	if groups := NewElement("b").AttrsByNamespace(); groups != nil {
+		t.Errorf("etree: AttrsByNamespace returned %v for an element without attributes", groups)
+	}
+}
+
+func TestDedupeAttrs(t *testing.T) {
+	doc := newDocumentFromString(t, `<el a="1" p:a="2" b="3"/>`)
+	root := doc.Root()
+	root.Attr = append(root.Attr, root.Attr...)
+	root.Attr = append(root.Attr, Attr{Key: "a", Value: "4"}, Attr{Key: "c", Value: "5"})
+
+	checkBoolEq(t, root.Attr[0].Equal(root.Attr[3]), true)
+	checkBoolEq(t, root.Attr[0].Equal(root.Attr[1]), false)
+	checkBoolEq(t, root.Attr[0].Equal(root.Attr[6]), false)
+
+	conflicts := root.DedupeAttrs()
+	checkIntEq(t, len(conflicts), 1)
+	checkStrEq(t, conflicts[0].Value, "4")
+	checkElementEq(t, conflicts[0].Element(), nil)
+
+	doc.WriteSettings.CanonicalAttrVal = true
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<el a="1" p:a="2" b="3" c="5"/>`)
+
+	checkIntEq(t, len(root.DedupeAttrs()), 0)
+}
+
+func TestCharsetReaderEncoding(t *testing.T) {
+	cases := []string{
+		`<?xml version="1.0" encoding="ISO-8859-1"?><foo></foo>`,
+		`<?xml version="1.0" encoding="UTF-8"?><foo></foo>`,
+		`<?xml version="1.0" encoding="US-ASCII"?><foo></foo>`,
+	}
+
+	for _, c := range cases {
+		doc := NewDocument()
+		if err := doc.ReadFromBytes([]byte(c)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReadValidateEncoding(t *testing.T) {
+	utf16le := []byte{0xFF, 0xFE}
+	for _, r := range `<a>é</a>` {
+		utf16le = append(utf16le, byte(r), byte(r>>8))
+	}
+
+	cases := []struct {
+		input    string
+		encoding string
+		offset   int64 // -1 if valid
+		reason   string
+	}{
+		{"<a>caf\xc3\xa9 \xe2\x9c\x93</a>", "", -1, ""},
+		{"<?xml version='1.0' encoding='UTF-8'?><a><!--caf\xe9--></a>", "", 48, "invalid UTF-8 sequence"},
+		{"<a>caf\xe9</a>", "", 6, "invalid UTF-8 sequence"},
+		{"<a>\xe2\x9c", "", 3, "incomplete UTF-8 sequence"},
+		{"<a>\xe2\x9c</a>", "", 3, "invalid UTF-8 sequence"},
+		{"<?xml version='1.0' encoding='us-ascii'?><a>caf\xc3\xa9</a>", "", 47, "non-ASCII byte"},
+		{"<?xml version='1.0' encoding='ISO-8859-1'?><a>caf\xe9</a>", "", -1, ""},
+		{"\xef\xbb\xbf<?xml version='1.0' encoding='UTF-8'?><a/>", "", -1, ""},
+		{"\xef\xbb\xbf<?xml version='1.0' encoding='ISO-8859-1'?><a/>", "", 0, "UTF-8 byte order mark"},
+		{string(utf16le), "", 0, "UTF-16 byte order mark"},
+		{string(utf16le[2:]), "", 0, "UTF-16 text"},
+		{string(utf16le), "UTF-16", -1, ""},
+		{"<a>caf\xe9</a>", "latin1", -1, ""},
+		{"<?xml version='1.0' encoding='ISO-8859-1'?><a>caf\xe9</a>", "utf-8", 49, "invalid UTF-8 sequence"},
+	}
+	for _, c := range cases {
+		for _, oneByte := range []bool{false, true} {
+			doc := NewDocument()
+			doc.ReadSettings.ValidateEncoding = true
+			doc.ReadSettings.Encoding = c.encoding
+			doc.ReadSettings.CharsetReader = CharsetReader
+			var r io.Reader = strings.NewReader(c.input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			_, err := doc.ReadFrom(r)
+			if c.offset < 0 {
+				if err != nil {
+					t.Errorf("etree: reading %q failed: %v", c.input, err)
+				}
+				continue
+			}
+			encErr, ok := err.(*EncodingError)
+			if !ok {
+				t.Errorf("etree: reading %q returned error %v", c.input, err)
+				continue
+			}
+			checkIntEq(t, int(encErr.Offset), int(c.offset))
+			checkStrEq(t, encErr.Reason, c.reason)
+		}
+	}
+
+	doc := NewDocument()
+	if err := doc.ReadFromString("<a><!--caf\xe9--></a>"); err != nil {
+		t.Error(err)
+	}
+	doc.ReadSettings.ValidateEncoding = true
+	err := doc.ReadFromString("<a><!--caf\xe9--></a>")
+	checkStrEq(t, fmt.Sprint(err), `etree: input does not match encoding "UTF-8" at offset 10: invalid UTF-8 sequence`)
+}
+
+func TestCharData(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateCharData("This ")
+	root.CreateCData("is ")
+	e1 := NewText("a ")
+	e2 := NewCData("text ")
+	root.AddChild(e1)
+	root.AddChild(e2)
+	root.CreateCharData("Element!!")
+
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+
+	checkStrEq(t, s, `<root>This <![CDATA[is ]]>a <![CDATA[text ]]>Element!!</root>`)
+
+	// Check we can parse the output
+	err = doc.ReadFromString(s)
+	if err != nil {
+		t.Fatal("etree: incorrect ReadFromString result")
+	}
+	if doc.Root().Text() != "This is a text Element!!" {
+		t.Error("etree: invalid text")
+	}
+}
+
+func TestIndentSettings(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	ch1 := root.CreateElement("child1")
+	ch1.CreateElement("child2")
+
+	// First test with NoIndent.
+	doc.Indent(NoIndent)
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Error("etree: failed to serialize document")
+	}
+	expected := "<root><child1><child2/></child1></root>"
+	checkStrEq(t, s, expected)
+
+	// Run all indent test cases.
+	tests := []struct {
+		useTabs, useCRLF bool
+		ws, nl           string
+	}{
+		{false, false, " ", "\n"},
+		{false, true, " ", "\r\n"},
+		{true, false, "\t", "\n"},
+		{true, true, "\t", "\r\n"},
+	}
+
+	for _, test := range tests {
+		doc.WriteSettings.UseCRLF = test.useCRLF
+		if test.useTabs {
+			doc.IndentTabs()
+			s, err := doc.WriteToString()
+			if err != nil {
+				t.Error("etree: failed to serialize document")
+			}
+			tab := test.ws
+			expected := "<root>" + test.nl + tab + "<child1>" + test.nl +
+				tab + tab + "<child2/>" + test.nl + tab +
+				"</child1>" + test.nl + "</root>" + test.nl
+			checkStrEq(t, s, expected)
+		} else {
+			for i := 0; i < 256; i++ {
+				doc.Indent(i)
+				s, err := doc.WriteToString()
+				if err != nil {
+					t.Error("etree: failed to serialize document")
+				}
+				tab := strings.Repeat(test.ws, i)
+				expected := "<root>" + test.nl + tab + "<child1>" + test.nl +
+					tab + tab + "<child2/>" + test.nl + tab +
+					"</child1>" + test.nl + "</root>" + test.nl
+				checkStrEq(t, s, expected)
+			}
+		}
+	}
+}
+
+func TestWriteIndentedTo(t *testing.T) {
+	s := `<store><!--c--><book lang="en">
+	<title>Great Expectations</title>   <author>Dickens</author><empty>  </empty></book>text<x/></store>`
+	doc := newDocumentFromString(t, s)
+	original, _ := doc.WriteToString()
+
+	tests := []struct {
+		spaces  int
+		useCRLF bool
+	}{
+		{2, false},
+		{4, true},
+		{0, false},
+		{NoIndent, false},
+	}
+	for _, e := range []*Element{doc.Root(), doc.FindElement("//book")} {
+		for _, test := range tests {
+			settings := newWriteSettings()
+			settings.UseCRLF = test.useCRLF
+
+			var buf strings.Builder
+			n, err := e.WriteIndentedTo(&buf, settings, test.spaces)
+			if err != nil {
+				t.Error("etree: failed to serialize element")
+			}
+			checkIntEq(t, int(n), buf.Len())
+
+			tmp := NewDocument()
+			tmp.WriteSettings = settings
+			tmp.SetRoot(e.Copy())
+			tmp.Indent(test.spaces)
+			expected, _ := tmp.WriteToString()
+			checkStrEq(t, buf.String(), expected)
+		}
+	}
+
+	after, _ := doc.WriteToString()
+	checkStrEq(t, after, original)
+	checkIndexes(t, &doc.Element)
+}
+
+func TestEncodeToken(t *testing.T) {
+	s := `<p:a xmlns:p="urn:p" xmlns="urn:d" p:k="1" xml:lang="en" q:u="2"><b>x &amp; <![CDATA[<y>]]></b><c xmlns=""><!--c--><?pi inst?></c></p:a>`
+	doc := newDocumentFromString(t, s)
+
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	outer := xml.StartElement{Name: xml.Name{Local: "outer"}}
+	if err := enc.EncodeToken(outer); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Root().EncodeToken(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.EncodeToken(outer.End()); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStrEq(t, buf.String(), `<outer><a xmlns="urn:p" xmlns:_="urn:p" _:k="1" xml:lang="en" q:u="2">`+
+		`<b xmlns="urn:d">x &amp; &lt;y&gt;</b><c xmlns=""><!--c--><?pi inst?></c></a></outer>`)
+
+	doc = newDocumentFromString(t, `<!--top--><r/>`)
+	buf.Reset()
+	enc = xml.NewEncoder(&buf)
+	if err := doc.EncodeToken(enc); err != nil {
+		t.Fatal(err)
+	}
+	enc.Flush()
+	checkStrEq(t, buf.String(), `<!--top--><r></r>`)
+}
+
+func TestFromTokens(t *testing.T) {
+	s := `<?xml version="1.0"?><!DOCTYPE r><r xmlns:p="urn:p"><p:a k="&custom;"> text </p:a><!--c--><![CDATA[<d>]]></r>`
+	dec := xml.NewDecoder(strings.NewReader(s))
+	dec.Entity = map[string]string{"custom": "value"}
+	doc, err := FromTokens(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := doc.FindElement("//p:a")
+	if a == nil {
+		t.Fatal("etree: FromTokens did not keep the namespace prefix")
+	}
+	checkStrEq(t, a.SelectAttrValue("k", ""), "value")
+	checkStrEq(t, a.NamespaceURI(), "urn:p")
+	checkStrEq(t, a.Text(), " text ")
+	checkStrEq(t, doc.Root().Child[2].(*CharData).Data, "<d>")
+
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, out, `<?xml version="1.0"?><!DOCTYPE r><r xmlns:p="urn:p"><p:a k="value"> text </p:a><!--c-->&lt;d&gt;</r>`)
+
+	for _, s := range []string{`<a><b></a>`, `<a>`, `</a>`} {
+		dec = xml.NewDecoder(strings.NewReader(s))
+		dec.Strict = false
+		if _, err := FromTokens(dec); err != ErrXML {
+			t.Errorf("etree: FromTokens(%q) returned %v, wanted ErrXML", s, err)
+		}
+	}
+}
+
+func TestStreamTransform(t *testing.T) {
+	s := `<?xml version="1.0"?>
+<people>
+	<person ssn="123" name="Ann"><note>private</note><!--c--></person>
+	<person ssn="456" name="Bob"><note/>x &amp; y</person>
+	<secret><deep/></secret>
+	<old/>
+</people>`
+
+	edit := func(t Token) Token {
+		switch t := t.(type) {
+		case *Element:
+			switch t.Tag {
+			case "person":
+				t.RemoveAttr("ssn")
+			case "note":
+				if t.GetPath() != "/people/person/note" {
+					panic("unexpected path")
+				}
+				t.CreateAttr("redacted", "true")
+				t.CreateText("[removed]")
+			case "secret":
+				return nil
+			case "old":
+				e := NewElement("new")
+				e.CreateElement("child")
+				return e
+			}
+		case *CharData:
+			if t.Parent() != nil && t.Parent().Tag == "note" {
+				return nil
+			}
+		case *Comment:
+			return nil
+		}
+		return t
+	}
+
+	var buf bytes.Buffer
+	err := StreamTransform(strings.NewReader(s), &buf, ReadSettings{}, WriteSettings{}, edit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<?xml version="1.0"?>
+<people>
+	<person name="Ann"><note redacted="true">[removed]</note></person>
+	<person name="Bob"><note redacted="true">[removed]</note>x &amp; y</person>
+	
+	<new><child/></new>
+</people>`
+	checkStrEq(t, buf.String(), expected)
+
+	buf.Reset()
+	err = StreamTransform(strings.NewReader(`<a><b/><c>text</c></a>`), &buf, ReadSettings{}, WriteSettings{CanonicalEndTags: true},
+		func(t Token) Token {
+			if _, ok := t.(*CharData); ok {
+				return nil
+			}
+			return t
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, buf.String(), `<a><b></b><c></c></a>`)
+
+	for _, bad := range []string{`<a><b></a>`, `<a>`, `</a>`, `<a><drop></a>`} {
+		err = StreamTransform(strings.NewReader(bad), ioutil.Discard, ReadSettings{}, WriteSettings{},
+			func(t Token) Token {
+				if e, ok := t.(*Element); ok && e.Tag == "drop" {
+					return nil
+				}
+				return t
+			})
+		if err == nil {
+			t.Errorf("etree: expected an error streaming %q", bad)
+		}
+	}
+
+	identity := func(t Token) Token { return t }
+
+	// Tokens written before an error are flushed, and the end tags of
+	// dropped elements are checked.
+	buf.Reset()
+	err = StreamTransform(strings.NewReader(`<a><b>text</c>`), &buf, ReadSettings{}, WriteSettings{}, identity)
+	checkBoolEq(t, err == ErrXML, true)
+	checkStrEq(t, buf.String(), "<a><b>text")
+	err = StreamTransform(strings.NewReader(`<a><drop><x></y></drop></a>`), ioutil.Discard, ReadSettings{Permissive: true}, WriteSettings{},
+		func(t Token) Token {
+			if e, ok := t.(*Element); ok && e.Tag == "drop" {
+				return nil
+			}
+			return t
+		})
+	checkBoolEq(t, err == ErrXML, true)
+
+	// Unchanged tags are written verbatim.
+	buf.Reset()
+	err = StreamTransform(strings.NewReader(`<a  x='1' ><b y="2"  /><c z="3"></c ><d/></a >`), &buf,
+		ReadSettings{Verbatim: true}, WriteSettings{Verbatim: true},
+		func(t Token) Token {
+			if e, ok := t.(*Element); ok && e.Tag == "c" {
+				e.CreateAttr("z", "4")
+			}
+			if e, ok := t.(*Element); ok && e.Tag == "d" {
+				e.CreateText("t")
+			}
+			return t
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, buf.String(), `<a  x='1' ><b y="2"  /><c z="4"></c><d>t</d></a >`)
+
+	// Expanded namespaces are written with their prefixes, and start tags
+	// are wrapped, as when writing a document.
+	s = "<r xmlns:p=\"urn:p\">\n  <p:e a=\"1\" p:b=\"2\" c=\"3\"/>\n</r>"
+	doc := newDocumentFromString(t, s)
+	doc.WriteSettings.MaxLineWidth = 12
+	want, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBoolEq(t, strings.Count(want, "\n") > 2, true)
+	var spaces []string
+	buf.Reset()
+	err = StreamTransform(strings.NewReader(s), &buf, ReadSettings{ExpandNamespaces: true}, WriteSettings{MaxLineWidth: 12},
+		func(t Token) Token {
+			if e, ok := t.(*Element); ok {
+				spaces = append(spaces, e.Space)
+				if e.Tag == "e" {
+					spaces = append(spaces, e.Attr[1].Space)
+				}
+			}
+			return t
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, strings.Join(spaces, ","), ",urn:p,urn:p")
+	checkStrEq(t, buf.String(), want)
+}
+
+func TestValidate(t *testing.T) {
+	doc := newDocumentFromString(t, `<?xml version="1.0"?><a x="1"><b/><b>text<!--ok--></b></a>`)
+	if errs := doc.Validate(); errs != nil {
+		t.Errorf("etree: Validate reported %v for a valid document", errs)
+	}
+
+	a := doc.Root()
+	b := a.SelectElements("b")[1]
+	b.CreateAttr("ok", "bad\x01value")
+	b.CreateElement("c").Tag = "1c"
+	b.CreateCData("a]]>b")
+	b.CreateComment("a--b")
+	b.CreateComment("ends-")
+	b.CreateProcInst("pi", "a?>b")
+	b.CreateProcInst("", "x")
+	a.CreateText("bad\xffutf8")
+	a.Attr = append(a.Attr, Attr{Key: "bad key", Value: "v"})
+
+	var got []string
+	for _, err := range doc.Validate() {
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Fatalf("etree: Validate returned an error of type %T", err)
+		}
+		if !errors.Is(err, verr.Err) {
+			t.Errorf("etree: errors.Is failed to match %v with %v", err, verr.Err)
+		}
+		got = append(got, verr.Path+" "+strings.TrimPrefix(verr.Err.Error(), "etree: "))
+	}
+	want := []string{
+		`/a invalid XML name`,
+		`/a/b[2] text contains a character not allowed in XML`,
+		`/a/b[2]/1c invalid XML name`,
+		`/a/b[2] CDATA section contains "]]>"`,
+		`/a/b[2] comment contains "--" or ends with "-"`,
+		`/a/b[2] comment contains "--" or ends with "-"`,
+		`/a/b[2] processing instruction contains "?>"`,
+		`/a/b[2] invalid XML name`,
+		`/a text contains a character not allowed in XML`,
+	}
+	checkStrEq(t, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	if errs := doc.Validate(); !errors.Is(errs[0], ErrInvalidName) || errors.Is(errs[0], ErrInvalidChar) {
+		t.Errorf("etree: errors.Is matched %v incorrectly", errs[0])
+	}
+
+	errs := b.Validate()
+	checkIntEq(t, len(errs), 7)
+	checkStrEq(t, errs[0].Error(), "etree: text contains a character not allowed in XML at /a/b[2]")
+}
+
+func TestResolveIncludes(t *testing.T) {
+	files := map[string]string{
+		"chapter1.xml": `<?xml version="1.0"?><chapter n="1"><include href="section.xml"/></chapter>`,
+		"chapter2.xml": `<chapter n="2"/>`,
+		"section.xml":  `<!-- section --><section>text</section>`,
+		"empty.xml":    `<!-- nothing -->`,
+		"a.xml":        `<a><include href="b.xml"/></a>`,
+		"b.xml":        `<b><include href="a.xml"/></b>`,
+	}
+	var loads int
+	loader := func(href string) (*Document, error) {
+		loads++
+		s, ok := files[href]
+		if !ok {
+			return nil, fmt.Errorf("not found: %s", href)
+		}
+		doc := NewDocument()
+		err := doc.ReadFromString(s)
+		return doc, err
+	}
+
+	doc := newDocumentFromString(t, `<book><include href="chapter1.xml"/><x:include href="chapter2.xml"/><include href="section.xml"/></book>`)
+	if err := doc.ResolveIncludes(loader, "include"); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, doc.Root().String(), `<book><chapter n="1"><section>text</section></chapter><chapter n="2"/><section>text</section></book>`)
+	checkIntEq(t, loads, 4)
+	for _, c := range doc.Root().ChildElements() {
+		if c.Parent() != doc.Root() {
+			t.Errorf("etree: included element %s has the wrong parent", c.Tag)
+		}
+	}
+
+	doc = newDocumentFromString(t, `<book><include href="chapter2.xml"/><x:include href="chapter2.xml"/></book>`)
+	if err := doc.ResolveIncludes(loader, "x:include"); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, doc.Root().String(), `<book><include href="chapter2.xml"/><chapter n="2"/></book>`)
+
+	doc = newDocumentFromString(t, `<include href="chapter2.xml"/>`)
+	if err := doc.ResolveIncludes(loader, "include"); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, doc.Root().String(), `<chapter n="2"/>`)
+	checkIntEq(t, len(doc.Child), 1)
+
+	errorCases := []struct {
+		input, err string
+	}{
+		{`<book><include href="a.xml"/></book>`, `etree: include cycle detected at "a.xml"`},
+		{`<book><include href="empty.xml"/></book>`, `etree: included document "empty.xml" has no root element`},
+		{`<book><include href="missing.xml"/></book>`, `not found: missing.xml`},
+		{`<book><include/></book>`, `etree: include element /book/include has no href attribute`},
+	}
+	for _, c := range errorCases {
+		doc := newDocumentFromString(t, c.input)
+		err := doc.ResolveIncludes(loader, "include")
+		if err == nil {
+			t.Errorf("etree: ResolveIncludes(%s) did not fail", c.input)
+			continue
+		}
+		checkStrEq(t, err.Error(), c.err)
+	}
+}
+
+func TestTextDiff(t *testing.T) {
+	a := newDocumentFromString(t, `<r><a x="1" y="2"/><b>t</b><!--c--><c/><d/><e/><f/><g/><h/><i/></r>`)
+	b := newDocumentFromString(t, "<r>\n  <a y='2' x='1'/>\n  <b>u</b>\n  <c/><d/><e/><f/><g/><new/><h/>\n</r>")
+
+	checkStrEq(t, TextDiff(a, a.Copy(), DiffOptions{}), "")
+	checkStrEq(t, TextDiff(a, b, DiffOptions{Context: 1, IgnoreComments: true, NameA: "old.xml", NameB: "new.xml"}),
+		`--- old.xml
++++ new.xml
+@@ -2,3 +2,3 @@
+   <a x="1" y="2"/>
+-  <b>t</b>
++  <b>u</b>
+   <c/>
+@@ -8,4 +8,4 @@
+   <g/>
++  <new/>
+   <h/>
+-  <i/>
+ </r>
+`)
+	checkStrEq(t, TextDiff(a, b, DiffOptions{}),
+		`--- a
++++ b
+@@ -3,2 +3,1 @@
+-  <b>t</b>
+-  <!--c-->
++  <b>u</b>
+@@ -9,0 +9,1 @@
++  <new/>
+@@ -11,1 +10,0 @@
+-  <i/>
+`)
+	checkStrEq(t, TextDiff(NewDocument(), newDocumentFromString(t, "<r/>"), DiffOptions{Context: 3}),
+		"--- a\n+++ b\n@@ -0,0 +1,1 @@\n+<r/>\n")
+	checkStrEq(t, a.FindElement("//a").Attr[0].Key, "x")
 }
 
-func TestCharsetReaderEncoding(t *testing.T) {
-	cases := []string{
-		`<?xml version="1.0" encoding="ISO-8859-1"?><foo></foo>`,
-		`<?xml version="1.0" encoding="UTF-8"?><foo></foo>`,
-		`<?xml version="1.0" encoding="US-ASCII"?><foo></foo>`,
+func TestDiffLines(t *testing.T) {
+	// lcs returns the length of the longest common subsequence of a and b.
+	lcs := func(a, b []string) int {
+		l := make([][]int, len(a)+1)
+		for i := range l {
+			l[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				switch {
+				case a[i] == b[j]:
+					l[i][j] = l[i+1][j+1] + 1
+				case l[i+1][j] > l[i][j+1]:
+					l[i][j] = l[i+1][j]
+				default:
+					l[i][j] = l[i][j+1]
+				}
+			}
+		}
+		return l[0][0]
 	}
 
-	for _, c := range cases {
-		doc := NewDocument()
-		if err := doc.ReadFromBytes([]byte(c)); err != nil {
-			t.Error(err)
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		s := make([]string, r.Intn(12))
+		for i := range s {
+			s[i] = string(rune('a' + r.Intn(3)))
 		}
+		return s
+	}
+	for i := 0; i < 500; i++ {
+		a, b := lines(), lines()
+		var gotA, gotB []string
+		unchanged := 0
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind == ' ' {
+				unchanged++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("etree: diff of %q and %q doesn't reproduce them", a, b)
+		}
+		if want := lcs(a, b); unchanged != want {
+			t.Fatalf("etree: diff of %q and %q keeps %d lines, wanted %d", a, b, unchanged, want)
+		}
+	}
+
+	// Completely different texts must not need memory proportional to the
+	// product of their lengths.
+	a, b := make([]string, 5000), make([]string, 5000)
+	for i := range a {
+		a[i], b[i] = "a"+strconv.Itoa(i), "b"+strconv.Itoa(i)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ops := diffLines(a, b)
+	runtime.ReadMemStats(&after)
+	checkIntEq(t, len(ops), 10000)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Errorf("etree: diff of 5000 lines allocated %d bytes", alloc)
 	}
 }
 
-func TestCharData(t *testing.T) {
-	doc := NewDocument()
-	root := doc.CreateElement("root")
-	root.CreateCharData("This ")
-	root.CreateCData("is ")
-	e1 := NewText("a ")
-	e2 := NewCData("text ")
-	root.AddChild(e1)
-	root.AddChild(e2)
-	root.CreateCharData("Element!!")
+func TestMaxOutputBytes(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b x="1">text</b><c/></a>`)
+	full := doc.String()
+
+	for _, max := range []int64{1, 10, int64(len(full)) - 1} {
+		doc.WriteSettings.MaxOutputBytes = max
+		var buf bytes.Buffer
+		n, err := doc.WriteTo(&buf)
+		if err != ErrOutputLimit {
+			t.Errorf("etree: WriteTo with MaxOutputBytes %d returned error %v", max, err)
+		}
+		checkIntEq(t, int(n), int(max))
+		checkStrEq(t, buf.String(), full[:max])
+
+		if b, err := doc.WriteToBytes(); b != nil || err != ErrOutputLimit {
+			t.Errorf("etree: WriteToBytes with MaxOutputBytes %d returned %q, %v", max, b, err)
+		}
+		if b, err := doc.Minify(); b != nil || err != ErrOutputLimit {
+			t.Errorf("etree: Minify with MaxOutputBytes %d returned %q, %v", max, b, err)
+		}
 
+		buf.Reset()
+		n, err = doc.Root().WriteIndentedTo(&buf, doc.WriteSettings, NoIndent)
+		if err != ErrOutputLimit {
+			t.Errorf("etree: WriteIndentedTo with MaxOutputBytes %d returned error %v", max, err)
+		}
+		checkIntEq(t, int(n), int(max))
+		checkStrEq(t, buf.String(), full[:max])
+	}
+
+	doc.WriteSettings.MaxOutputBytes = int64(len(full))
 	s, err := doc.WriteToString()
 	if err != nil {
-		t.Error("etree: failed to serialize document")
+		t.Fatal(err)
 	}
+	checkStrEq(t, s, full)
 
-	checkStrEq(t, s, `<root>This <![CDATA[is ]]>a <![CDATA[text ]]>Element!!</root>`)
+	doc.WriteSettings.MaxOutputBytes = 1
+	checkStrEq(t, doc.String(), full)
+}
 
-	// Check we can parse the output
-	err = doc.ReadFromString(s)
+func TestMinify(t *testing.T) {
+	s := "<?xml version=\"1.0\"?>\n<!-- c -->\n<a x=\"1\">\n  <b> keep  me </b>\n  <c><![CDATA[  ]]></c>\n  <d>\n  </d>\n</a>\n"
+	doc := newDocumentFromString(t, s)
+
+	b, err := doc.Minify()
 	if err != nil {
-		t.Fatal("etree: incorrect ReadFromString result")
+		t.Fatal(err)
 	}
-	if doc.Root().Text() != "This is a text Element!!" {
-		t.Error("etree: invalid text")
+	checkStrEq(t, string(b), `<?xml version="1.0"?><!-- c --><a x="1"><b> keep  me </b><c><![CDATA[  ]]></c><d/></a>`)
+	checkStrEq(t, doc.String(), s)
+
+	doc.WriteSettings.ChildFilter = func(t Token) bool {
+		_, ok := t.(*Comment)
+		return !ok
+	}
+	doc.WriteSettings.TrailingNewline = true
+	b, err = doc.Minify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, string(b), `<?xml version="1.0"?><a x="1"><b> keep  me </b><c><![CDATA[  ]]></c><d/></a>`)
+
+	tests := []struct {
+		in, want string
+	}{
+		{`<p><b>a</b> <i>b</i></p>`, `<p><b>a</b> <i>b</i></p>`},
+		{"<p>x<b>a</b>\n<i>b</i></p>", "<p>x<b>a</b>\n<i>b</i></p>"},
+		{"<p>\n  <b>a</b>\n  <c><![CDATA[\n]]></c>\n</p>", "<p><b>a</b><c><![CDATA[\n]]></c></p>"},
+	}
+	for _, test := range tests {
+		doc := newDocumentFromString(t, test.in)
+		b, err := doc.Minify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStrEq(t, string(b), test.want)
 	}
 }
 
-func TestIndentSettings(t *testing.T) {
-	doc := NewDocument()
-	root := doc.CreateElement("root")
-	ch1 := root.CreateElement("child1")
-	ch1.CreateElement("child2")
+func TestCharDataSignificant(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><pre xml:space="preserve">   </pre><b>  </b></a>`)
+	pre := doc.FindElement("//pre").Child[0].(*CharData)
+	pre.SetSignificant(true)
+	checkBoolEq(t, pre.IsSignificant(), true)
+	checkBoolEq(t, pre.IsWhitespace(), true)
+	checkBoolEq(t, doc.FindElement("//pre").HasSignificantText(), true)
 
-	// First test with NoIndent.
-	doc.Indent(NoIndent)
-	s, err := doc.WriteToString()
+	doc.Indent(2)
+	checkStrEq(t, doc.Root().String(), "<a>\n  <pre xml:space=\"preserve\">   </pre>\n  <b/>\n</a>")
+
+	var buf bytes.Buffer
+	if _, err := doc.Root().WriteIndentedTo(&buf, doc.WriteSettings, 4); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, buf.String(), "<a>\n    <pre xml:space=\"preserve\">   </pre>\n    <b/>\n</a>\n")
+
+	m, err := doc.Minify()
 	if err != nil {
-		t.Error("etree: failed to serialize document")
+		t.Fatal(err)
 	}
-	expected := "<root><child1><child2/></child1></root>"
-	checkStrEq(t, s, expected)
+	checkStrEq(t, string(m), `<a><pre xml:space="preserve">   </pre><b/></a>`)
+
+	pre.SetData("\t")
+	checkBoolEq(t, pre.IsSignificant(), true)
+	doc.StripIndentation()
+	checkStrEq(t, doc.Root().String(), "<a><pre xml:space=\"preserve\">\t</pre><b/></a>")
+
+	pre.SetSignificant(false)
+	doc.StripIndentation()
+	checkStrEq(t, doc.Root().String(), "<a><pre xml:space=\"preserve\"/><b/></a>")
+}
+
+func TestIndentEmptyElements(t *testing.T) {
+	s := "<a>\n  <b>\n    </b>\n  <c> </c>\n  <d><!--x--></d>\n</a>"
+	doc := newDocumentFromString(t, s)
+	doc.Indent(2)
+	checkStrEq(t, doc.Root().String(), "<a>\n  <b/>\n  <c/>\n  <d>\n    <!--x-->\n  </d>\n</a>")
+
+	doc.Root().FindElement("b").CreateElement("e")
+	doc.Root().FindElement("b").RemoveChildAt(0)
+	doc.WriteSettings.CanonicalEndTags = true
+	doc.IndentTabs()
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, out, "<a>\n\t<b></b>\n\t<c></c>\n\t<d>\n\t\t<!--x-->\n\t</d>\n</a>\n")
+
+	var buf bytes.Buffer
+	if _, err = doc.Root().FindElement("c").WriteIndentedTo(&buf, doc.WriteSettings, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, buf.String(), "<c></c>\n")
+}
+
+func TestIndentComments(t *testing.T) {
+	s := `<?xml version="1.0"?><!--top--><root><!--lead--><a/>text<!--after text--><b><!--only--></b><c/><!--trailing--></root>`
 
-	// Run all indent test cases.
 	tests := []struct {
-		useTabs, useCRLF bool
-		ws, nl           string
+		inline   bool
+		expected string
 	}{
-		{false, false, " ", "\n"},
-		{false, true, " ", "\r\n"},
-		{true, false, "\t", "\n"},
-		{true, true, "\t", "\r\n"},
+		{false, `<?xml version="1.0"?>
+<!--top-->
+<root>
+  <!--lead-->
+  <a/>text
+  <!--after text-->
+  <b>
+    <!--only-->
+  </b>
+  <c/>
+  <!--trailing-->
+</root>
+`},
+		{true, `<?xml version="1.0"?>
+<!--top-->
+<root><!--lead-->
+  <a/>text
+  <!--after text-->
+  <b><!--only--></b>
+  <c/>
+  <!--trailing-->
+</root>
+`},
 	}
 
 	for _, test := range tests {
-		doc.WriteSettings.UseCRLF = test.useCRLF
-		if test.useTabs {
-			doc.IndentTabs()
-			s, err := doc.WriteToString()
-			if err != nil {
-				t.Error("etree: failed to serialize document")
-			}
-			tab := test.ws
-			expected := "<root>" + test.nl + tab + "<child1>" + test.nl +
-				tab + tab + "<child2/>" + test.nl + tab +
-				"</child1>" + test.nl + "</root>" + test.nl
-			checkStrEq(t, s, expected)
-		} else {
-			for i := 0; i < 256; i++ {
-				doc.Indent(i)
-				s, err := doc.WriteToString()
-				if err != nil {
-					t.Error("etree: failed to serialize document")
-				}
-				tab := strings.Repeat(test.ws, i)
-				expected := "<root>" + test.nl + tab + "<child1>" + test.nl +
-					tab + tab + "<child2/>" + test.nl + tab +
-					"</child1>" + test.nl + "</root>" + test.nl
-				checkStrEq(t, s, expected)
-			}
+		doc := newDocumentFromString(t, s)
+		doc.WriteSettings.InlineLeadingComments = test.inline
+		doc.Indent(2)
+		out, err := doc.WriteToString()
+		if err != nil {
+			t.Error("etree: failed to serialize document")
 		}
+		checkStrEq(t, out, test.expected)
+		checkIndexes(t, &doc.Element)
+	}
+}
+
+func TestStripWhitespace(t *testing.T) {
+	s := "<root>\n  <a> text </a>\n  <b><![CDATA[  ]]></b>\n  <c>\n    <d/>\t\n  </c>\n</root>\n"
+	doc := newDocumentFromString(t, s)
+	doc.Root().CreateText("   ")
+
+	doc.StripIndentation()
+	checkIndexes(t, &doc.Element)
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, "<root><a> text </a><b><![CDATA[  ]]></b><c><d/></c></root>")
+
+	doc.Root().SelectElement("b").SetText("")
+	doc.Indent(2)
+	doc.StripIndentation()
+	out, _ = doc.WriteToString()
+	checkStrEq(t, out, "<root><a> text </a><b/><c><d/></c></root>")
+}
+
+func TestCompact(t *testing.T) {
+	doc := newDocumentFromString(t, `<root a="1" b="2"><x/><y><z/><z/><z/></y></root>`)
+	root := doc.Root()
+	y := root.SelectElement("y")
+	for i := 0; i < 20; i++ {
+		y.CreateElement("w")
+	}
+	for len(y.Child) > 3 {
+		y.RemoveChildAt(len(y.Child) - 1)
+	}
+	checkBoolEq(t, cap(y.Child) > len(y.Child), true)
+
+	doc.Compact()
+	for _, e := range []*Element{&doc.Element, root, y} {
+		checkIntEq(t, cap(e.Child), len(e.Child))
+		checkIntEq(t, cap(e.Attr), len(e.Attr))
 	}
+	checkDocEq(t, doc, `<root a="1" b="2"><x/><y><z/><z/><z/></y></root>`)
+	checkIndexes(t, &doc.Element)
 }
 
 func TestTokenIndexing(t *testing.T) {
@@ -907,6 +3474,73 @@ func TestSetText(t *testing.T) {
 	checkIntEq(t, len(root.Child), 1)
 }
 
+func TestSetCDataSplit(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateElement("child")
+
+	root.SetCDataSplit("a]]>b]]>")
+	checkStrEq(t, root.Text(), "a]]>b]]>")
+	checkIntEq(t, len(root.Child), 4)
+	checkIndexes(t, &doc.Element)
+	s, _ := doc.WriteToString()
+	checkStrEq(t, s, `<root><![CDATA[a]]]]><![CDATA[>b]]]]><![CDATA[>]]><child/></root>`)
+
+	doc2 := newDocumentFromString(t, s)
+	checkStrEq(t, doc2.Root().Text(), "a]]>b]]>")
+
+	root.SetCDataSplit("plain")
+	checkIntEq(t, len(root.Child), 2)
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<root><![CDATA[plain]]><child/></root>`)
+
+	root.SetCDataSplit("")
+	checkIntEq(t, len(root.Child), 1)
+}
+
+func TestSubstituteEntities(t *testing.T) {
+	doc := NewDocument()
+	doc.ReadSettings.Permissive = true
+	err := doc.ReadFromString(`<a>&copy; 2024 &foo;<b>&amp;copy; &nbsp;&nbsp;&bogus</b>tail &copy;<![CDATA[&copy;]]></a>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities := map[string]string{
+		"copy": "©",
+		"nbsp": "\u00a0",
+		"foo":  "&bar;",
+		"":     "empty",
+		"a b":  "space",
+	}
+	checkIntEq(t, doc.Root().SubstituteEntities(entities), 6)
+	checkStrEq(t, doc.Root().Text(), "© 2024 &bar;")
+	checkStrEq(t, doc.FindElement("//b").Text(), "© \u00a0\u00a0&bogus")
+	checkStrEq(t, doc.FindElement("//b").Tail(), "tail ©&copy;")
+
+	cd := NewText("&; &a b; & a;")
+	e := NewElement("e")
+	e.AddChild(cd)
+	checkIntEq(t, e.SubstituteEntities(entities), 0)
+	checkStrEq(t, cd.Data, "&; &a b; & a;")
+}
+
+func TestReplaceTextAll(t *testing.T) {
+	s := `<root>{name}<a>Hi {name}, {name}!</a><b><![CDATA[{name}]]></b>{name}<c x="{name}"/></root>`
+	doc := newDocumentFromString(t, s)
+	root := doc.Root()
+
+	checkIntEq(t, root.ReplaceTextAll("{name}", "Bob", false), 4)
+	checkDocEq(t, doc, `<root>Bob<a>Hi Bob, Bob!</a><b><![CDATA[{name}]]></b>Bob<c x="{name}"/></root>`)
+
+	checkIntEq(t, root.ReplaceTextAll("{name}", " ", true), 1)
+	out, _ := doc.WriteToString()
+	checkStrEq(t, out, `<root>Bob<a>Hi Bob, Bob!</a><b><![CDATA[ ]]></b>Bob<c x="{name}"/></root>`)
+	checkBoolEq(t, root.SelectElement("b").Child[0].(*CharData).IsWhitespace(), true)
+
+	checkIntEq(t, root.ReplaceTextAll("", "x", true), 0)
+	checkIntEq(t, root.ReplaceTextAll("missing", "x", true), 0)
+}
+
 func TestSetTail(t *testing.T) {
 	doc := NewDocument()
 	root := doc.CreateElement("root")
@@ -1043,6 +3677,252 @@ func TestDefaultNamespaceURI(t *testing.T) {
 	}
 }
 
+func TestChildren(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/>text<c/><!--d--></a>`)
+	a := doc.Root()
+	children := a.Children()
+	checkIntEq(t, len(children), 4)
+
+	// Removing children while ranging over the copy visits every child.
+	for _, c := range children {
+		a.RemoveChild(c)
+	}
+	checkIntEq(t, len(a.Child), 0)
+	checkIntEq(t, len(children), 4)
+	if _, ok := children[1].(*CharData); !ok {
+		t.Error("etree: Children copy was modified")
+	}
+
+	children[0] = NewElement("x")
+	checkIntEq(t, len(a.Child), 0)
+	if a.Children() != nil {
+		t.Error("etree: Children of an empty element should be nil")
+	}
+}
+
+func TestEnsureChildWithAttr(t *testing.T) {
+	doc := newDocumentFromString(t, `<params><param name="a">1</param><other name="b"/><param name="b">2</param></params>`)
+	params := doc.Root()
+
+	b := params.EnsureChildWithAttr("param", "name", "b")
+	checkStrEq(t, b.Text(), "2")
+	c := params.EnsureChildWithAttr("param", "name", "c")
+	c.SetText("3")
+	if params.EnsureChildWithAttr("param", "name", "c") != c {
+		t.Error("etree: EnsureChildWithAttr created a duplicate element")
+	}
+	params.EnsureChildWithAttr("param", "name", "")
+	checkStrEq(t, params.String(), `<params><param name="a">1</param><other name="b"/><param name="b">2</param><param name="c">3</param><param name=""/></params>`)
+}
+
+func TestEnsurePath(t *testing.T) {
+	doc := newDocumentFromString(t, `<config><server><port>80</port></server></config>`)
+	root := doc.Root()
+
+	server := root.SelectElement("server")
+	if root.EnsureChildElement("server") != server {
+		t.Error("etree: EnsureChildElement created a duplicate element")
+	}
+	client := root.EnsureChildElement("client")
+	if client.Parent() != root || root.SelectElement("client") != client {
+		t.Error("etree: EnsureChildElement failed to create an element")
+	}
+
+	host := root.EnsurePath("server/tls/host")
+	host.SetText("example.com")
+	if root.EnsurePath("/server//tls/host/") != host {
+		t.Error("etree: EnsurePath created a duplicate element")
+	}
+	if root.EnsurePath("") != root {
+		t.Error("etree: EnsurePath with an empty path should return the element")
+	}
+	root.EnsurePath("server/x:port").SetText("443")
+
+	checkDocEq(t, doc, `<config><server><port>80</port><tls><host>example.com</host></tls><x:port>443</x:port></server><client/></config>`)
+	checkIndexes(t, &doc.Element)
+}
+
+func TestSelectElementNS(t *testing.T) {
+	s := `
+<root xmlns="https://default.example.com" xmlns:a="https://a.example.com" xmlns:b="https://a.example.com">
+	<item id="1"/>
+	<a:item id="2"/>
+	<b:item id="3"/>
+	<other xmlns="">
+		<item id="4"/>
+	</other>
+</root>`
+
+	doc := newDocumentFromString(t, s)
+	root := doc.Root()
+
+	// An unprefixed tag matches any prefix.
+	checkIntEq(t, len(root.SelectElements("item")), 3)
+	checkIntEq(t, len(root.SelectElements("a:item")), 1)
+
+	e := root.SelectElementNS("https://default.example.com", "item")
+	checkStrEq(t, e.SelectAttrValue("id", ""), "1")
+	f := root.SelectElementsNS("https://a.example.com", "item")
+	if len(f) != 2 || f[0].SelectAttrValue("id", "") != "2" || f[1].SelectAttrValue("id", "") != "3" {
+		t.Error("etree: failed SelectElementsNS test")
+	}
+
+	other := root.SelectElementNS("https://default.example.com", "other")
+	if other != nil {
+		t.Error("etree: SelectElementNS matched element outside namespace")
+	}
+	other = root.SelectElementNS("", "other")
+	e = other.SelectElementNS("", "item")
+	checkStrEq(t, e.SelectAttrValue("id", ""), "4")
+	if root.SelectElementNS("", "item") != nil {
+		t.Error("etree: SelectElementNS matched namespaced element")
+	}
+}
+
+func TestQName(t *testing.T) {
+	s := `<root xmlns="https://root.example.com" xmlns:p="https://p.example.com"><p:child p:a="1" b="2"/></root>`
+	doc := newDocumentFromString(t, s)
+	root := doc.Root()
+	child := root.SelectElement("child")
+
+	uri, local := root.QName()
+	checkStrEq(t, uri, "https://root.example.com")
+	checkStrEq(t, local, "root")
+	uri, local = child.QName()
+	checkStrEq(t, uri, "https://p.example.com")
+	checkStrEq(t, local, "child")
+
+	uri, local = child.Attr[0].QName()
+	checkStrEq(t, uri, "https://p.example.com")
+	checkStrEq(t, local, "a")
+	uri, local = child.Attr[1].QName()
+	checkStrEq(t, uri, "")
+	checkStrEq(t, local, "b")
+}
+
+func TestEqualNS(t *testing.T) {
+	a := newDocumentFromString(t, `<a:root xmlns:a="urn:a" xmlns:b="urn:b" b:x="1" y="2"><a:child>text</a:child><other xmlns="urn:c"/><!--c--></a:root>`).Root()
+	cases := []struct {
+		xml   string
+		equal bool
+	}{
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:b" y="2" q:x="1"><p:child><![CDATA[text]]></p:child><c:other xmlns:c="urn:c"/><!--c--></p:root>`, true},
+		{`<root xmlns="urn:a" xmlns:q="urn:b" q:x="1" y="2"><child>text</child><other xmlns="urn:c"/><!--c--></root>`, true},
+		{`<p:root xmlns:p="urn:x" xmlns:q="urn:b" q:x="1" y="2"><p:child>text</p:child><other xmlns="urn:c"/><!--c--></p:root>`, false},
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:other" q:x="1" y="2"><p:child>text</p:child><other xmlns="urn:c"/><!--c--></p:root>`, false},
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:b" q:x="1" y="2" z="3"><p:child>text</p:child><other xmlns="urn:c"/><!--c--></p:root>`, false},
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:b" q:x="1" y="2"><p:child>text2</p:child><other xmlns="urn:c"/><!--c--></p:root>`, false},
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:b" q:x="1" y="2"><p:child>text</p:child><other/><!--c--></p:root>`, false},
+		{`<p:root xmlns:p="urn:a" xmlns:q="urn:b" q:x="1" y="2"><p:child>text</p:child><other xmlns="urn:c"/></p:root>`, false},
+	}
+	for i, c := range cases {
+		b := newDocumentFromString(t, c.xml).Root()
+		if a.EqualNS(b) != c.equal || b.EqualNS(a) != c.equal {
+			t.Errorf("etree: EqualNS case %d: expected %v", i, c.equal)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fp := func(s string, opts ...FingerprintOption) []byte {
+		t.Helper()
+		return newDocumentFromString(t, s).Root().Fingerprint(opts...)
+	}
+	base := fp(`<a:r xmlns:a="urn:x" k="1" a:j="2"><b>text</b><c/></a:r>`)
+	checkIntEq(t, len(base), 32)
+
+	same := []string{
+		`<p:r xmlns:p="urn:x" p:j="2" k="1"><b>text</b><c/></p:r>`,
+		"<a:r xmlns:a=\"urn:x\" a:j=\"2\" k=\"1\">\n  <b><![CDATA[te]]>xt</b>\n  <!--note-->\n  <c></c>\n</a:r>",
+	}
+	for _, s := range same {
+		if !bytes.Equal(fp(s), base) {
+			t.Errorf("etree: fingerprint of %s differs", s)
+		}
+	}
+
+	different := []string{
+		`<a:r xmlns:a="urn:y" k="1" a:j="2"><b>text</b><c/></a:r>`,
+		`<a:r xmlns:a="urn:x" k="1" j="2"><b>text</b><c/></a:r>`,
+		`<a:r xmlns:a="urn:x" k="1" a:j="2"><b>text!</b><c/></a:r>`,
+		`<a:r xmlns:a="urn:x" k="1" a:j="2"><b>text<c/></b></a:r>`,
+		`<a:r xmlns:a="urn:x" k="1" a:j="2"><b>tex</b>t<c/></a:r>`,
+	}
+	for _, s := range different {
+		if bytes.Equal(fp(s), base) {
+			t.Errorf("etree: fingerprint of %s unexpectedly matches", s)
+		}
+	}
+
+	s := "<r>\n  <b> two  words </b><!--x--><?p i?>\n</r>"
+	if bytes.Equal(fp(s), fp(s, FingerprintComments)) ||
+		bytes.Equal(fp(s), fp(s, FingerprintProcInsts)) ||
+		bytes.Equal(fp(s), fp(s, FingerprintWhitespace)) {
+		t.Error("etree: fingerprint options had no effect")
+	}
+	if !bytes.Equal(fp(s, FingerprintNormalizeSpace), fp(`<r><b>two words</b></r>`)) {
+		t.Error("etree: FingerprintNormalizeSpace did not normalize text")
+	}
+}
+
+func TestBaseURI(t *testing.T) {
+	s := `<feed xml:base="http://example.com/blog/">
+	<entry xml:base="2024/">
+		<link xml:base="post.html#top"/>
+		<link xml:base="/about/"/>
+		<link xml:base="https://other.org/x"/>
+		<content/>
+	</entry>
+	<entry xml:base="../news/"/>
+	<entry xml:base="%zz"/>
+</feed>`
+	doc := newDocumentFromString(t, s)
+	links := doc.FindElements("//link")
+	checkStrEq(t, links[0].BaseURI(), "http://example.com/blog/2024/post.html#top")
+	checkStrEq(t, links[1].BaseURI(), "http://example.com/about/")
+	checkStrEq(t, links[2].BaseURI(), "https://other.org/x")
+	checkStrEq(t, doc.FindElement("//content").BaseURI(), "http://example.com/blog/2024/")
+
+	entries := doc.FindElements("//entry")
+	checkStrEq(t, entries[1].BaseURI(), "http://example.com/news/")
+	checkStrEq(t, entries[2].BaseURI(), "http://example.com/blog/")
+
+	doc = newDocumentFromString(t, `<a><b xml:base="rel/"><c/></b></a>`)
+	checkStrEq(t, doc.Root().BaseURI(), "")
+	checkStrEq(t, doc.FindElement("//c").BaseURI(), "rel/")
+}
+
+func TestNormalizeNamespaces(t *testing.T) {
+	s := `<root xmlns:x="urn:a" xmlns:x1="urn:c">` +
+		`<x:a/>` +
+		`<part xmlns:x="urn:b"><x:b x:attr="1" xml:lang="en"/></part>` +
+		`<part xmlns:y="urn:a"><y:c y:attr="2"/></part>` +
+		`<x:d xmlns:x="urn:a" xmlns="urn:default"><e/><z:f/></x:d>` +
+		`<x1:g/>` +
+		`</root>`
+	doc := newDocumentFromString(t, s)
+	doc.NormalizeNamespaces()
+
+	expected := `<root xmlns:x="urn:a" xmlns:x1="urn:c">` +
+		`<x:a/>` +
+		`<part xmlns:x2="urn:b"><x2:b x2:attr="1" xml:lang="en"/></part>` +
+		`<part><x:c x:attr="2"/></part>` +
+		`<x:d xmlns="urn:default"><e/><z:f/></x:d>` +
+		`<x1:g/>` +
+		`</root>`
+	checkDocEq(t, doc, expected)
+
+	for _, e := range doc.FindElements("//*") {
+		if e.Space != "" && e.Space != "z" && e.NamespaceURI() == "" {
+			t.Errorf("etree: element %s has an unbound prefix after normalization", e.FullTag())
+		}
+	}
+	uri, _ := doc.FindElement("//b").QName()
+	checkStrEq(t, uri, "urn:b")
+	uri, _ = doc.FindElement("//c").QName()
+	checkStrEq(t, uri, "urn:a")
+}
+
 func TestLocalNamespaceURI(t *testing.T) {
 	s := `
 <a:root xmlns:a="https://root.example.com">
@@ -1155,3 +4035,29 @@ func TestWhitespace(t *testing.T) {
 	cd.SetData("")
 	checkBoolEq(t, cd.IsWhitespace(), true)
 }
+
+func newWideElement(n int) *Element {
+	root := NewElement("root")
+	for i := 0; i < n; i++ {
+		root.CreateElement("item")
+	}
+	root.CreateElement("last")
+	return root
+}
+
+func BenchmarkSelectElementWide(b *testing.B) {
+	root := newWideElement(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root.SelectElement("last")
+	}
+}
+
+func BenchmarkSelectElementWideIndexed(b *testing.B) {
+	root := newWideElement(10000)
+	root.BuildChildIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root.SelectElement("last")
+	}
+}
@@ -5,7 +5,9 @@
 package etree
 
 import (
+	"context"
 	"io"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -99,6 +101,20 @@ func (cr *countReader) Read(p []byte) (n int, err error) {
 	return b, err
 }
 
+// contextReader implements a proxy reader that fails with the context's
+// error once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (n int, err error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
 // countWriter implements a proxy writer that counts the number of
 // bytes written by its encapsulated writer.
 type countWriter struct {
@@ -116,6 +132,169 @@ func (cw *countWriter) Write(p []byte) (n int, err error) {
 	return b, err
 }
 
+// limitWriter implements a proxy writer that passes at most 'remaining'
+// bytes to its encapsulated writer and fails with ErrOutputLimit once more
+// are written.
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+// limitOutput returns a writer that passes at most 'max' bytes to 'w', or
+// 'w' itself if 'max' is not greater than zero.
+func limitOutput(w io.Writer, max int64) io.Writer {
+	if max <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, remaining: max}
+}
+
+func (lw *limitWriter) Write(p []byte) (n int, err error) {
+	if int64(len(p)) <= lw.remaining {
+		n, err = lw.w.Write(p)
+		lw.remaining -= int64(n)
+		return n, err
+	}
+	n, err = lw.w.Write(p[:lw.remaining])
+	lw.remaining -= int64(n)
+	if err == nil {
+		err = ErrOutputLimit
+	}
+	return n, err
+}
+
+// columnWriter implements a proxy XMLWriter that keeps track of the column
+// at which the next character will be written to its encapsulated writer,
+// and of the whitespace that begins the current line.
+type columnWriter struct {
+	w        XMLWriter
+	col      int    // characters written since the last newline
+	indent   []byte // whitespace at the start of the current line
+	blank    bool   // true if only whitespace has been written on the line
+	indented bool   // true if the line was begun by an indentation token
+}
+
+// trackColumns returns a columnWriter encapsulating 'w', or 'w' itself if it
+// is already a columnWriter.
+func trackColumns(w XMLWriter) *columnWriter {
+	if cw, ok := w.(*columnWriter); ok {
+		return cw
+	}
+	return &columnWriter{w: w, blank: true}
+}
+
+func (cw *columnWriter) Write(p []byte) (n int, err error) {
+	for _, c := range p {
+		cw.advance(c)
+	}
+	return cw.w.Write(p)
+}
+
+func (cw *columnWriter) WriteString(s string) (n int, err error) {
+	for i := 0; i < len(s); i++ {
+		cw.advance(s[i])
+	}
+	return cw.w.WriteString(s)
+}
+
+func (cw *columnWriter) WriteByte(c byte) error {
+	cw.advance(c)
+	return cw.w.WriteByte(c)
+}
+
+// columns returns the columnWriter that 'w' writes to, if any.
+func columns(w XMLWriter) (*columnWriter, bool) {
+	if pw, ok := w.(*prefixWriter); ok {
+		w = pw.XMLWriter
+	}
+	cw, ok := w.(*columnWriter)
+	return cw, ok
+}
+
+// advance updates the column and line state for the byte 'c'.
+func (cw *columnWriter) advance(c byte) {
+	switch {
+	case c == '\n':
+		cw.col, cw.indent, cw.blank, cw.indented = 0, cw.indent[:0], true, false
+	case c&0xc0 == 0x80:
+		// UTF-8 continuation bytes don't start a new character.
+	default:
+		cw.col++
+		if cw.blank && (c == ' ' || c == '\t') {
+			cw.indent = append(cw.indent, c)
+		} else {
+			cw.blank = false
+		}
+	}
+}
+
+// prefixWriter implements a proxy XMLWriter that records the namespace
+// prefixes declared in the output for namespace URIs that no in-scope
+// declaration binds, as happens when an element read with
+// ReadSettings.ExpandNamespaces is copied or moved away from the element
+// declaring its namespace.
+type prefixWriter struct {
+	XMLWriter
+	bindings []prefixBinding // the bindings in scope, innermost last
+	next     int             // the number of the last prefix declared
+}
+
+// A prefixBinding binds a prefix declared by a prefixWriter to a namespace
+// URI.
+type prefixBinding struct {
+	prefix, uri string
+}
+
+// withPrefixes returns a prefixWriter encapsulating 'w', or 'w' itself if
+// it is already a prefixWriter.
+func withPrefixes(w XMLWriter) *prefixWriter {
+	if pw, ok := w.(*prefixWriter); ok {
+		return pw
+	}
+	return &prefixWriter{XMLWriter: w}
+}
+
+// prefix returns the prefix bound to the namespace 'uri' for the element
+// 'e', declaring a new prefix of the form "nsN" if no binding is in scope.
+// A binding is out of scope if a declaration of its prefix in the element
+// tree hides it.
+func (pw *prefixWriter) prefix(e *Element, uri string) string {
+	for i := len(pw.bindings) - 1; i >= 0; i-- {
+		if b := pw.bindings[i]; b.uri == uri && e.findLocalNamespaceURI(b.prefix) == "" {
+			return b.prefix
+		}
+	}
+
+	for {
+		pw.next++
+		p := "ns" + strconv.Itoa(pw.next)
+		if e.findLocalNamespaceURI(p) != "" {
+			continue
+		}
+		used := false
+		for _, b := range pw.bindings {
+			used = used || b.prefix == p
+		}
+		if !used {
+			pw.bindings = append(pw.bindings, prefixBinding{prefix: p, uri: uri})
+			return p
+		}
+	}
+}
+
+// writeTo writes the namespace declaration of the binding.
+func (b *prefixBinding) writeTo(w XMLWriter, s *WriteSettings) {
+	w.WriteString("xmlns:" + b.prefix + `="`)
+	s.escape(w, b.uri, true)
+	w.WriteByte('"')
+}
+
+// restore discards the bindings declared after the first 'n', whose scope
+// has ended.
+func (pw *prefixWriter) restore(n int) {
+	pw.bindings = pw.bindings[:n]
+}
+
 // isWhitespace returns true if the byte slice contains only
 // whitespace characters.
 func isWhitespace(s string) bool {
@@ -127,8 +306,49 @@ func isWhitespace(s string) bool {
 	return true
 }
 
+// trimSpace returns the string 's' with leading and trailing XML whitespace
+// removed. If 'collapse' is true, each remaining run of whitespace is also
+// replaced by a single space.
+func trimSpace(s string, collapse bool) string {
+	const ws = " \t\n\r"
+	s = strings.Trim(s, ws)
+	if !collapse || !strings.ContainsAny(s, ws) {
+		return s
+	}
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; strings.IndexByte(ws, c) >= 0 {
+			space = true
+		} else {
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitCData splits a string into pieces that can each be written as a CDATA
+// section, by breaking every occurrence of "]]>" between "]]" and ">".
+func splitCData(s string) []string {
+	parts := strings.Split(s, "]]>")
+	for i := range parts {
+		if i > 0 {
+			parts[i] = ">" + parts[i]
+		}
+		if i < len(parts)-1 {
+			parts[i] += "]]"
+		}
+	}
+	return parts
+}
+
 // spaceMatch returns true if namespace a is the empty string
-// or if namespace a equals namespace b.
+// or if namespace a equals namespace b. An empty namespace prefix in a
+// query therefore acts as a wildcard.
 func spaceMatch(a, b string) bool {
 	switch {
 	case a == "":
@@ -148,6 +368,69 @@ func spaceDecompose(str string) (space, key string) {
 	return str[:colon], str[colon+1:]
 }
 
+// writeCRLF writes the string 's' to the writer, replacing each linefeed
+// that isn't preceded by a carriage return with a carriage return and
+// linefeed.
+func writeCRLF(w XMLWriter, s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' && (i == 0 || s[i-1] != '\r') {
+			w.WriteString(s[last:i])
+			w.WriteString("\r\n")
+			last = i + 1
+		}
+	}
+	w.WriteString(s[last:])
+}
+
+// numericLess reports whether the string 'a' sorts before the string 'b' when
+// sequences of decimal digits are compared by their numeric values and all
+// other bytes are compared individually.
+func numericLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			da, db := digitPrefix(a), digitPrefix(b)
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digitPrefix returns the longest prefix of 's' consisting of decimal digits.
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+// isDigit reports whether the byte is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// spaceJoin joins a namespace prefix and a tag or key into a namespace:tag
+// identifier. If the prefix is empty, the tag is returned unchanged.
+func spaceJoin(space, key string) string {
+	if space == "" {
+		return key
+	}
+	return space + ":" + key
+}
+
 // Strings used by indentCRLF and indentLF
 const (
 	indentSpaces = "\r\n                                                                "
@@ -265,6 +548,217 @@ func escapeString(w XMLWriter, s string, m escapeMode) {
 	w.WriteString(s[last:])
 }
 
+// unescapeRef returns the character represented by the name of a character
+// or predefined entity reference, such as "amp" or "#x41".
+func unescapeRef(name string) (r rune, ok bool) {
+	switch name {
+	case "amp":
+		return '&', true
+	case "lt":
+		return '<', true
+	case "gt":
+		return '>', true
+	case "apos":
+		return '\'', true
+	case "quot":
+		return '"', true
+	}
+
+	if len(name) < 2 || name[0] != '#' {
+		return 0, false
+	}
+	var n uint64
+	var err error
+	if name[1] == 'x' {
+		n, err = strconv.ParseUint(name[2:], 16, 32)
+	} else {
+		n, err = strconv.ParseUint(name[1:], 10, 32)
+	}
+	if err != nil || !isInCharacterRange(rune(n)) {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+// A pseudoAttr is a key="value" pair found in the content of a processing
+// instruction. The quoted value occupies the bytes [start, end) of the
+// content.
+type pseudoAttr struct {
+	key, value string
+	start, end int
+}
+
+// parsePseudoAttrs parses a processing instruction's content as a sequence
+// of pseudo-attributes, stopping at the first malformed one.
+func parsePseudoAttrs(s string) []pseudoAttr {
+	var attrs []pseudoAttr
+	i := 0
+	for {
+		i = skipWhitespace(s, i)
+		start := i
+		for i < len(s) {
+			r, width := utf8.DecodeRuneInString(s[i:])
+			if r == '=' || !isNameChar(r, i == start) {
+				break
+			}
+			i += width
+		}
+		if i == start {
+			return attrs
+		}
+		key := s[start:i]
+
+		i = skipWhitespace(s, i)
+		if i == len(s) || s[i] != '=' {
+			return attrs
+		}
+		i = skipWhitespace(s, i+1)
+		if i == len(s) || (s[i] != '"' && s[i] != '\'') {
+			return attrs
+		}
+		end := strings.IndexByte(s[i+1:], s[i])
+		if end < 0 {
+			return attrs
+		}
+		end += i + 1
+		attrs = append(attrs, pseudoAttr{key, UnescapeText(s[i+1 : end]), i, end + 1})
+		i = end + 1
+	}
+}
+
+// substituteEntities replaces the references in the string 's' to the
+// entities named in 'entities' with their values, as described by
+// Element.SubstituteEntities. It returns the resulting string and the number
+// of references replaced.
+func substituteEntities(s string, entities map[string]string) (string, int) {
+	var b strings.Builder
+	count, last := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '&' {
+			continue
+		}
+		end := strings.IndexByte(s[i+1:], ';')
+		if end < 0 {
+			break
+		}
+		end += i + 1
+		value, ok := entities[s[i+1:end]]
+		if !ok || !isName(s[i+1:end]) {
+			continue
+		}
+		b.WriteString(s[last:i])
+		b.WriteString(value)
+		last = end + 1
+		i = end
+		count++
+	}
+	if count == 0 {
+		return s, 0
+	}
+	b.WriteString(s[last:])
+	return b.String(), count
+}
+
+// isName reports whether the string is a valid XML name, which may contain
+// colons.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !isNameChar(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlDeclAttrs lists the pseudo-attributes of an XML declaration in the
+// order in which they must appear.
+var xmlDeclAttrs = []string{"version", "encoding", "standalone"}
+
+// canonicalXMLDecl returns the content of an XML declaration with the
+// content 's' in the form described by WriteSettings.CanonicalXMLDecl. It
+// returns false if 's' contains anything other than the pseudo-attributes of
+// an XML declaration, each appearing at most once.
+func canonicalXMLDecl(s string) (string, bool) {
+	attrs := parsePseudoAttrs(s)
+	end := 0
+	if len(attrs) > 0 {
+		end = attrs[len(attrs)-1].end
+	}
+	if skipWhitespace(s, end) != len(s) {
+		return "", false
+	}
+
+	values := make(map[string]string)
+	for _, a := range attrs {
+		if _, dup := values[a.key]; dup {
+			return "", false
+		}
+		values[a.key] = a.value
+	}
+
+	var parts []string
+	for _, key := range xmlDeclAttrs {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		delete(values, key)
+		quote := `"`
+		if strings.IndexByte(value, '"') >= 0 {
+			quote = "'"
+		}
+		parts = append(parts, key+"="+quote+value+quote)
+	}
+	if len(values) > 0 {
+		return "", false
+	}
+	return strings.Join(parts, " "), true
+}
+
+// skipWhitespace returns the index of the first non-whitespace character in
+// s at or after index i, or len(s) if there is none.
+func skipWhitespace(s string, i int) int {
+	for i < len(s) && isWhitespace(s[i:i+1]) {
+		i++
+	}
+	return i
+}
+
+// isNCName reports whether the string is a valid XML name containing no
+// colons.
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == ':' || !isNameChar(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNameChar reports whether the rune may appear in an XML name, or at the
+// start of an XML name if 'start' is true.
+func isNameChar(r rune, start bool) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':',
+		r >= 0xC0 && r <= 0xD6, r >= 0xD8 && r <= 0xF6, r >= 0xF8 && r <= 0x2FF,
+		r >= 0x370 && r <= 0x37D, r >= 0x37F && r <= 0x1FFF, r >= 0x200C && r <= 0x200D,
+		r >= 0x2070 && r <= 0x218F, r >= 0x2C00 && r <= 0x2FEF, r >= 0x3001 && r <= 0xD7FF,
+		r >= 0xF900 && r <= 0xFDCF, r >= 0xFDF0 && r <= 0xFFFD, r >= 0x10000 && r <= 0xEFFFF:
+		return true
+	case start:
+		return false
+	default:
+		return r == '-' || r == '.' || r >= '0' && r <= '9' || r == 0xB7 ||
+			r >= 0x300 && r <= 0x36F || r >= 0x203F && r <= 0x2040
+	}
+}
+
 func isInCharacterRange(r rune) bool {
 	return r == 0x09 ||
 		r == 0x0A ||
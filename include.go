@@ -0,0 +1,94 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import "fmt"
+
+// ResolveIncludes replaces each include element in the document with the
+// root element of the document referenced by the include element's href
+// attribute. Include elements are those with the tag 'includeTag', which
+// may include a namespace prefix followed by a colon; the prefix is matched
+// as described for Element.SelectElement. The 'loader' function is called
+// with the href attribute's value to load each referenced document, and
+// include elements within the loaded documents are resolved in turn before
+// their roots are spliced into this document. Other tokens in a loaded
+// document, such as its XML declaration and any comments outside its root
+// element, are discarded.
+//
+// The function returns an error if an include element has no href
+// attribute, if a loaded document has no root element, or if a document
+// includes itself, directly or through other included documents. Errors
+// returned by 'loader' are returned unchanged. The document may be left
+// partially resolved when an error occurs.
+func (d *Document) ResolveIncludes(loader func(href string) (*Document, error), includeTag string) error {
+	r := includeResolver{loader: loader}
+	r.space, r.tag = spaceDecompose(includeTag)
+	return r.resolve(&d.Element)
+}
+
+// An includeResolver holds the state of a ResolveIncludes call. The 'active'
+// list holds the hrefs of the documents currently being resolved, and is
+// used to detect include cycles.
+type includeResolver struct {
+	loader     func(href string) (*Document, error)
+	space, tag string
+	active     []string
+}
+
+// resolve replaces the include elements among the descendants of 'e'.
+func (r *includeResolver) resolve(e *Element) error {
+	for i := 0; i < len(e.Child); i++ {
+		c, ok := e.Child[i].(*Element)
+		if !ok {
+			continue
+		}
+		if c.Tag != r.tag || !spaceMatch(r.space, c.Space) {
+			if err := r.resolve(c); err != nil {
+				return err
+			}
+			continue
+		}
+
+		root, err := r.load(c)
+		if err != nil {
+			return err
+		}
+		e.RemoveChildAt(i)
+		e.InsertChildAt(i, root)
+	}
+	return nil
+}
+
+// load loads the document referenced by the include element 'c', resolves
+// the include elements it contains, and returns its root element.
+func (r *includeResolver) load(c *Element) (*Element, error) {
+	attr := c.SelectAttr("href")
+	if attr == nil {
+		return nil, fmt.Errorf("etree: include element %s has no href attribute", c.GetPath())
+	}
+	href := attr.Value
+	for _, a := range r.active {
+		if a == href {
+			return nil, fmt.Errorf("etree: include cycle detected at %q", href)
+		}
+	}
+
+	doc, err := r.loader(href)
+	if err != nil {
+		return nil, err
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, fmt.Errorf("etree: included document %q has no root element", href)
+	}
+
+	r.active = append(r.active, href)
+	err = r.resolve(&doc.Element)
+	r.active = r.active[:len(r.active)-1]
+	if err != nil {
+		return nil, err
+	}
+	return doc.Root(), nil
+}
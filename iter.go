@@ -0,0 +1,52 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package etree
+
+import "iter"
+
+// Descendants returns an iterator over all elements descending from this
+// element, in document order. The element itself is not included. Elements
+// are visited as the iterator advances, so breaking out of a range loop over
+// the iterator stops the traversal.
+func (e *Element) Descendants() iter.Seq[*Element] {
+	return func(yield func(*Element) bool) {
+		e.walkDescendants(yield)
+	}
+}
+
+// walkDescendants calls the function fn for each descendant element in
+// document order. It stops and returns false as soon as fn returns false.
+func (e *Element) walkDescendants(fn func(e *Element) bool) bool {
+	for _, t := range e.Child {
+		if c, ok := t.(*Element); ok {
+			if !fn(c) || !c.walkDescendants(fn) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FindElementsSeq returns an iterator over the elements matched by the
+// XPath-like 'path' string. The elements are produced in the same order as
+// those returned by FindElements, but without first collecting them into a
+// slice, so breaking out of a range loop over the iterator stops the search.
+// Paths containing the union operator are an exception: they are evaluated
+// completely before the first element is produced. It panics if an invalid
+// path string is supplied.
+func (e *Element) FindElementsSeq(path string) iter.Seq[*Element] {
+	return e.FindElementsPathSeq(compileCachedPath(path))
+}
+
+// FindElementsPathSeq returns an iterator over the elements matched by the
+// 'path' object. See FindElementsSeq.
+func (e *Element) FindElementsPathSeq(path Path) iter.Seq[*Element] {
+	return func(yield func(*Element) bool) {
+		p := newPather()
+		p.visit(e, path, yield)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package etree
+
+import "testing"
+
+func TestDescendants(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b><c/><d/></b>text<e><f/></e></a>`)
+
+	var tags string
+	for e := range doc.Root().Descendants() {
+		tags += e.Tag
+	}
+	checkStrEq(t, tags, "bcdef")
+
+	tags = ""
+	for e := range doc.Descendants() {
+		tags += e.Tag
+		if e.Tag == "d" {
+			break
+		}
+	}
+	checkStrEq(t, tags, "abcd")
+}
+
+func TestFindElementsSeq(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, path := range []string{"//author", "//book[@category='WEB']/title", "//title | //year", "//isbn"} {
+		elements := doc.FindElements(path)
+		var i int
+		for e := range doc.FindElementsSeq(path) {
+			if i >= len(elements) || e != elements[i] {
+				t.Errorf("etree: incorrect FindElementsSeq result for '%s'", path)
+				break
+			}
+			i++
+		}
+		checkIntEq(t, i, len(elements))
+	}
+
+	var n int
+	for range doc.FindElementsSeq("//author") {
+		if n++; n == 2 {
+			break
+		}
+	}
+	checkIntEq(t, n, 2)
+}
@@ -5,8 +5,11 @@
 package etree
 
 import (
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 /*
@@ -31,6 +34,8 @@ The following selectors are supported by etree paths:
     /               Select the root element when used at the start of a path.
     //              Select all descendants of the current element.
     tag             Select all child elements with a name matching the tag.
+    {uri}tag        Select all child elements with the local name tag whose
+                    namespace URI is uri, regardless of namespace prefix.
 
 The following basic filters are supported:
 
@@ -40,6 +45,16 @@ The following basic filters are supported:
     [tag='val']     Keep elements with a child element named tag and text matching val.
     [n]             Keep the n-th element, where n is a numeric index starting from 1.
 
+Filters other than [n] may be combined within a single pair of brackets using
+the 'and' and 'or' keywords, where 'and' takes precedence over 'or', and
+negated using not(). Parentheses are not supported for grouping. A sequence of
+bracketed filters also keeps only the elements matching all of them:
+
+    [f1 and f2]     Keep elements matching both filters f1 and f2.
+    [f1 or f2]      Keep elements matching either filter f1 or f2.
+    [not(f)]        Keep elements not matching filter f, e.g. [not(tag)].
+    [f1][f2]        Keep elements matching filter f1, then filter f2.
+
 The following function-based filters are supported:
 
     [text()]                    Keep elements with non-empty text.
@@ -51,6 +66,10 @@ The following function-based filters are supported:
     [namespace-uri()]           Keep elements with non-empty namespace URIs.
     [namespace-uri()='val']     Keep elements whose namespace URI matches val.
 
+Paths may be combined using the union operator:
+
+    path1 | path2   Keep elements matched by either path, in document order.
+
 Below are some examples of etree path strings.
 
 Select the bookstore child element of the root element:
@@ -80,9 +99,22 @@ Beginning from the current element, select all descendant book elements
 belonging to the http://www.w3.org/TR/html4/ namespace:
     .//book[namespace-uri()='http://www.w3.org/TR/html4/']
 
+Beginning from the current element, select all descendant book elements
+belonging to the http://www.w3.org/TR/html4/ namespace, using the Clark
+notation for the namespace:
+    .//{http://www.w3.org/TR/html4/}book
+
+Beginning from the root element, select all title and heading elements:
+    //title | //heading
+
+Beginning from the current element, select all descendant book elements with
+a 'category' attribute of 'WEB' or 'COOKING' and a 'lang' attribute:
+    .//book[@category='WEB' or @category='COOKING'][@lang]
+
 */
 type Path struct {
 	segments []segment
+	union    [][]segment // additional paths joined with the | operator
 }
 
 // ErrPath is returned by path functions when an invalid etree path is provided.
@@ -97,11 +129,11 @@ func (err ErrPath) Error() string {
 // can be used to query elements in an element tree.
 func CompilePath(path string) (Path, error) {
 	var comp compiler
-	segments := comp.parsePath(path)
+	branches := comp.parseUnion(path)
 	if comp.err != ErrPath("") {
-		return Path{nil}, comp.err
+		return Path{nil, nil}, comp.err
 	}
-	return Path{segments}, nil
+	return Path{branches[0], branches[1:]}, nil
 }
 
 // MustCompilePath creates an optimized version of an XPath-like string that
@@ -116,6 +148,151 @@ func MustCompilePath(path string) Path {
 	return p
 }
 
+// DefaultPathCacheSize is the number of compiled paths kept by the path
+// cache unless it is resized with SetPathCacheSize.
+const DefaultPathCacheSize = 256
+
+// SetPathCacheSize sets the maximum number of compiled paths kept by the
+// cache used by the methods that take a path string, such as FindElement and
+// FindElements, so that calling them repeatedly with the same string doesn't
+// recompile it each time. When the cache is full, the least recently used
+// path is discarded. Pass 0 to disable the cache. The cache is safe for
+// concurrent use, and looking up a cached path takes only a shared lock, so
+// concurrent queries using cached paths don't block each other. Paths
+// compiled with CompilePath are not cached.
+func SetPathCacheSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	pathCache.mu.Lock()
+	defer pathCache.mu.Unlock()
+	pathCache.size = n
+	for len(pathCache.items) > n {
+		pathCache.removeOldest()
+	}
+}
+
+// pathCache is the cache of compiled paths used by compileCachedPath.
+var pathCache = &pathLRU{
+	size:  DefaultPathCacheSize,
+	items: make(map[string]*pathEntry),
+}
+
+// A pathLRU is a cache of compiled paths that discards the least recently
+// used path when it is full. Each entry records the value of the cache's
+// clock when it was last used. Lookups update the clock and the entries
+// atomically while holding a read lock, so only adding and removing entries
+// requires the write lock.
+type pathLRU struct {
+	clock uint64 // accessed atomically; first for 64-bit alignment
+	mu    sync.RWMutex
+	size  int
+	items map[string]*pathEntry
+}
+
+type pathEntry struct {
+	used uint64 // accessed atomically; first for 64-bit alignment
+	path Path
+}
+
+// touch marks the entry as the most recently used one.
+func (c *pathLRU) touch(e *pathEntry) {
+	atomic.StoreUint64(&e.used, atomic.AddUint64(&c.clock, 1))
+}
+
+// removeOldest discards the least recently used path. The cache must be
+// locked for writing.
+func (c *pathLRU) removeOldest() {
+	var oldest string
+	var min uint64
+	first := true
+	for source, e := range c.items {
+		if used := atomic.LoadUint64(&e.used); first || used < min {
+			oldest, min, first = source, used, false
+		}
+	}
+	delete(c.items, oldest)
+}
+
+// compileCachedPath returns the compiled form of the path string 'path' from
+// the path cache, compiling and caching it first if necessary. Like
+// MustCompilePath, it panics if the path is invalid.
+func compileCachedPath(path string) Path {
+	p, err := tryCompileCachedPath(path)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// tryCompileCachedPath is like compileCachedPath, but returns an error
+// instead of panicking if the path is invalid. Invalid paths are not cached.
+func tryCompileCachedPath(path string) (Path, error) {
+	c := pathCache
+	c.mu.RLock()
+	e, ok := c.items[path]
+	if ok {
+		c.touch(e)
+	}
+	size := c.size
+	c.mu.RUnlock()
+	if ok {
+		return e.path, nil
+	}
+
+	p, err := CompilePath(path)
+	if err != nil || size == 0 {
+		return p, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[path]; !ok && c.size > 0 {
+		if len(c.items) >= c.size {
+			c.removeOldest()
+		}
+		e := &pathEntry{path: p}
+		c.touch(e)
+		c.items[path] = e
+	}
+	return p, nil
+}
+
+// PathFeatures describes the features used by a compiled path. See
+// Path.Features.
+type PathFeatures struct {
+	UsesDescendant bool // the path contains a // selector
+	UsesPredicates bool // the path contains at least one [filter]
+	UsesPositional bool // the path contains a positional [n] filter
+	UsesUnion      bool // the path contains the | operator
+	MaxDepth       int  // the largest number of segments in a union branch
+}
+
+// Features reports which selectors and filters the path uses, so that
+// callers can decide whether to run a query, for example one supplied by a
+// user, before performing a potentially expensive traversal. The leading "/"
+// of an absolute path counts as a segment, as does each "//" selector.
+func (path Path) Features() PathFeatures {
+	f := PathFeatures{UsesUnion: len(path.union) > 0}
+	for _, segments := range append([][]segment{path.segments}, path.union...) {
+		if len(segments) > f.MaxDepth {
+			f.MaxDepth = len(segments)
+		}
+		for _, seg := range segments {
+			if _, ok := seg.sel.(*selectDescendants); ok {
+				f.UsesDescendant = true
+			}
+			for _, filt := range seg.filters {
+				f.UsesPredicates = true
+				if _, ok := filt.(*filterPos); ok {
+					f.UsesPositional = true
+				}
+			}
+		}
+	}
+	return f
+}
+
 // A segment is a portion of a path between "/" characters.
 // It contains one selector and zero or more [filters].
 type segment struct {
@@ -150,7 +327,10 @@ type pather struct {
 	results    []*Element
 	inResults  map[*Element]bool
 	candidates []*Element
-	scratch    []*Element // used by filters
+	scratch    []*Element            // used by filters
+	countOnly  bool                  // track matches in inResults without collecting them
+	yield      func(e *Element) bool // if set, called for each match instead
+	stopped    bool                  // set when yield returns false
 }
 
 // A node represents an element and the remaining path segments that
@@ -173,12 +353,65 @@ func newPather() *pather {
 // and then returning all elements that match the path's selectors
 // and filters.
 func (p *pather) traverse(e *Element, path Path) []*Element {
-	for p.queue.add(node{e, path.segments}); p.queue.len() > 0; {
+	for p.queue.add(node{e, path.segments}); p.queue.len() > 0 && !p.stopped; {
 		p.eval(p.queue.remove().(node))
 	}
+	if len(path.union) > 0 {
+		for _, segments := range path.union {
+			for p.queue.add(node{e, segments}); p.queue.len() > 0; {
+				p.eval(p.queue.remove().(node))
+			}
+		}
+		if !p.countOnly {
+			sortDocumentOrder(p.results)
+		}
+	}
 	return p.results
 }
 
+// visit calls the function fn for each element matched by the path,
+// stopping as soon as fn returns false. Elements are visited in the same
+// order in which traverse returns them. Paths containing union operators are
+// fully evaluated before the first element is visited, since their results
+// must be sorted into document order.
+func (p *pather) visit(e *Element, path Path, fn func(e *Element) bool) {
+	if len(path.union) > 0 {
+		for _, c := range p.traverse(e, path) {
+			if !fn(c) {
+				return
+			}
+		}
+		return
+	}
+	p.yield = fn
+	p.traverse(e, path)
+}
+
+// sortDocumentOrder sorts a list of elements into the order in which they
+// appear in their document.
+func sortDocumentOrder(elements []*Element) {
+	keys := make(map[*Element][]int, len(elements))
+	for _, e := range elements {
+		var key []int
+		for seg := e; seg.parent != nil; seg = seg.parent {
+			key = append(key, seg.index)
+		}
+		for i, j := 0, len(key)-1; i < j; i, j = i+1, j-1 {
+			key[i], key[j] = key[j], key[i]
+		}
+		keys[e] = key
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		a, b := keys[elements[i]], keys[elements[j]]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+}
+
 // eval evalutes the current path node by applying the remaining
 // path's selector rules against the node's element.
 func (p *pather) eval(n node) {
@@ -190,7 +423,15 @@ func (p *pather) eval(n node) {
 		for _, c := range p.candidates {
 			if in := p.inResults[c]; !in {
 				p.inResults[c] = true
-				p.results = append(p.results, c)
+				switch {
+				case p.yield != nil:
+					if !p.yield(c) {
+						p.stopped = true
+						return
+					}
+				case !p.countOnly:
+					p.results = append(p.results, c)
+				}
 			}
 		}
 	} else {
@@ -205,6 +446,53 @@ type compiler struct {
 	err ErrPath
 }
 
+// parseUnion splits a path string at each top-level | operator and parses
+// each of the resulting paths. It always returns at least one path.
+func (c *compiler) parseUnion(path string) [][]segment {
+	parts := splitUnion(path)
+	if len(parts) == 1 {
+		// Without a union operator, the path is parsed as it is.
+		return [][]segment{c.parsePath(path)}
+	}
+
+	var branches [][]segment
+	for _, s := range parts {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			c.err = ErrPath("path contains an empty union expression.")
+			return [][]segment{nil}
+		}
+		branches = append(branches, c.parsePath(s))
+		if c.err != ErrPath("") {
+			break
+		}
+	}
+	return branches
+}
+
+// splitUnion splits a path string at each | character that is not enclosed
+// by quotes or [brackets].
+func splitUnion(path string) []string {
+	var pieces []string
+	start, depth := 0, 0
+	inquote := false
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\'':
+			inquote = !inquote
+		case inquote:
+		case path[i] == '[' || path[i] == '{':
+			depth++
+		case path[i] == ']' || path[i] == '}':
+			depth--
+		case path[i] == '|' && depth == 0:
+			pieces = append(pieces, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(pieces, path[start:])
+}
+
 // parsePath parses an XPath-like string describing a path
 // through an element tree and returns a slice of segment
 // descriptors.
@@ -235,11 +523,17 @@ func (c *compiler) parsePath(path string) []segment {
 func splitPath(path string) []string {
 	var pieces []string
 	start := 0
-	inquote := false
+	inquote, inbrace := false, false
 	for i := 0; i+1 <= len(path); i++ {
-		if path[i] == '\'' {
+		switch {
+		case path[i] == '\'' && !inbrace:
 			inquote = !inquote
-		} else if path[i] == '/' && !inquote {
+		case inquote:
+		case path[i] == '{':
+			inbrace = true
+		case path[i] == '}':
+			inbrace = false
+		case path[i] == '/' && !inbrace:
 			pieces = append(pieces, path[start:i])
 			start = i + 1
 		}
@@ -249,14 +543,22 @@ func splitPath(path string) []string {
 
 // parseSegment parses a path segment between / characters.
 func (c *compiler) parseSegment(path string) segment {
+	// Don't split a namespace URI in Clark notation at its [ characters.
+	uri := ""
+	if strings.HasPrefix(path, "{") {
+		if end := strings.IndexByte(path, '}'); end >= 0 {
+			uri, path = path[:end+1], path[end+1:]
+		}
+	}
 	pieces := strings.Split(path, "[")
+	pieces[0] = uri + pieces[0]
 	seg := segment{
 		sel:     c.parseSelector(pieces[0]),
 		filters: []filter{},
 	}
 	for i := 1; i < len(pieces); i++ {
 		fpath := pieces[i]
-		if fpath[len(fpath)-1] != ']' {
+		if fpath == "" || fpath[len(fpath)-1] != ']' {
 			c.err = ErrPath("path has invalid filter [brackets].")
 			break
 		}
@@ -277,6 +579,14 @@ func (c *compiler) parseSelector(path string) selector {
 	case "":
 		return new(selectDescendants)
 	default:
+		if strings.HasPrefix(path, "{") {
+			end := strings.IndexByte(path, '}')
+			if end < 0 || end == len(path)-1 {
+				c.err = ErrPath("path has an invalid {namespace-uri}tag selector.")
+				return nil
+			}
+			return newSelectChildrenByURI(path[1:end], path[end+1:])
+		}
 		return newSelectChildrenByTag(path)
 	}
 }
@@ -296,6 +606,27 @@ func (c *compiler) parseFilter(path string) filter {
 		return nil
 	}
 
+	// Filter contains a boolean expression?
+	if terms := splitFilter(path, " or "); len(terms) > 1 {
+		return newFilterOr(c.parseFilterTerms(terms))
+	}
+	if terms := splitFilter(path, " and "); len(terms) > 1 {
+		return newFilterAnd(c.parseFilterTerms(terms))
+	}
+
+	// Filter contains [not(f)]?
+	if strings.HasPrefix(path, "not(") && strings.HasSuffix(path, ")") {
+		f := c.parseFilter(strings.TrimSpace(path[4 : len(path)-1]))
+		if c.err != ErrPath("") {
+			return nil
+		}
+		if _, ok := f.(*filterPos); ok {
+			c.err = ErrPath("path has a positional filter in a boolean expression.")
+			return nil
+		}
+		return newFilterNot(f)
+	}
+
 	// Filter contains [@attr='val'], [fn()='val'], or [tag='val']?
 	eqindex := strings.Index(path, "='")
 	if eqindex >= 0 {
@@ -314,7 +645,7 @@ func (c *compiler) parseFilter(path string) filter {
 		case strings.HasSuffix(key, "()"):
 			name := key[:len(key)-2]
 			if fn, ok := fnTable[name]; ok {
-				return newFilterFuncVal(fn, value)
+				return newFilterFuncVal(name, fn, value)
 			}
 			c.err = ErrPath("path has unknown function " + name)
 			return nil
@@ -330,7 +661,7 @@ func (c *compiler) parseFilter(path string) filter {
 	case strings.HasSuffix(path, "()"):
 		name := path[:len(path)-2]
 		if fn, ok := fnTable[name]; ok {
-			return newFilterFunc(fn)
+			return newFilterFunc(name, fn)
 		}
 		c.err = ErrPath("path has unknown function " + name)
 		return nil
@@ -347,6 +678,47 @@ func (c *compiler) parseFilter(path string) filter {
 	}
 }
 
+// splitFilter splits a filter expression at each occurrence of the boolean
+// operator 'op' that is not enclosed by quotes or parentheses.
+func splitFilter(path, op string) []string {
+	var terms []string
+	start := 0
+	inquote, depth := false, 0
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\'':
+			inquote = !inquote
+		case inquote:
+		case path[i] == '(':
+			depth++
+		case path[i] == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(path[i:], op):
+			terms = append(terms, path[start:i])
+			start = i + len(op)
+			i = start - 1
+		}
+	}
+	return append(terms, path[start:])
+}
+
+// parseFilterTerms parses the operands of a boolean filter expression.
+func (c *compiler) parseFilterTerms(terms []string) []filter {
+	filters := make([]filter, 0, len(terms))
+	for _, t := range terms {
+		f := c.parseFilter(strings.TrimSpace(t))
+		if c.err != ErrPath("") {
+			return nil
+		}
+		if _, ok := f.(*filterPos); ok {
+			c.err = ErrPath("path has a positional filter in a boolean expression.")
+			return nil
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
+
 // selectSelf selects the current element into the candidate list.
 type selectSelf struct{}
 
@@ -404,19 +776,35 @@ func (s *selectDescendants) apply(e *Element, p *pather) {
 }
 
 // selectChildrenByTag selects into the candidate list all child
-// elements of the element having the specified tag.
+// elements of the element having the specified tag. If 'byURI' is set, the
+// elements must instead have the specified local name, or any local name if
+// the tag is "*", and namespace URI.
 type selectChildrenByTag struct {
 	space, tag string
+	uri        string
+	byURI      bool
 }
 
 func newSelectChildrenByTag(path string) *selectChildrenByTag {
 	s, l := spaceDecompose(path)
-	return &selectChildrenByTag{s, l}
+	return &selectChildrenByTag{space: s, tag: l}
+}
+
+func newSelectChildrenByURI(uri, tag string) *selectChildrenByTag {
+	return &selectChildrenByTag{tag: tag, uri: uri, byURI: true}
+}
+
+// matches reports whether the element c is selected by the selector.
+func (s *selectChildrenByTag) matches(c *Element) bool {
+	if s.byURI {
+		return (s.tag == "*" || s.tag == c.Tag) && s.uri == c.NamespaceURI()
+	}
+	return spaceMatch(s.space, c.Space) && s.tag == c.Tag
 }
 
 func (s *selectChildrenByTag) apply(e *Element, p *pather) {
 	for _, c := range e.Child {
-		if c, ok := c.(*Element); ok && spaceMatch(s.space, c.Space) && s.tag == c.Tag {
+		if c, ok := c.(*Element); ok && s.matches(c) {
 			p.candidates = append(p.candidates, c)
 		}
 	}
@@ -494,11 +882,12 @@ func (f *filterAttrVal) apply(p *pather) {
 // filterFunc filters the candidate list for elements satisfying a custom
 // boolean function.
 type filterFunc struct {
-	fn func(e *Element) string
+	name string
+	fn   func(e *Element) string
 }
 
-func newFilterFunc(fn func(e *Element) string) *filterFunc {
-	return &filterFunc{fn}
+func newFilterFunc(name string, fn func(e *Element) string) *filterFunc {
+	return &filterFunc{name, fn}
 }
 
 func (f *filterFunc) apply(p *pather) {
@@ -513,12 +902,13 @@ func (f *filterFunc) apply(p *pather) {
 // filterFuncVal filters the candidate list for elements containing a value
 // matching the result of a custom function.
 type filterFuncVal struct {
-	fn  func(e *Element) string
-	val string
+	name string
+	fn   func(e *Element) string
+	val  string
 }
 
-func newFilterFuncVal(fn func(e *Element) string, value string) *filterFuncVal {
-	return &filterFuncVal{fn, value}
+func newFilterFuncVal(name string, fn func(e *Element) string, value string) *filterFuncVal {
+	return &filterFuncVal{name, fn, value}
 }
 
 func (f *filterFuncVal) apply(p *pather) {
@@ -578,3 +968,176 @@ func (f *filterChildText) apply(p *pather) {
 	}
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
+
+// filterAnd filters the candidate list for elements matching all of a
+// list of filters.
+type filterAnd struct {
+	filters []filter
+}
+
+func newFilterAnd(filters []filter) *filterAnd {
+	return &filterAnd{filters}
+}
+
+func (f *filterAnd) apply(p *pather) {
+	for _, ff := range f.filters {
+		if len(p.candidates) == 0 {
+			return
+		}
+		ff.apply(p)
+	}
+}
+
+// filterOr filters the candidate list for elements matching any of a list
+// of filters.
+type filterOr struct {
+	filters []filter
+}
+
+func newFilterOr(filters []filter) *filterOr {
+	return &filterOr{filters}
+}
+
+func (f *filterOr) apply(p *pather) {
+	all := append([]*Element(nil), p.candidates...)
+	keep := make(map[*Element]bool)
+	for _, ff := range f.filters {
+		if len(keep) == len(all) {
+			break
+		}
+		p.candidates = append(p.candidates[0:0], all...)
+		ff.apply(p)
+		for _, c := range p.candidates {
+			keep[c] = true
+		}
+	}
+	p.candidates = p.candidates[0:0]
+	for _, c := range all {
+		if keep[c] {
+			p.candidates = append(p.candidates, c)
+		}
+	}
+}
+
+// filterNot filters the candidate list for elements not matching a filter.
+type filterNot struct {
+	filter filter
+}
+
+func newFilterNot(f filter) *filterNot {
+	return &filterNot{f}
+}
+
+func (f *filterNot) apply(p *pather) {
+	all := append([]*Element(nil), p.candidates...)
+	f.filter.apply(p)
+	matched := make(map[*Element]bool, len(p.candidates))
+	for _, c := range p.candidates {
+		matched[c] = true
+	}
+	p.candidates = p.candidates[0:0]
+	for _, c := range all {
+		if !matched[c] {
+			p.candidates = append(p.candidates, c)
+		}
+	}
+}
+
+// checkStream returns an error if the path cannot be used to match elements
+// as they are read from a stream, before their contents are known. Such
+// paths may contain only those selectors and filters that depend solely on
+// an element's ancestors, tag and attributes.
+func (path Path) checkStream() error {
+	if len(path.union) > 0 {
+		return ErrPath("path has a union operator that cannot be streamed.")
+	}
+	for _, seg := range path.segments {
+		switch seg.sel.(type) {
+		case *selectSelf, *selectRoot, *selectChildren, *selectDescendants, *selectChildrenByTag:
+		default:
+			return ErrPath("path has a selector that cannot be streamed.")
+		}
+		for _, f := range seg.filters {
+			if err := checkStreamFilter(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkStreamFilter returns an error if the filter cannot be applied to an
+// element before its contents are known.
+func checkStreamFilter(f filter) error {
+	switch f := f.(type) {
+	case *filterAttr, *filterAttrVal:
+	case *filterFunc:
+		if f.name == "text" {
+			return ErrPath("path has a function that cannot be streamed.")
+		}
+	case *filterFuncVal:
+		if f.name == "text" {
+			return ErrPath("path has a function that cannot be streamed.")
+		}
+	case *filterAnd:
+		for _, ff := range f.filters {
+			if err := checkStreamFilter(ff); err != nil {
+				return err
+			}
+		}
+	case *filterOr:
+		for _, ff := range f.filters {
+			if err := checkStreamFilter(ff); err != nil {
+				return err
+			}
+		}
+	case *filterNot:
+		return checkStreamFilter(f.filter)
+	default:
+		return ErrPath("path has a filter that cannot be streamed.")
+	}
+	return nil
+}
+
+// matchStream reports whether the remaining path segments match the
+// elements of the stack following the context element at stack[i]. The stack
+// holds the path's context element followed by each of the candidate
+// element's ancestors, in order, ending with the candidate element itself.
+func (p *pather) matchStream(stack []*Element, i int, segments []segment) bool {
+	if len(segments) == 0 {
+		return i == len(stack)-1
+	}
+	seg, remain := segments[0], segments[1:]
+	switch sel := seg.sel.(type) {
+	case *selectSelf:
+		return p.filterStream(stack[i], seg) && p.matchStream(stack, i, remain)
+	case *selectRoot:
+		return p.filterStream(stack[0], seg) && p.matchStream(stack, 0, remain)
+	case *selectDescendants:
+		for j := i; j < len(stack); j++ {
+			if p.filterStream(stack[j], seg) && p.matchStream(stack, j, remain) {
+				return true
+			}
+		}
+		return false
+	case *selectChildrenByTag:
+		if i+1 == len(stack) {
+			return false
+		}
+		c := stack[i+1]
+		return sel.matches(c) && p.filterStream(c, seg) && p.matchStream(stack, i+1, remain)
+	default:
+		return i+1 < len(stack) &&
+			p.filterStream(stack[i+1], seg) && p.matchStream(stack, i+1, remain)
+	}
+}
+
+// filterStream reports whether the element e passes all of the segment's
+// filters.
+func (p *pather) filterStream(e *Element, seg segment) bool {
+	p.candidates = append(p.candidates[0:0], e)
+	for _, f := range seg.filters {
+		f.apply(p)
+	}
+	return len(p.candidates) == 1
+}
@@ -4,7 +4,11 @@
 
 package etree
 
-import "testing"
+import (
+	"strings"
+	"sync"
+	"testing"
+)
 
 var testXML = `
 <?xml version="1.0" encoding="UTF-8"?>
@@ -125,6 +129,26 @@ var tests = []test{
 	{"//p:price[@p:tax]", []string{"29.99"}},
 	{"//p:price[@tax]", []string{"29.99"}},
 
+	// boolean filter queries
+	{"./bookstore/book[@category='WEB' and @path]/title", "Learning XML"},
+	{"./bookstore/book[@category='COOKING' or @category='CHILDREN']/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"./bookstore/book[@category='CHILDREN' or @category='COOKING']/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"./bookstore/book[@category='WEB' and author='Kurt Cagle' or year='2005']/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start"}},
+	{"./bookstore/book[@category='WEB' and year='2005']/title", nil},
+	{"//title[@lang='en' and @sku='150' and text()='Harry Potter']", "Harry Potter"},
+	{"//title[text()='a and b' or @sku='150']", "Harry Potter"},
+	{"//book[editor or p:price][@category='WEB']/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[editor and p:price][@category='WEB']/title", nil},
+	{"//book[@category='WEB' or @category='WEB']/title", []string{"XQuery Kick Start", "Learning XML"}},
+
+	// child existence and negation queries
+	{"//book[not(editor)]/title", "Learning XML"},
+	{"//book[editor and not(p:price)]/title", "XQuery Kick Start"},
+	{"//book[not(@category='WEB') and year]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[not(editor or p:price)]/title", nil},
+	{"//book[not(not(editor))][@category='WEB']/title", "XQuery Kick Start"},
+	{"//title[not(text()='a or b')][@sku]", "Harry Potter"},
+
 	// parent queries
 	{"./bookstore/book[@category='COOKING']/title/../../book[4]/title", "Learning XML"},
 
@@ -140,11 +164,30 @@ var tests = []test{
 	{"/bookstore/book[-4]/title", "Everyday Italian"},
 	{"/bookstore/book[-5]/title", nil},
 
+	// union queries
+	{"//book[1]/title | //book[1]/year", []string{"Everyday Italian", "2005"}},
+	{"//book[1]/year|//book[1]/title", []string{"Everyday Italian", "2005"}},
+	{"//book[4]/title | //book[1]/title", []string{"Everyday Italian", "Learning XML"}},
+	{"//p:price | //price", []string{"30.00", "29.99", "49.99", "39.95"}},
+	{"//title[@sku='150'] | //book[@category='CHILDREN']/title", "Harry Potter"},
+	{"//book[@path='/books/xml']/title | //isbn", "Learning XML"},
+	{"//isbn | //book[title='a|b']", nil},
+
 	// bad paths
+	{"//title | ", errorResult("etree: path contains an empty union expression.")},
+	{"| //title", errorResult("etree: path contains an empty union expression.")},
 	{"./bookstore/book[]", errorResult("etree: path contains an empty filter expression.")},
 	{"./bookstore/book[@category='WEB'", errorResult("etree: path has invalid filter [brackets].")},
 	{"./bookstore/book[@category='WEB]", errorResult("etree: path has mismatched filter quotes.")},
 	{"./bookstore/book[author]a", errorResult("etree: path has invalid filter [brackets].")},
+	{"./bookstore/book[", errorResult("etree: path has invalid filter [brackets].")},
+	{"./bookstore/book[@category='WEB' and ]", errorResult("etree: path contains an empty filter expression.")},
+	{"./bookstore/book[1 or @category='WEB']", errorResult("etree: path has a positional filter in a boolean expression.")},
+	{"./bookstore/book[not(1)]", errorResult("etree: path has a positional filter in a boolean expression.")},
+	{"./bookstore/book[not()]", errorResult("etree: path contains an empty filter expression.")},
+	{"./bookstore/book[@category='WEB' or foo()]", errorResult("etree: path has unknown function foo")},
+	{"//{urn:books-com:prices", errorResult("etree: path has an invalid {namespace-uri}tag selector.")},
+	{"//{urn:books-com:prices}", errorResult("etree: path has an invalid {namespace-uri}tag selector.")},
 }
 
 func TestPath(t *testing.T) {
@@ -166,6 +209,9 @@ func TestPath(t *testing.T) {
 		// Test both FindElementsPath and FindElementPath
 		element := doc.FindElementPath(path)
 		elements := doc.FindElementsPath(path)
+		if doc.CountElementsPath(path) != len(elements) {
+			fail(t, test)
+		}
 
 		switch s := test.result.(type) {
 		case errorResult:
@@ -200,6 +246,273 @@ func fail(t *testing.T, test test) {
 	t.Errorf("etree: failed test '%s'\n", test.path)
 }
 
+func TestPathClarkNotation(t *testing.T) {
+	s := `<root xmlns:a="http://example.com/ns" xmlns:b="http://example.com/ns">
+	<a:item>1</a:item>
+	<b:item>2</b:item>
+	<item xmlns="http://example.com/ns">3</item>
+	<item>4</item>
+	<a:other>5</a:other>
+	<c:item xmlns:c="http://example.com/ns/[1]|x">6</c:item>
+</root>`
+	doc := newDocumentFromString(t, s)
+
+	cases := []struct {
+		path   string
+		result string
+	}{
+		{"{http://example.com/ns}item", ""},
+		{"root/{http://example.com/ns}item", "123"},
+		{"//{http://example.com/ns}item", "123"},
+		{"//{http://example.com/ns}item[2]", "2"},
+		{"//{http://example.com/ns}item[text()='3']", "3"},
+		{"//{http://example.com/ns}*", "1235"},
+		{"//{http://example.com/ns/[1]|x}item", "6"},
+		{"//{http://example.com/ns/[1]|x}item | //{}item", "46"},
+		{"//{http://example.com/other}item", ""},
+	}
+	for _, c := range cases {
+		var result string
+		for _, e := range doc.FindElements(c.path) {
+			result += e.Text()
+		}
+		if result != c.result {
+			t.Errorf("etree: path '%s' selected '%s', expected '%s'", c.path, result, c.result)
+		}
+	}
+
+	e, err := FindFirst(strings.NewReader(s), "//root/{http://example.com/ns}item", newReadSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Text() != "1" || e.Space != "a" {
+		t.Error("etree: FindFirst failed to match a Clark notation path")
+	}
+}
+
+func TestPathFeatures(t *testing.T) {
+	cases := []struct {
+		path     string
+		features PathFeatures
+	}{
+		{"title", PathFeatures{MaxDepth: 1}},
+		{"./bookstore/book/title", PathFeatures{MaxDepth: 4}},
+		{"//book/title", PathFeatures{UsesDescendant: true, MaxDepth: 4}},
+		{"/bookstore/book[@category='WEB']", PathFeatures{UsesPredicates: true, MaxDepth: 3}},
+		{"book[2]/author[@x or @y]", PathFeatures{UsesPredicates: true, UsesPositional: true, MaxDepth: 2}},
+		{"title | .//book//price[1]", PathFeatures{UsesDescendant: true, UsesPredicates: true, UsesPositional: true, UsesUnion: true, MaxDepth: 5}},
+	}
+	for _, c := range cases {
+		f := MustCompilePath(c.path).Features()
+		if f != c.features {
+			t.Errorf("etree: Features(%q) = %+v, wanted %+v", c.path, f, c.features)
+		}
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Indent(2)
+	expected, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := MustCompilePath("//book[@category='WEB']/title")
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if n := len(doc.FindElementsPath(path)); n != 2 {
+					errs <- "FindElementsPath"
+					return
+				}
+				if n := len(doc.FindElements("//author")); n != 8 {
+					errs <- "FindElements"
+					return
+				}
+				book := doc.SelectElement("bookstore").SelectElement("book")
+				if book.SelectAttrValue("category", "") != "COOKING" || book.GetPath() != "/bookstore/book" {
+					errs <- "SelectElement"
+					return
+				}
+				if s, _ := doc.WriteToString(); s != expected {
+					errs <- "WriteToString"
+					return
+				}
+				if doc.Copy().Root().FindElement("book/title").Text() != "Everyday Italian" {
+					errs <- "Copy"
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for name := range errs {
+		t.Errorf("etree: incorrect %s result during concurrent reads", name)
+	}
+}
+
+func TestEmptyPath(t *testing.T) {
+	doc := newDocumentFromString(t, `<a><b/></a>`)
+
+	for _, path := range []string{"", "  "} {
+		p, err := CompilePath(path)
+		if err != nil {
+			t.Errorf("etree: CompilePath(%q) failed: %v", path, err)
+			continue
+		}
+		checkIntEq(t, len(p.segments), 1)
+		checkIntEq(t, len(p.union), 0)
+	}
+
+	checkBoolEq(t, doc.FindElement("") == &doc.Element, true)
+	checkBoolEq(t, doc.Root().FindElement("") == doc.Root(), true)
+	checkIntEq(t, len(doc.FindElements("")), 3)
+	checkBoolEq(t, doc.FindElement("  ") == nil, true)
+	checkIntEq(t, len(doc.FindElements("  ")), 0)
+}
+
+func TestFindElementsReverse(t *testing.T) {
+	doc := newDocumentFromString(t, testXML)
+
+	for _, path := range []string{"//author", "//book[@category='WEB']/title", "//title | //year", "//nothing"} {
+		forward := doc.FindElements(path)
+		reverse := doc.FindElementsReverse(path)
+		checkIntEq(t, len(reverse), len(forward))
+		for i, e := range reverse {
+			if e != forward[len(forward)-1-i] {
+				t.Errorf("etree: incorrect FindElementsReverse result for '%s'", path)
+				break
+			}
+		}
+	}
+
+	for _, e := range doc.FindElementsReverse("//author") {
+		e.Parent().RemoveChildAt(e.Index())
+	}
+	checkIntEq(t, doc.CountElements("//author"), 0)
+}
+
+func TestFindElementErr(t *testing.T) {
+	doc := newDocumentFromString(t, testXML)
+
+	e, err := doc.FindElementErr("//book/title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, e.Text(), "Everyday Italian")
+	if _, err := doc.FindElementErr("//nothing"); err != ErrNotFound {
+		t.Errorf("etree: FindElementErr returned error %v for a missing element", err)
+	}
+	if _, err := doc.FindElementErr("//book["); err == nil {
+		t.Error("etree: FindElementErr accepted an invalid path")
+	} else if _, ok := err.(ErrPath); !ok {
+		t.Errorf("etree: FindElementErr returned error %v for an invalid path", err)
+	}
+
+	e, err = doc.FindExactlyOne("//book[@category='WEB'][1]/title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, e.Text(), "XQuery Kick Start")
+	if _, err := doc.FindExactlyOne("//nothing"); err != ErrNotFound {
+		t.Errorf("etree: FindExactlyOne returned error %v for a missing element", err)
+	}
+	if _, err := doc.FindExactlyOne("//title"); err != ErrMultiple {
+		t.Errorf("etree: FindExactlyOne returned error %v for several elements", err)
+	}
+	if _, err := doc.FindExactlyOne("//book["); err == nil {
+		t.Error("etree: FindExactlyOne accepted an invalid path")
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	defer SetPathCacheSize(DefaultPathCacheSize)
+	doc := newDocumentFromString(t, testXML)
+
+	cached := func(path string) bool {
+		pathCache.mu.RLock()
+		defer pathCache.mu.RUnlock()
+		_, ok := pathCache.items[path]
+		return ok
+	}
+
+	SetPathCacheSize(2)
+	checkIntEq(t, len(doc.FindElements("//title")), 4)
+	checkIntEq(t, doc.CountElements("//author"), 8)
+	checkBoolEq(t, cached("//title"), true)
+	checkBoolEq(t, cached("//author"), true)
+
+	// Using //title makes //author the least recently used path.
+	checkStrEq(t, doc.FindElement("//title").Text(), "Everyday Italian")
+	doc.FindElement("//year")
+	checkBoolEq(t, cached("//title"), true)
+	checkBoolEq(t, cached("//author"), false)
+	checkBoolEq(t, cached("//year"), true)
+
+	SetPathCacheSize(0)
+	checkIntEq(t, len(pathCache.items), 0)
+	checkIntEq(t, len(doc.FindElements("//title")), 4)
+	checkBoolEq(t, cached("//title"), false)
+
+	SetPathCacheSize(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths := []string{"//title", "//author", "//year", "//price", "//book[1]", "//book[2]", "//isbn", "//editor", "//p:price", "//book"}
+			for j := 0; j < 50; j++ {
+				doc.FindElements(paths[(i+j)%len(paths)])
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkIntEq(t, len(pathCache.items), 8)
+}
+
+func TestFindElementsAcross(t *testing.T) {
+	a := newDocumentFromString(t, `<a><x id="1"/><y><x id="2"/></y></a>`)
+	b := newDocumentFromString(t, `<b><x id="3"/></b>`)
+	c := newDocumentFromString(t, `<c/>`)
+	roots := []*Element{a.Root(), nil, c.Root(), b.Root()}
+
+	var ids []string
+	for _, e := range FindElementsAcross(roots, "//x") {
+		ids = append(ids, e.SelectAttrValue("id", ""))
+	}
+	checkStrEq(t, strings.Join(ids, ","), "1,2,3")
+
+	elements := FindElementsAcrossPath(roots, MustCompilePath("x"))
+	checkIntEq(t, len(elements), 2)
+	if FindElementsAcross(nil, "x") != nil {
+		t.Error("etree: expected no elements")
+	}
+}
+
+func TestCountElements(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Error(err)
+	}
+
+	checkIntEq(t, doc.CountElements("//author"), 8)
+	checkIntEq(t, doc.CountElements("//book[@category='WEB']/author"), 6)
+	checkIntEq(t, doc.CountElements("//book/.."), 1)
+	checkIntEq(t, doc.CountElements("//title | //book/title"), 4)
+	checkIntEq(t, doc.CountElements("//isbn"), 0)
+}
+
 func TestAbsolutePath(t *testing.T) {
 	doc := NewDocument()
 	err := doc.ReadFromString(testXML)
@@ -220,3 +533,50 @@ func TestAbsolutePath(t *testing.T) {
 		}
 	}
 }
+
+func TestFindFirst(t *testing.T) {
+	cases := []struct {
+		path   string
+		result string
+	}{
+		{"//title", "Everyday Italian"},
+		{"./bookstore/book[@category='WEB']/title", "XQuery Kick Start"},
+		{"/bookstore/book[@path]/title[@lang='en']", "Learning XML"},
+		{"//p:price[@tax]", "29.99"},
+		{"//*[namespace-uri()='urn:books-com:prices']", "30.00"},
+		{"//book[@category='CHILDREN' or @path]/title[@lang='en' and @sku]", "Harry Potter"},
+		{"//book[not(@category='COOKING')]/title[not(@lang='de')]", "Harry Potter"},
+		{"bookstore/*/isbn", ""},
+	}
+	for _, c := range cases {
+		e, err := FindFirst(strings.NewReader(testXML), c.path, newReadSettings())
+		if err != nil {
+			t.Errorf("etree: FindFirst failed for '%s': %v", c.path, err)
+			continue
+		}
+		switch {
+		case c.result == "":
+			if e != nil {
+				t.Errorf("etree: FindFirst failed for '%s'", c.path)
+			}
+		case e == nil || e.Text() != c.result || e.Parent() != nil:
+			t.Errorf("etree: FindFirst failed for '%s'", c.path)
+		}
+	}
+
+	// Reading stops after the matched element, so later errors are ignored.
+	s := `<root><a x="1"><b>first</b></a><a x="2"></b>`
+	e, err := FindFirst(strings.NewReader(s), "//a[@x]", newReadSettings())
+	if err != nil || e == nil {
+		t.Fatalf("etree: FindFirst failed: %v", err)
+	}
+	doc := NewDocumentWithRoot(e)
+	str, _ := doc.WriteToString()
+	checkStrEq(t, str, `<a x="1"><b>first</b></a>`)
+
+	for _, path := range []string{"//title[1]", "//book[title]", "//title[text()='a']", "//a/..", "//a | //b", "//book[@path or title]"} {
+		if _, err := FindFirst(strings.NewReader(testXML), path, newReadSettings()); err == nil {
+			t.Errorf("etree: FindFirst should have rejected '%s'", path)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidName is reported by Validate for an element tag, attribute
+	// key or processing instruction target that is not a valid XML name.
+	ErrInvalidName = errors.New("etree: invalid XML name")
+
+	// ErrInvalidCData is reported by Validate for a CDATA section containing
+	// the sequence "]]>", which would end the section early. See
+	// Element.SetCDataSplit.
+	ErrInvalidCData = errors.New(`etree: CDATA section contains "]]>"`)
+
+	// ErrInvalidComment is reported by Validate for a comment containing the
+	// sequence "--" or ending with "-".
+	ErrInvalidComment = errors.New(`etree: comment contains "--" or ends with "-"`)
+
+	// ErrInvalidProcInst is reported by Validate for a processing instruction
+	// whose Inst contains the sequence "?>".
+	ErrInvalidProcInst = errors.New(`etree: processing instruction contains "?>"`)
+
+	// ErrInvalidChar is reported by Validate for character data, an attribute
+	// value, a comment, a directive or a processing instruction containing
+	// invalid UTF-8 or a character that is not allowed in XML, such as most
+	// control characters. Such characters in text and attribute values are
+	// written as the Unicode replacement character U+FFFD, while in other
+	// tokens they produce malformed XML.
+	ErrInvalidChar = errors.New("etree: text contains a character not allowed in XML")
+)
+
+// A ValidationError describes a problem found by Validate.
+type ValidationError struct {
+	Path string // the IndexedPath of the element containing the problem
+	Err  error  // one of the ErrInvalid* errors
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error() + " at " + e.Path
+}
+
+// Unwrap returns the underlying ErrInvalid* error, so that a ValidationError
+// can be matched with errors.Is.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks the document's tokens for content that can't be written as
+// well-formed XML, such as element tags that aren't valid XML names and
+// comments containing "--", and returns a ValidationError for each problem
+// found, in document order. It returns nil if no problems are found. See
+// Element.Validate.
+func (d *Document) Validate() []error {
+	var errs []error
+	for _, c := range d.Child {
+		errs = validateToken(c, &d.Element, errs)
+	}
+	return errs
+}
+
+// Validate checks the element and its descendants for content that can't be
+// written as well-formed XML, and returns a ValidationError for each problem
+// found, in document order. The Err field of each ValidationError is one of
+// ErrInvalidName, ErrInvalidCData, ErrInvalidComment, ErrInvalidProcInst and
+// ErrInvalidChar, and its Path field is the IndexedPath of the element
+// whose tag, attributes or child tokens contain the problem. It returns nil
+// if no problems are found. Validate is meant as a check before writing a
+// programmatically modified tree; it does not validate the document against
+// a schema or DTD, or check namespace prefixes for declarations.
+func (e *Element) Validate() []error {
+	return validateToken(e, e.Parent(), nil)
+}
+
+// validateToken appends the problems found in the token 't', whose parent
+// is 'parent', and in its descendants to 'errs'.
+func validateToken(t Token, parent *Element, errs []error) []error {
+	report := func(e *Element, err error) {
+		errs = append(errs, &ValidationError{Path: e.IndexedPath(), Err: err})
+	}
+
+	switch t := t.(type) {
+	case *Element:
+		// Namespace URIs that no declaration binds are written with
+		// generated prefixes, which are checked like declared ones.
+		var pw prefixWriter
+		if !IsValidTag(t.writtenTag(&pw)) {
+			report(t, ErrInvalidName)
+		}
+		for i := range t.Attr {
+			a := &t.Attr[i]
+			if !IsValidTag(t.writtenName(a.Space, a.Key, false, &pw)) {
+				report(t, ErrInvalidName)
+			}
+			if !isValidText(a.Value) {
+				report(t, ErrInvalidChar)
+			}
+		}
+		for _, c := range t.Child {
+			errs = validateToken(c, t, errs)
+		}
+	case *CharData:
+		if t.IsCData() && strings.Contains(t.Data, "]]>") {
+			report(parent, ErrInvalidCData)
+		}
+		if !isValidText(t.Data) {
+			report(parent, ErrInvalidChar)
+		}
+	case *Comment:
+		if strings.Contains(t.Data, "--") || strings.HasSuffix(t.Data, "-") {
+			report(parent, ErrInvalidComment)
+		}
+		if !isValidText(t.Data) {
+			report(parent, ErrInvalidChar)
+		}
+	case *Directive:
+		if !isValidText(t.Data) {
+			report(parent, ErrInvalidChar)
+		}
+	case *ProcInst:
+		if !isNCName(t.Target) {
+			report(parent, ErrInvalidName)
+		}
+		if strings.Contains(t.Inst, "?>") {
+			report(parent, ErrInvalidProcInst)
+		}
+		if !isValidText(t.Inst) {
+			report(parent, ErrInvalidChar)
+		}
+	}
+	return errs
+}
+
+// isValidText reports whether the string is valid UTF-8 containing only
+// characters allowed in XML.
+func isValidText(s string) bool {
+	for i, r := range s {
+		if !isInCharacterRange(r) {
+			return false
+		}
+		if r == utf8.RuneError {
+			if _, width := utf8.DecodeRuneInString(s[i:]); width == 1 {
+				return false
+			}
+		}
+	}
+	return true
+}